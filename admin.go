@@ -0,0 +1,516 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Roles that may be granted to admin API tokens.  Each role includes the
+// permissions of the ones before it.
+const (
+	RoleRead  = "read"
+	RoleAdmin = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleRead:  1,
+	RoleAdmin: 2,
+}
+
+// adminAuth holds the bearer tokens permitted to use the admin API, loaded
+// from a JSON file of the form:
+//
+//	{"Tokens": [{"Token": "s3cr3t", "Role": "admin"}, ...]}
+type adminAuth struct {
+	Tokens []struct {
+		Token string
+		Role  string
+	}
+}
+
+func loadAdminAuth(path string) (*adminAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var auth adminAuth
+	if err := json.NewDecoder(f).Decode(&auth); err != nil {
+		return nil, fmt.Errorf("Parsing admin tokens file %v failed: %v", path, err)
+	}
+	for _, t := range auth.Tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("Admin tokens file %v has an empty token.", path)
+		}
+		if _, ok := roleRank[t.Role]; !ok {
+			return nil, fmt.Errorf("Admin tokens file %v has unknown role %q.",
+				path, t.Role)
+		}
+	}
+	return &auth, nil
+}
+
+// role returns the role granted to a request's bearer token, or "" if none.
+func (a *adminAuth) role(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+	token := []byte(strings.TrimPrefix(h, "Bearer "))
+	for _, t := range a.Tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 {
+			return t.Role
+		}
+	}
+	return ""
+}
+
+// require wraps an admin handler so that it only runs for requests carrying
+// a token granted at least the given role.
+func (a *adminAuth) require(role string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		granted := a.role(r)
+		if granted == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if roleRank[granted] < roleRank[role] {
+			logError("Denied %s to a token with role %s.\n", r.URL.Path, granted)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// makeAdminRoutes registers the admin API for whichever administrative
+// operations the driver supports.
+func makeAdminRoutes(r *mux.Router, d VolumeDriver, auth *adminAuth) {
+	if i, ok := d.(InfoDriver); ok {
+		r.HandleFunc("/Admin.Info", auth.require(RoleRead, serveInfo(i)))
+	}
+	r.HandleFunc("/Admin.Capabilities",
+		auth.require(RoleRead, serveCapabilities(d)))
+	r.HandleFunc("/Admin.Operations", auth.require(RoleRead, serveOperations))
+	r.HandleFunc("/Admin.Inventory", auth.require(RoleRead, serveInventory(d)))
+	if p, ok := d.(PlacementDriver); ok {
+		r.HandleFunc("/Admin.Placement", auth.require(RoleRead, servePlacement(p)))
+	}
+	if ml, ok := d.(MountLister); ok {
+		r.HandleFunc("/Admin.Mounts", auth.require(RoleRead, serveMounts(ml)))
+	}
+	if ds, ok := d.(Describer); ok {
+		r.HandleFunc("/Admin.Describe", auth.require(RoleRead, serveDescribe(ds)))
+	}
+	if ml, ok := d.(MountLister); ok {
+		r.HandleFunc("/Admin.Drain", auth.require(RoleAdmin, serveDrain(d)))
+		r.HandleFunc("/Admin.Flush", auth.require(RoleAdmin, serveFlush(ml)))
+	}
+	if fd, ok := d.(ForceDetacher); ok {
+		r.HandleFunc("/Admin.ForceDetach",
+			auth.require(RoleAdmin, serveVolumeSimple(fd.ForceDetach)))
+	}
+	if pa, ok := d.(PreAttacher); ok {
+		r.HandleFunc("/Admin.PreAttach", auth.require(RoleAdmin, servePreAttach(pa)))
+	}
+	if e, ok := d.(Exporter); ok {
+		r.HandleFunc("/Admin.Export", auth.require(RoleAdmin, serveExport(e)))
+	}
+	if f, ok := d.(Freezer); ok && featureAvailable("freeze") {
+		r.HandleFunc("/Admin.Freeze", auth.require(RoleAdmin, serveFreeze(f)))
+		r.HandleFunc("/Admin.Thaw",
+			auth.require(RoleAdmin, serveVolumeSimple(f.Thaw)))
+	}
+	if rs, ok := d.(Resizer); ok && featureAvailable("resize") {
+		r.HandleFunc("/Admin.Resize", auth.require(RoleAdmin, serveResize(rs)))
+	}
+	if sn, ok := d.(Snapshotter); ok {
+		r.HandleFunc("/Admin.Snapshot", auth.require(RoleAdmin, serveSnapshot(sn)))
+	}
+	if rb, ok := d.(RollBacker); ok {
+		r.HandleFunc("/Admin.Rollback", auth.require(RoleAdmin, serveRollback(rb)))
+	}
+	if p, ok := d.(Promoter); ok {
+		r.HandleFunc("/Admin.Clone", auth.require(RoleAdmin, serveClone(p)))
+		r.HandleFunc("/Admin.Promote", auth.require(RoleAdmin, servePromote(p)))
+	}
+	if e, ok := d.(Encrypter); ok {
+		r.HandleFunc("/Admin.Encrypt", auth.require(RoleAdmin, serveEncrypt(e)))
+	}
+}
+
+func serveInfo(d InfoDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		json.NewEncoder(w).Encode(d.Info())
+	}
+}
+
+type inventoryResponse struct {
+	Inventory
+	Err string
+}
+
+func serveInventory(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		inv, err := inventory(d)
+		resp := inventoryResponse{Inventory: inv}
+		if err != nil {
+			operationFailed(r.URL.Path, "")
+			resp.Err = errorString(err)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+type placementResponse struct {
+	Labels map[string]string
+}
+
+func servePlacement(d PlacementDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		json.NewEncoder(w).Encode(placementResponse{
+			Labels: d.Placement(),
+		})
+	}
+}
+
+type mountsResponse struct {
+	Mounts []MountInfo
+}
+
+func serveMounts(d MountLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		json.NewEncoder(w).Encode(mountsResponse{
+			Mounts: d.Mounts(),
+		})
+	}
+}
+
+type describeResponse struct {
+	VolumeDescription
+	Err string
+}
+
+func serveDescribe(d Describer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req volumeRequest
+		var resp describeResponse
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			resp.VolumeDescription, err = d.Describe(req.Name)
+		}
+		if err != nil {
+			operationFailed(r.URL.Path, req.Name)
+			resp.Err = errorString(err)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+type operationsResponse struct {
+	Operations []operation
+}
+
+func serveOperations(w http.ResponseWriter, r *http.Request) {
+	log("* %s\n", r.URL.String())
+	json.NewEncoder(w).Encode(operationsResponse{
+		Operations: inFlightOperations(),
+	})
+}
+
+type encryptRequest struct {
+	Name           string
+	KmsKeyId       string
+	DeleteOriginal bool
+}
+
+type encryptResponse struct {
+	Volume string
+	Err    string
+}
+
+func serveEncrypt(d Encrypter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req encryptRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		var volume string
+		if err == nil {
+			defer beginOperation(r.URL.Path, req.Name)()
+			defer lockVolume(r.URL.Path, req.Name)()
+			volume, err = d.Encrypt(req.Name, req.KmsKeyId, req.DeleteOriginal)
+			log("\tdone: (%s): (%s, %v)\n", req.Name, volume, err)
+		}
+		var errs string
+		if err != nil {
+			operationFailed(r.URL.Path, req.Name)
+			errs = errorString(err)
+		}
+		json.NewEncoder(w).Encode(encryptResponse{
+			Volume: volume,
+			Err:    errs,
+		})
+	}
+}
+
+type preAttachRequest struct {
+	Names []string
+}
+
+type preAttachResponse struct {
+	// Errors by the name of each volume that failed to attach.
+	Errs map[string]string `json:",omitempty"`
+	Err  string
+}
+
+// servePreAttach attaches each of a set of volumes in parallel, reporting
+// which, if any, failed.
+func servePreAttach(d PreAttacher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req preAttachRequest
+		var resp preAttachResponse
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			operationFailed(r.URL.Path, "")
+			resp.Err = errorString(err)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, name := range req.Names {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				defer beginOperation(r.URL.Path, name)()
+				defer lockVolume(r.URL.Path, name)()
+				err := d.PreAttach(name)
+				log("\tdone: (%s): %v\n", name, err)
+				if err != nil {
+					operationFailed(r.URL.Path, name)
+					mu.Lock()
+					if resp.Errs == nil {
+						resp.Errs = make(map[string]string)
+					}
+					resp.Errs[name] = errorString(err)
+					mu.Unlock()
+				}
+			}(name)
+		}
+		wg.Wait()
+		if len(resp.Errs) > 0 {
+			resp.Err = fmt.Sprintf("%d of %d volumes failed to attach.",
+				len(resp.Errs), len(req.Names))
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+type exportRequest struct {
+	Name string
+	Url  string
+}
+
+func serveExport(d Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req exportRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			defer beginOperation(r.URL.Path, req.Name)()
+			defer lockVolume(r.URL.Path, req.Name)()
+			err = d.Export(req.Name, req.Url)
+			log("\tdone: (%s, %s): %v\n", req.Name, req.Url, err)
+		}
+		var errs string
+		if err != nil {
+			operationFailed(r.URL.Path, req.Name)
+			errs = errorString(err)
+		}
+		json.NewEncoder(w).Encode(volumeSimpleResponse{
+			Err: errs,
+		})
+	}
+}
+
+type rollbackRequest struct {
+	Name       string
+	SnapshotId string
+}
+
+func serveRollback(d RollBacker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req rollbackRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			defer beginOperation(r.URL.Path, req.Name)()
+			defer lockVolume(r.URL.Path, req.Name)()
+			err = d.Rollback(req.Name, req.SnapshotId)
+			log("\tdone: (%s, %s): %v\n", req.Name, req.SnapshotId, err)
+		}
+		var errs string
+		if err != nil {
+			operationFailed(r.URL.Path, req.Name)
+			errs = errorString(err)
+		}
+		json.NewEncoder(w).Encode(volumeSimpleResponse{
+			Err: errs,
+		})
+	}
+}
+
+type cloneRequest struct {
+	Name  string
+	Clone string
+}
+
+func serveClone(d Promoter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req cloneRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			defer beginOperation(r.URL.Path, req.Clone)()
+			defer lockVolume(r.URL.Path, req.Clone)()
+			err = d.Clone(req.Name, req.Clone)
+			log("\tdone: (%s, %s): %v\n", req.Name, req.Clone, err)
+		}
+		var errs string
+		if err != nil {
+			operationFailed(r.URL.Path, req.Clone)
+			errs = errorString(err)
+		}
+		json.NewEncoder(w).Encode(volumeSimpleResponse{
+			Err: errs,
+		})
+	}
+}
+
+type promoteRequest struct {
+	Name      string
+	Candidate string
+}
+
+func servePromote(d Promoter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req promoteRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			defer beginOperation(r.URL.Path, req.Name)()
+			defer lockVolumes(r.URL.Path, req.Name, req.Candidate)()
+			err = d.Promote(req.Name, req.Candidate)
+			log("\tdone: (%s, %s): %v\n", req.Name, req.Candidate, err)
+		}
+		var errs string
+		if err != nil {
+			operationFailed(r.URL.Path, req.Name)
+			errs = errorString(err)
+		}
+		json.NewEncoder(w).Encode(volumeSimpleResponse{
+			Err: errs,
+		})
+	}
+}
+
+type freezeRequest struct {
+	Name           string
+	TimeoutSeconds int
+}
+
+func serveFreeze(d Freezer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req freezeRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			defer beginOperation(r.URL.Path, req.Name)()
+			defer lockVolume(r.URL.Path, req.Name)()
+			err = d.Freeze(req.Name, time.Duration(req.TimeoutSeconds)*time.Second)
+			log("\tdone: (%s, %ds): %v\n", req.Name, req.TimeoutSeconds, err)
+		}
+		var errs string
+		if err != nil {
+			operationFailed(r.URL.Path, req.Name)
+			errs = errorString(err)
+		}
+		json.NewEncoder(w).Encode(volumeSimpleResponse{
+			Err: errs,
+		})
+	}
+}
+
+type resizeRequest struct {
+	Name string
+	// The size to grow to in GiB, or how much to grow by as +<GiB> or
+	// +<percent>%.
+	Size string
+}
+
+func serveResize(d Resizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req resizeRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			// Grow takes the volume's lock itself.
+			defer beginOperation(r.URL.Path, req.Name)()
+			var policy ResizePolicy
+			if policy, err = parseResizeTarget(req.Size); err == nil {
+				err = d.Grow(req.Name, policy)
+			}
+			log("\tdone: (%s, %s): %v\n", req.Name, req.Size, err)
+		}
+		var errs string
+		if err != nil {
+			operationFailed(r.URL.Path, req.Name)
+			errs = errorString(err)
+		}
+		json.NewEncoder(w).Encode(volumeSimpleResponse{
+			Err: errs,
+		})
+	}
+}
+
+type snapshotRequest struct {
+	Name     string
+	Snapshot string
+}
+
+func serveSnapshot(d Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req snapshotRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			defer beginOperation(r.URL.Path, req.Name)()
+			defer lockVolume(r.URL.Path, req.Name)()
+			err = d.Snapshot(req.Name, req.Snapshot)
+			log("\tdone: (%s, %s): %v\n", req.Name, req.Snapshot, err)
+		}
+		var errs string
+		if err != nil {
+			operationFailed(r.URL.Path, req.Name)
+			errs = errorString(err)
+		}
+		json.NewEncoder(w).Encode(volumeSimpleResponse{
+			Err: errs,
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// After breakerThreshold consecutive EC2 calls fail for want of AWS (network
+// errors, throttling, or server errors), further calls fail straight away,
+// rather than piling up behind the SDK's retries, until a probe in the
+// background finds AWS reachable again.  A threshold of 0 disables this.
+var (
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+// How many times the breaker has opened.
+var breakerTrips = expvar.NewInt("aws_breaker_trips")
+
+type awsBreaker struct {
+	mu       sync.Mutex
+	failures int
+	open     bool
+	// probe checks whether AWS is reachable again, bypassing the breaker.
+	probe func() error
+}
+
+func newAwsBreaker(probe func() error) *awsBreaker {
+	return &awsBreaker{probe: probe}
+}
+
+// install adds the breaker to a client's request handlers.
+func (b *awsBreaker) install(h *request.Handlers) {
+	if breakerThreshold <= 0 {
+		return
+	}
+	h.Validate.PushFront(b.check)
+	h.Complete.PushBack(b.record)
+}
+
+// check fails a request before it is sent if the breaker is open.
+func (b *awsBreaker) check(r *request.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open {
+		r.Error = errorf(ErrAwsUnavailable,
+			"AWS is unavailable: %v failed calls in a row; not calling %v.",
+			b.failures, r.Operation.Name)
+	}
+}
+
+// record counts a completed request's outcome, opening the breaker once too
+// many have failed in a row.
+func (b *awsBreaker) record(r *request.Request) {
+	if _, ok := r.Error.(*codedError); ok {
+		// Refused by the breaker itself.
+		return
+	}
+	unavailable := r.Error != nil && (request.IsErrorRetryable(r.Error) ||
+		request.IsErrorThrottle(r.Error) ||
+		(r.HTTPResponse != nil &&
+			r.HTTPResponse.StatusCode >= http.StatusInternalServerError))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !unavailable {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= breakerThreshold && !b.open {
+		logError("AWS is unavailable after %v failed calls in a row (%v); "+
+			"failing EC2 calls fast until it recovers.\n", b.failures, r.Error)
+		b.open = true
+		breakerTrips.Add(1)
+		go b.recover()
+	}
+}
+
+// recover probes AWS every cool-down period, closing the breaker once it
+// responds.
+func (b *awsBreaker) recover() {
+	for {
+		time.Sleep(breakerCooldown)
+		err := b.probe()
+		if err == nil {
+			b.mu.Lock()
+			b.open, b.failures = false, 0
+			b.mu.Unlock()
+			log("AWS is reachable again.\n")
+			return
+		}
+		logError("AWS is still unavailable: %v\n", err)
+	}
+}
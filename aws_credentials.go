@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/processcreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+)
+
+// awsCredentials returns credentials vended by a local agent, either over
+// HTTP from endpoint or by running process, for fleets where instance
+// profiles are not allowed.  Returns nil, meaning the SDK's default chain,
+// if neither is given.  Short-lived credentials are refreshed as they expire.
+func awsCredentials(endpoint string, process string) (*credentials.Credentials, error) {
+	switch {
+	case endpoint != "" && process != "":
+		return nil, errors.New(
+			"Only one of a credentials endpoint and process may be configured.")
+	case endpoint != "":
+		return endpointcreds.NewCredentialsClient(
+			*defaults.Config(), defaults.Handlers(), endpoint), nil
+	case process != "":
+		return processcreds.NewCredentials(process), nil
+	}
+	return nil, nil
+}
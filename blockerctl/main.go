@@ -0,0 +1,270 @@
+// Command blockerctl drives blocker's admin API from the command line.
+//
+// Usage:
+//
+//	blockerctl [-url URL] [-token TOKEN] drain [-timeout 5m] [-force]
+//	blockerctl [-url URL] [-token TOKEN] undrain
+//	blockerctl [-url URL] [-token TOKEN] flush VOLUME
+//	blockerctl [-url URL] [-token TOKEN] resize VOLUME SIZE
+//	blockerctl [-url URL] [-token TOKEN] describe VOLUME
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+func main() {
+	url := flag.String("url", "http://127.0.0.1:9070",
+		"base URL of a blocker TCP listener")
+	token := flag.String("token", os.Getenv("BLOCKER_TOKEN"),
+		"admin API bearer token (default $BLOCKER_TOKEN)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: blockerctl [flags] drain [-timeout d] [-force]\n"+
+			"       blockerctl [flags] undrain\n"+
+			"       blockerctl [flags] flush VOLUME\n"+
+			"       blockerctl [flags] resize VOLUME <GiB>|+<GiB>|+<percent>%%\n"+
+			"       blockerctl [flags] describe VOLUME\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch flag.Arg(0) {
+	case "drain":
+		os.Exit(drain(*url, *token, flag.Args()[1:]))
+	case "undrain":
+		if flag.NArg() != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(undrain(*url, *token))
+	case "flush":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(flush(*url, *token, flag.Arg(1)))
+	case "resize":
+		if flag.NArg() != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(resize(*url, *token, flag.Arg(1), flag.Arg(2)))
+	case "describe":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(describe(*url, *token, flag.Arg(1)))
+	default:
+		fmt.Fprintf(os.Stderr, "blockerctl: unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+type drainResponse struct {
+	Volumes     map[string]string
+	StorageFree bool
+	Err         string
+}
+
+// drain stops new mounts on the host and waits for it to become free of
+// volumes, exiting non-zero unless it does.
+func drain(url string, token string, args []string) int {
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 5*time.Minute,
+		"how long to wait for volumes to be unmounted by their users")
+	force := fs.Bool("force", false,
+		"forcibly unmount volumes still mounted after the timeout")
+	fs.Parse(args)
+
+	var dr drainResponse
+	if err := post(url, token, "/Admin.Drain", map[string]interface{}{
+		"TimeoutSeconds": int(timeout.Seconds()),
+		"Force":          *force,
+	}, &dr); err != nil {
+		fmt.Fprintf(os.Stderr, "blockerctl: %v\n", err)
+		return 1
+	}
+	if dr.Err != "" {
+		fmt.Fprintf(os.Stderr, "blockerctl: %v\n", dr.Err)
+		return 1
+	}
+	volumes := make([]string, 0, len(dr.Volumes))
+	for v := range dr.Volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Strings(volumes)
+	for _, v := range volumes {
+		fmt.Printf("%-30s %s\n", v, dr.Volumes[v])
+	}
+	if !dr.StorageFree {
+		fmt.Println("Host still has volumes mounted.")
+		return 1
+	}
+	fmt.Println("Host is storage-free.")
+	return 0
+}
+
+// undrain cancels a drain, so that the host takes new mounts again.
+func undrain(url string, token string) int {
+	var dr drainResponse
+	if err := post(url, token, "/Admin.Drain",
+		map[string]bool{"Cancel": true}, &dr); err != nil {
+		fmt.Fprintf(os.Stderr, "blockerctl: %v\n", err)
+		return 1
+	}
+	if dr.Err != "" {
+		fmt.Fprintf(os.Stderr, "blockerctl: %v\n", dr.Err)
+		return 1
+	}
+	fmt.Println("Host is taking new mounts.")
+	return 0
+}
+
+type flushResponse struct {
+	Consumers int
+	Err       string
+}
+
+// flush writes out a volume's dirty data, e.g. from a container's pre-stop
+// hook, exiting non-zero if it couldn't.
+func flush(url string, token string, volume string) int {
+	var fr flushResponse
+	if err := post(url, token, "/Admin.Flush",
+		map[string]string{"Name": volume}, &fr); err != nil {
+		fmt.Fprintf(os.Stderr, "blockerctl: %v\n", err)
+		return 1
+	}
+	if fr.Err != "" {
+		fmt.Fprintf(os.Stderr, "blockerctl: %v\n", fr.Err)
+		return 1
+	}
+	fmt.Printf("Flushed %v (%d users).\n", volume, fr.Consumers)
+	return 0
+}
+
+type resizeResponse struct {
+	Err string
+}
+
+// resize grows a mounted volume and its filesystem, exiting non-zero if it
+// couldn't.
+func resize(url string, token string, volume string, size string) int {
+	var rr resizeResponse
+	if err := post(url, token, "/Admin.Resize",
+		map[string]string{"Name": volume, "Size": size}, &rr); err != nil {
+		fmt.Fprintf(os.Stderr, "blockerctl: %v\n", err)
+		return 1
+	}
+	if rr.Err != "" {
+		fmt.Fprintf(os.Stderr, "blockerctl: %v\n", rr.Err)
+		return 1
+	}
+	fmt.Printf("Resized %v.\n", volume)
+	return 0
+}
+
+type describeResponse struct {
+	Name  string
+	Mount *struct {
+		Device     string
+		Mountpoint string
+		AttachedAt time.Time
+		VerifiedAt time.Time
+		Refcount   int
+	}
+	Host          map[string]string
+	Backend       map[string]string
+	Discrepancies []string
+	Err           string
+}
+
+// describe prints what blocker's mount table, the host, and the storage
+// backend each say about a volume, and where they disagree, exiting non-zero
+// if they do.
+func describe(url string, token string, volume string) int {
+	var dr describeResponse
+	if err := post(url, token, "/Admin.Describe",
+		map[string]string{"Name": volume}, &dr); err != nil {
+		fmt.Fprintf(os.Stderr, "blockerctl: %v\n", err)
+		return 1
+	}
+	if dr.Err != "" {
+		fmt.Fprintf(os.Stderr, "blockerctl: %v\n", dr.Err)
+		return 1
+	}
+
+	fmt.Printf("Volume %v\n", dr.Name)
+	fmt.Println("Mount table:")
+	if dr.Mount == nil {
+		fmt.Println("  (not mounted)")
+	} else {
+		printFields(map[string]string{
+			"Device":     dr.Mount.Device,
+			"Mountpoint": dr.Mount.Mountpoint,
+			"AttachedAt": dr.Mount.AttachedAt.Format(time.RFC3339),
+			"VerifiedAt": dr.Mount.VerifiedAt.Format(time.RFC3339),
+			"Refcount":   fmt.Sprint(dr.Mount.Refcount),
+		})
+	}
+	fmt.Println("Host:")
+	printFields(dr.Host)
+	fmt.Println("Backend:")
+	printFields(dr.Backend)
+	if len(dr.Discrepancies) == 0 {
+		return 0
+	}
+	fmt.Println("Discrepancies:")
+	for _, d := range dr.Discrepancies {
+		fmt.Printf("  ! %v\n", d)
+	}
+	return 1
+}
+
+// printFields prints key-value pairs in order of their keys.
+func printFields(fields map[string]string) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %-18s %s\n", k+":", fields[k])
+	}
+}
+
+// post sends an admin API request, decoding its response into resp.
+func post(url string, token string, path string,
+	body interface{}, resp interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return errors.New(r.Status)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// How long external commands may take before they are killed: mount and
+// umount, which can hang on a wedged device or server, and long-running
+// filesystem tools such as mkfs and fsck.
+var (
+	mountTimeout     = 2 * time.Minute
+	fsCommandTimeout = time.Hour
+)
+
+// splitArgs splits a command line into arguments at whitespace, honoring
+// single and double quotes and backslash escapes as a shell would, but without
+// expanding anything.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg []rune
+	inArg, escaped := false, false
+	var quote rune
+	for _, c := range s {
+		switch {
+		case escaped:
+			arg, escaped = append(arg, c), false
+		case c == '\\' && quote != '\'':
+			inArg, escaped = true, true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg = append(arg, c)
+		case c == '\'' || c == '"':
+			inArg, quote = true, c
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args, arg, inArg = append(args, string(arg)), nil, false
+			}
+		default:
+			inArg, arg = true, append(arg, c)
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote or escape in %q.", s)
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
+
+// runWithTimeout runs a command like exec.Cmd.CombinedOutput, but kills it if
+// it takes longer than timeout.
+func runWithTimeout(timeout time.Duration, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Don't wait forever for output from children the command left behind.
+	cmd.WaitDelay = 10 * time.Second
+	out, err := cmd.CombinedOutput()
+	return out, timeoutError(ctx, err, name, timeout)
+}
+
+// timeoutError explains the failure of a command killed for taking too long.
+func timeoutError(ctx context.Context, err error, name string,
+	timeout time.Duration) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errorf(ErrCommandTimeout, "%v timed out after %v and was killed.",
+			name, timeout)
+	}
+	return err
+}
+
+// runStreaming runs a long-running command, such as mkfs or fsck, logging its
+// output line by line as it arrives and reporting the latest line as the
+// progress of the volume's in-flight operations.  Returns the combined output,
+// like exec.Cmd.CombinedOutput.  The command is killed if it takes longer than
+// fsCommandTimeout.
+func runStreaming(volume string, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fsCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = 10 * time.Second
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	var out bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			out.WriteString(line + "\n")
+			log("\t%s: %s\n", name, line)
+			operationProgress(volume, line)
+		}
+		// Keep draining if a line was too long to scan, so the command
+		// doesn't block writing to us.
+		io.Copy(&out, pr)
+	}()
+
+	err := cmd.Run()
+	pw.Close()
+	wg.Wait()
+	return out.Bytes(), timeoutError(ctx, err, name, fsCommandTimeout)
+}
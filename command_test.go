@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"-m 0", []string{"-m", "0"}},
+		{"  -m\t0\n-O  ^has_journal ", []string{"-m", "0", "-O", "^has_journal"}},
+		{`-L "my label"`, []string{"-L", "my label"}},
+		{`-L 'my label'`, []string{"-L", "my label"}},
+		{`-L my" "label`, []string{"-L", "my label"}},
+		{`-L ""`, []string{"-L", ""}},
+		{`''`, []string{""}},
+		{`"it's"`, []string{"it's"}},
+		{`'say "hi"'`, []string{`say "hi"`}},
+		{`my\ label`, []string{"my label"}},
+		{`"a\"b"`, []string{`a"b`}},
+		// Backslashes are literal within single quotes.
+		{`'a\b'`, []string{`a\b`}},
+		// Nothing is expanded.
+		{`$HOME * ~`, []string{"$HOME", "*", "~"}},
+	}
+	for _, test := range tests {
+		got, err := splitArgs(test.in)
+		if err != nil {
+			t.Errorf("splitArgs(%q) failed: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestSplitArgsUnterminated(t *testing.T) {
+	for _, in := range []string{`"abc`, `'abc`, `abc\`, `-L "my label`, `'it\'s'`} {
+		if got, err := splitArgs(in); err == nil {
+			t.Errorf("splitArgs(%q) = %q, want an error", in, got)
+		}
+	}
+}
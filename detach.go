@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// What to do with a volume's attachment once its last user unmounts it.
+const (
+	// Detach the volume straight away.
+	DetachPolicyDetach = "detach"
+	// Leave the volume attached, so mounting it here again is faster, at the
+	// cost of one of the instance's device slots.
+	DetachPolicyKeepAttached = "keep-attached"
+	// Leave the volume attached for a while in case it is mounted here again,
+	// detaching it if not.
+	DetachPolicyAfterIdle = "detach-after-idle"
+)
+
+var detachPolicies = map[string]bool{
+	DetachPolicyDetach:       true,
+	DetachPolicyKeepAttached: true,
+	DetachPolicyAfterIdle:    true,
+}
+
+// The detach policy of volumes without a detach-policy option, and how long
+// detach-after-idle volumes stay attached.
+var (
+	defaultDetachPolicy = DetachPolicyDetach
+	detachIdleTimeout   = 10 * time.Minute
+)
+
+// idleDetacher detaches unmounted volumes after a delay, unless they are
+// mounted again first.  Timers are keyed by volume ID.
+type idleDetacher struct {
+	mu     sync.Mutex
+	timers map[string]*idleTimer
+}
+
+type idleTimer struct {
+	*time.Timer
+	PendingDetach
+}
+
+// A PendingDetach is a volume due to be detached once it has been idle long
+// enough.
+type PendingDetach struct {
+	Volume   string
+	VolumeId string
+	At       time.Time
+}
+
+func newIdleDetacher() *idleDetacher {
+	return &idleDetacher{timers: make(map[string]*idleTimer)}
+}
+
+// schedule arranges for detach to be called on volume name, with ID id, after
+// a delay.  When the delay is up, detach is called under the volume's lock,
+// and only if no mount has cancelled it in the meantime, as one that got the
+// lock first may have done while the timer was firing.
+func (i *idleDetacher) schedule(id string, name string, after time.Duration,
+	detach func(name string, id string) error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if t, ok := i.timers[id]; ok {
+		t.Stop()
+	}
+	t := &idleTimer{PendingDetach: PendingDetach{
+		Volume: name, VolumeId: id, At: time.Now().Add(after),
+	}}
+	t.Timer = time.AfterFunc(after, func() {
+		defer lockVolume("detach-idle", name)()
+		i.mu.Lock()
+		current := i.timers[id] == t
+		if current {
+			delete(i.timers, id)
+		}
+		i.mu.Unlock()
+		if !current {
+			return
+		}
+		log("\tVolume %v is idle; detaching it.\n", name)
+		if err := detach(name, id); err != nil {
+			logError("Detaching idle volume %v failed: %v\n", name, err)
+		}
+	})
+	i.timers[id] = t
+}
+
+// cancel stops a volume's pending detach, if any.
+func (i *idleDetacher) cancel(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if t, ok := i.timers[id]; ok {
+		t.Stop()
+		delete(i.timers, id)
+	}
+}
+
+// handOver stops all pending detaches, returning them for another process to
+// take over.
+func (i *idleDetacher) handOver() []PendingDetach {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	pending := []PendingDetach{}
+	for id, t := range i.timers {
+		t.Stop()
+		delete(i.timers, id)
+		pending = append(pending, t.PendingDetach)
+	}
+	return pending
+}
+
+// takeOver schedules detaches handed over by another process, at the times
+// they were due; those already overdue are done straight away.
+func (i *idleDetacher) takeOver(pending []PendingDetach,
+	detach func(name string, id string) error) {
+	for _, p := range pending {
+		after := time.Until(p.At)
+		if after < 0 {
+			after = 0
+		}
+		i.schedule(p.VolumeId, p.Volume, after, detach)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleDetacherDetaches(t *testing.T) {
+	i := newIdleDetacher()
+	detached := make(chan string, 1)
+	i.schedule("vol-1", "data", time.Millisecond, func(name, id string) error {
+		detached <- name + " " + id
+		return nil
+	})
+	select {
+	case got := <-detached:
+		if got != "data vol-1" {
+			t.Errorf("Detached %v, want data vol-1", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle volume was never detached.")
+	}
+}
+
+func TestIdleDetacherCancel(t *testing.T) {
+	i := newIdleDetacher()
+	detached := make(chan string, 1)
+	i.schedule("vol-1", "data", 10*time.Millisecond, func(name, id string) error {
+		detached <- name
+		return nil
+	})
+	i.cancel("vol-1")
+
+	select {
+	case <-detached:
+		t.Error("Volume mounted again was detached.")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// A mount that takes the volume's lock while the timer is firing cancels the
+// detach, even though the timer can no longer be stopped.
+func TestIdleDetacherMountedWhileFiring(t *testing.T) {
+	i := newIdleDetacher()
+	detached := make(chan string, 1)
+	unlock := lockVolume("/VolumeDriver.Mount", "data")
+	i.schedule("vol-1", "data", time.Millisecond, func(name, id string) error {
+		detached <- name
+		return nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	i.cancel("vol-1")
+	unlock()
+
+	select {
+	case <-detached:
+		t.Error("Volume mounted again was detached.")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDetachIdleMounted(t *testing.T) {
+	withMountStateFile(t)
+	d := &ebsVolumeDriver{mounts: newMountTable(), idle: newIdleDetacher()}
+	d.mounts.add("data", "/dev/xvdf", "/mnt/blocker/data", "m1", "/mnt/blocker/data")
+	// The driver has no EC2 client, so this fails if it tries to detach.
+	if err := d.detachIdle("data", "vol-1"); err != nil {
+		t.Errorf("detachIdle of a mounted volume = %v, want it left attached", err)
+	}
+}
+
+func TestIdleDetacherHandOver(t *testing.T) {
+	old := newIdleDetacher()
+	detached := make(chan string, 2)
+	detach := func(name, id string) error {
+		detached <- name
+		return nil
+	}
+	old.schedule("vol-1", "data", time.Hour, detach)
+	old.schedule("vol-2", "logs", 2*time.Hour, detach)
+	pending := old.handOver()
+	if len(pending) != 2 || len(old.timers) != 0 {
+		t.Fatalf("Handed over %+v, leaving %d timers; want 2 and none",
+			pending, len(old.timers))
+	}
+
+	// Pretend the first detach fell due during the handover.
+	for i := range pending {
+		if pending[i].Volume == "data" {
+			pending[i].At = time.Now().Add(-time.Second)
+		}
+	}
+	replacement := newIdleDetacher()
+	replacement.takeOver(pending, detach)
+	select {
+	case got := <-detached:
+		if got != "data" {
+			t.Errorf("Detached %v, want data", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Overdue detach was never done.")
+	}
+	if p := replacement.handOver(); len(p) != 1 || p[0].VolumeId != "vol-2" {
+		t.Errorf("Pending after takeover: %+v, want vol-2", p)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sysBlock = "/sys/block"
+
+// Whether to rescan the PCI bus when an attached volume's device doesn't show
+// up, for kernels whose hotplug support misses EBS attachments.
+var rescanOnAttach bool
+
+// Attachment device names as EC2 reports them, e.g. /dev/sdf or /dev/xvdf.
+var attachDeviceRegexp = regexp.MustCompile("^/dev/(xv|s)d([a-z]+)$")
+
+// Where udev keeps stable links to block devices, named after their model and
+// serial number.
+const diskById = "/dev/disk/by-id"
+
+// findDevice locates the local block device backing an attached EBS volume.
+// On Nitro instances EBS volumes show up as NVMe devices whose serial number
+// is the volume ID without its dash (vol-0123... becomes vol0123...), which
+// is the only reliable way to correlate them, since the kernel names them in
+// discovery order.  udev links such devices under /dev/disk/by-id, e.g. as
+// nvme-Amazon_Elastic_Block_Store_vol0123..., so they are looked up there, or
+// by their serial in sysfs on hosts without udev.  On Xen instances there is
+// no serial, so we fall back to translating the device name used at attach
+// time into the names the kernel may have picked for it.  Returns "" if the
+// device cannot be found.
+func findDevice(volumeId string, attachDevice string) string {
+	serial := strings.Replace(volumeId, "-", "", 1)
+	if links, err := filepath.Glob(filepath.Join(diskById, "*_"+serial)); err == nil {
+		for _, link := range links {
+			if dev, err := filepath.EvalSymlinks(link); err == nil {
+				return dev
+			}
+		}
+	}
+
+	entries, err := ioutil.ReadDir(sysBlock)
+	if err != nil {
+		logError("Listing block devices in %v failed: %v\n", sysBlock, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if readSysfs(filepath.Join(sysBlock, name, "device", "serial")) == serial {
+			return "/dev/" + name
+		}
+	}
+
+	res := attachDeviceRegexp.FindStringSubmatch(attachDevice)
+	if len(res) != 3 {
+		return ""
+	}
+	for _, name := range []string{"sd" + res[2], "xvd" + res[2]} {
+		if _, err := os.Stat(filepath.Join(sysBlock, name)); err == nil {
+			return "/dev/" + name
+		}
+	}
+	return ""
+}
+
+// How long to wait for an attached volume's device to appear, since udev may
+// take a while to process the hotplug event after EC2 reports the attachment.
+var deviceWaitTimeout = 30 * time.Second
+
+// waitForDevice waits up to deviceWaitTimeout for an attached volume's device
+// to appear, returning "" if it never does.
+func waitForDevice(volumeId string, attachDevice string) string {
+	deadline := time.Now().Add(deviceWaitTimeout)
+	for {
+		if dev := findDevice(volumeId, attachDevice); dev != "" {
+			return dev
+		}
+		if !time.Now().Before(deadline) {
+			return ""
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// rescanForDevice asks the kernel to rescan the PCI bus and then waits a few
+// seconds for an attached volume's device to appear, returning "" if it never
+// does.
+func rescanForDevice(volumeId string, attachDevice string) string {
+	log("\tDevice for %v not found; rescanning the PCI bus...\n", volumeId)
+	if err := ioutil.WriteFile("/sys/bus/pci/rescan", []byte("1"), 0200); err != nil {
+		logError("Rescanning the PCI bus failed: %v\n", err)
+		return ""
+	}
+	for i := 0; i < 10; i++ {
+		if dev := findDevice(volumeId, attachDevice); dev != "" {
+			return dev
+		}
+		time.Sleep(time.Second)
+	}
+	return ""
+}
+
+// sameDevice reports whether two device paths name the same block device,
+// following symlinks such as /dev/disk/by-id/... and /dev/xvdf -> /dev/sdf.
+func sameDevice(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	ra, err := filepath.EvalSymlinks(a)
+	if err != nil {
+		ra = a
+	}
+	rb, err := filepath.EvalSymlinks(b)
+	if err != nil {
+		rb = b
+	}
+	return ra == rb
+}
+
+// deviceInUse reports whether the kernel already has a block device under
+// either of the names an attach to the given /dev/sd* slot could produce.
+func deviceInUse(attachDevice string) bool {
+	res := attachDeviceRegexp.FindStringSubmatch(attachDevice)
+	if len(res) != 3 {
+		return false
+	}
+	for _, name := range []string{"sd" + res[2], "xvd" + res[2]} {
+		if _, err := os.Lstat("/dev/" + name); err == nil {
+			return true
+		}
+		if _, err := os.Stat(filepath.Join(sysBlock, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readSysfs returns the trimmed contents of a sysfs attribute, or "" if it
+// cannot be read.
+func readSysfs(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// probeDevice looks for signatures on a device, bypassing blkid's cache.  It
+// returns the type of filesystem on it, if any, or else a description of any
+// other signature found, such as a partition table or RAID member, which a
+// mkfs would destroy just the same.  Both are "" if the device is blank.
+func probeDevice(dev string) (string, string, error) {
+	out, err := exec.Command("blkid", "-p", "-o", "export", dev).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+		// blkid found nothing to report.
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Probing device %v failed: %v", dev, err)
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	switch {
+	case fields["USAGE"] == "filesystem" && fields["TYPE"] != "":
+		return fields["TYPE"], "", nil
+	case fields["TYPE"] != "":
+		return "", fields["TYPE"], nil
+	case fields["PTTYPE"] != "":
+		return "", fields["PTTYPE"] + " partition table", nil
+	}
+	return "", "", nil
+}
+
+// A mountEntry is one line of /proc/mounts.
+type mountEntry struct {
+	Device     string
+	Mountpoint string
+	FsType     string
+	Options    string
+}
+
+// readMounts returns the mounts whose mountpoint lies beneath the given root.
+func readMounts(root string) ([]mountEntry, error) {
+	b, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	var mounts []mountEntry
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[1], root) {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			Device:     fields[0],
+			Mountpoint: fields[1],
+			FsType:     fields[2],
+			Options:    fields[3],
+		})
+	}
+	return mounts, nil
+}
+
+// mountedDevice returns the device mounted at mnt, or "" if none.
+func mountedDevice(mnt string) string {
+	mounts, err := readMounts(mnt)
+	if err != nil {
+		return ""
+	}
+	for _, m := range mounts {
+		if m.Mountpoint == mnt {
+			return m.Device
+		}
+	}
+	return ""
+}
+
+// deviceNumber returns the major:minor number of a block device, or "" if it
+// cannot be determined.
+func deviceNumber(dev string) string {
+	if resolved, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = resolved
+	}
+	return readSysfs(filepath.Join("/sys/class/block", filepath.Base(dev), "dev"))
+}
+
+// deviceSize returns the size of a block device in bytes, or 0 if it cannot
+// be determined.
+func deviceSize(dev string) int64 {
+	if resolved, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = resolved
+	}
+	sectors, _ := strconv.ParseInt(readSysfs(
+		filepath.Join("/sys/class/block", filepath.Base(dev), "size")), 10, 64)
+	return sectors * 512
+}
+
+// tuneDevice sets a block device's read-ahead and IO scheduler.  Failures are
+// logged but otherwise ignored, since the device works either way.
+func tuneDevice(dev string, readAheadKb string, scheduler string) {
+	if resolved, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = resolved
+	}
+	queue := filepath.Join("/sys/class/block", filepath.Base(dev), "queue")
+	settings := [][2]string{
+		{"read_ahead_kb", readAheadKb},
+		{"scheduler", scheduler},
+	}
+	for _, s := range settings {
+		path := filepath.Join(queue, s[0])
+		if err := ioutil.WriteFile(path, []byte(s[1]), 0644); err != nil {
+			logError("Setting %v to %v failed: %v\n", path, s[1], err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The Docker API socket used to find out which containers use each volume,
+// or "" to not look them up.
+var dockerSocket string
+
+// ContainerInfo identifies a container using a volume.
+type ContainerInfo struct {
+	Id   string
+	Name string
+	// The Swarm or Compose service the container belongs to, if any.
+	Service string `json:",omitempty"`
+}
+
+// Service labels, in order of preference.
+var serviceLabels = []string{
+	"com.docker.swarm.service.name",
+	"com.docker.compose.service",
+}
+
+type dockerContainer struct {
+	Id     string
+	Names  []string
+	Labels map[string]string
+	Mounts []struct {
+		Source string
+	}
+}
+
+// dockerClient returns a client for the Docker API at dockerSocket.
+func dockerClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", dockerSocket)
+			},
+		},
+	}
+}
+
+// containersUsing returns the containers with anything beneath mnt mounted.
+func containersUsing(mnt string) ([]ContainerInfo, error) {
+	client := dockerClient()
+	client.Timeout = 10 * time.Second
+	resp, err := client.Get("http://docker/containers/json?all=1")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Listing containers failed: %v", resp.Status)
+	}
+	var all []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&all); err != nil {
+		return nil, err
+	}
+
+	var containers []ContainerInfo
+	for _, c := range all {
+		for _, m := range c.Mounts {
+			if m.Source != mnt && !strings.HasPrefix(m.Source, mnt+"/") {
+				continue
+			}
+			info := ContainerInfo{Id: c.Id}
+			if len(c.Names) > 0 {
+				info.Name = strings.TrimPrefix(c.Names[0], "/")
+			}
+			for _, label := range serviceLabels {
+				if s, ok := c.Labels[label]; ok {
+					info.Service = s
+					break
+				}
+			}
+			containers = append(containers, info)
+			break
+		}
+	}
+	return containers, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Set while the host is being drained, during which new mounts are refused.
+var draining int32
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+// refuseWhileDraining fails mounts of volumes not already mounted on this
+// host while it is being drained.  Further users of volumes that are still
+// mounted are let through, as they hold the volume up anyway.
+func refuseWhileDraining(d VolumeDriver,
+	f func(string, string) (string, error)) func(string, string) (string, error) {
+	return func(name string, id string) (string, error) {
+		if isDraining() && !isMounted(d, name) {
+			return "", errorf(ErrDraining,
+				"Host is being drained; not mounting %v.", name)
+		}
+		return f(name, id)
+	}
+}
+
+func isMounted(d VolumeDriver, name string) bool {
+	ml, ok := d.(MountLister)
+	if !ok {
+		return false
+	}
+	volume, _ := parsePath(name)
+	for _, m := range ml.Mounts() {
+		if m.Volume == volume {
+			return true
+		}
+	}
+	return false
+}
+
+type drainRequest struct {
+	// How long to wait for volumes to be unmounted by their users.
+	TimeoutSeconds int
+	// Whether to unmount volumes still mounted after the timeout.
+	Force bool
+	// Whether to stop draining instead, taking new mounts again.
+	Cancel bool
+}
+
+type drainResponse struct {
+	// The final state of each volume that was mounted: "unmounted",
+	// "mounted", or the error that unmounting it failed with.
+	Volumes     map[string]string
+	StorageFree bool
+	Err         string
+}
+
+// serveDrain stops new mounts and waits for the host to become free of
+// volumes, optionally unmounting any stragglers, so it can be decommissioned.
+// A cancelled drain takes new mounts again, e.g. once a decommissioning has
+// been called off.
+func serveDrain(d VolumeDriver) http.HandlerFunc {
+	ml := d.(MountLister)
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req drainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			operationFailed(r.URL.Path, "")
+			json.NewEncoder(w).Encode(drainResponse{Err: errorString(err)})
+			return
+		}
+		defer beginOperation(r.URL.Path, "")()
+		resp := drainResponse{Volumes: make(map[string]string)}
+		for _, m := range ml.Mounts() {
+			resp.Volumes[m.Volume] = "mounted"
+		}
+		if req.Cancel {
+			atomic.StoreInt32(&draining, 0)
+			log("\tNo longer draining: taking new mounts.\n")
+			resp.StorageFree = len(resp.Volumes) == 0
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		atomic.StoreInt32(&draining, 1)
+		log("\tDraining: refusing new mounts.\n")
+
+		deadline := time.Now().Add(time.Duration(req.TimeoutSeconds) * time.Second)
+		for len(ml.Mounts()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+		}
+
+		remaining := ml.Mounts()
+		if req.Force {
+			for _, m := range remaining {
+				if err := forceUnmount(d, m); err != nil {
+					operationFailed(r.URL.Path, m.Volume)
+					resp.Volumes[m.Volume] = errorString(err)
+				}
+			}
+			remaining = ml.Mounts()
+		}
+
+		still := make(map[string]bool)
+		for _, m := range remaining {
+			still[m.Volume] = true
+		}
+		for volume := range resp.Volumes {
+			if !still[volume] {
+				resp.Volumes[volume] = "unmounted"
+			}
+		}
+		resp.StorageFree = len(remaining) == 0
+		log("\tdone: storage free: %v\n", resp.StorageFree)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// forceUnmount releases every user of a mounted volume, so the driver tears
+// it down as if they had all unmounted it.  Volumes recorded without users,
+// e.g. those handed over by another blocker process, are unmounted directly.
+// It holds the volume's lock, like Docker's own unmounts.
+func forceUnmount(d VolumeDriver, m MountInfo) error {
+	defer lockVolume("drain", m.Volume)()
+	log("\tForcibly unmounting %v.\n", m.Volume)
+	if len(m.Consumers) == 0 {
+		return d.Unmount(m.Volume, "")
+	}
+	for key, path := range m.Consumers {
+		id := key
+		if key == path {
+			// Tracked by path, as Docker sent no mount ID.
+			id = ""
+		}
+		name := m.Volume + strings.TrimPrefix(path, m.Mountpoint)
+		if err := d.Unmount(name, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
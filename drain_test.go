@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeMountDriver records unmounts of the volumes it lists as mounted,
+// forgetting a volume once its last user has unmounted it.
+type fakeMountDriver struct {
+	mounts    []MountInfo
+	unmounted []string
+}
+
+func (d *fakeMountDriver) Create(name string, opts map[string]string) error {
+	return nil
+}
+
+func (d *fakeMountDriver) Mount(name string, id string) (string, error) {
+	return "", nil
+}
+
+func (d *fakeMountDriver) Path(name string) (string, error) {
+	return "", nil
+}
+
+func (d *fakeMountDriver) Remove(name string) error {
+	return nil
+}
+
+func (d *fakeMountDriver) Unmount(name string, id string) error {
+	d.unmounted = append(d.unmounted, name+" "+id)
+	volume, _ := parsePath(name)
+	for i, m := range d.mounts {
+		if m.Volume != volume {
+			continue
+		}
+		for key, path := range m.Consumers {
+			if key == id || (id == "" && key == path) {
+				delete(m.Consumers, key)
+			}
+		}
+		if len(m.Consumers) == 0 {
+			d.mounts = append(d.mounts[:i], d.mounts[i+1:]...)
+		}
+		break
+	}
+	return nil
+}
+
+func (d *fakeMountDriver) Mounts() []MountInfo {
+	return append([]MountInfo(nil), d.mounts...)
+}
+
+func TestForceUnmount(t *testing.T) {
+	tests := []struct {
+		name string
+		m    MountInfo
+		want []string
+	}{
+		{"consumers", MountInfo{Volume: "data", Mountpoint: "/mnt/blocker/data",
+			Consumers: map[string]string{"m1": "/mnt/blocker/data/sub"}},
+			[]string{"data/sub m1"}},
+		{"consumers by path", MountInfo{Volume: "data",
+			Mountpoint: "/mnt/blocker/data",
+			Consumers:  map[string]string{"/mnt/blocker/data": "/mnt/blocker/data"}},
+			[]string{"data "}},
+		// Mounts handed over by another blocker process may have no users.
+		{"no consumers", MountInfo{Volume: "data", Mountpoint: "/mnt/blocker/data"},
+			[]string{"data "}},
+	}
+	for _, test := range tests {
+		d := &fakeMountDriver{mounts: []MountInfo{test.m}}
+		if err := forceUnmount(d, test.m); err != nil {
+			t.Errorf("%v: forceUnmount failed: %v", test.name, err)
+		}
+		if strings.Join(d.unmounted, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%v: unmounted %q, want %q", test.name, d.unmounted, test.want)
+		}
+		if len(d.mounts) != 0 {
+			t.Errorf("%v: %v still mounted", test.name, d.mounts)
+		}
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	defer atomic.StoreInt32(&draining, 0)
+	d := &fakeMountDriver{mounts: []MountInfo{
+		{Volume: "data", Mountpoint: "/mnt/blocker/data"},
+	}}
+	drain := func(body string) drainResponse {
+		w := httptest.NewRecorder()
+		serveDrain(d)(w, httptest.NewRequest("POST", "/Admin.Drain",
+			strings.NewReader(body)))
+		var resp drainResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Decoding the response to %v failed: %v", body, err)
+		}
+		return resp
+	}
+
+	resp := drain(`{"Force": true}`)
+	if !resp.StorageFree || resp.Volumes["data"] != "unmounted" {
+		t.Errorf("Forced drain = %+v, want data unmounted", resp)
+	}
+	if !isDraining() {
+		t.Error("Host is not draining after a drain.")
+	}
+
+	drain(`{"Cancel": true}`)
+	if isDraining() {
+		t.Error("Host is still draining after the drain was cancelled.")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// The filesystem new, empty EBS volumes are formatted with, unless a volume's
+// fstype option says otherwise.
+var ebsFsType = "ext4"
+
+// createVolume provisions a new, empty volume called name, of the size (in
+// GiB) given by the size option, and formats it so that it can be mounted
+// straight away.
+func (d *ebsVolumeDriver) createVolume(name string, opts map[string]string) error {
+	defer d.creating.lock(name)()
+	if _, err := d.volumeId(name); err == nil {
+		return errorf(ErrAlreadyExists, "An EBS volume named %v already exists.", name)
+	}
+	size, _ := strconv.ParseInt(opts["size"], 10, 64)
+	if err := checkVolumeSize(opts, size); err != nil {
+		return err
+	}
+	timeout, err := provisionTimeout(opts)
+	if err != nil {
+		return err
+	}
+	fstype := opts["fstype"]
+	if fstype == "" {
+		fstype = ebsFsType
+	}
+
+	release, err := d.reserveQuota(1, size)
+	if err != nil {
+		return err
+	}
+	vol, err := d.ec2.CreateVolume(d.newVolumeInput(name, size, opts))
+	release()
+	if err != nil {
+		return err
+	}
+	id := *vol.VolumeId
+	log("\tCreated EBS volume %v (%v) of %v GiB.\n", id, name, size)
+	if err := d.checkDuplicate(name, id); err != nil {
+		d.deleteVolume(id)
+		return err
+	}
+	beginPhase(name, "provision")
+
+	err = d.provision(id, timeout, func(ctx context.Context, dev string) error {
+		log("\tFormatting %v with %v...\n", dev, fstype)
+		if out, err := mkfs(name, dev, fstype, opts, false, nil); err != nil {
+			return fmt.Errorf("Formatting %v failed: %v\n%v", dev, err, string(out))
+		}
+		return nil
+	})
+	if err != nil {
+		d.deleteVolume(id)
+		return err
+	}
+	return nil
+}
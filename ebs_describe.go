@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Describe sets the volume's mount table entry beside what the host and EC2
+// say about it, so that where they disagree, e.g. after something other than
+// Blocker unmounted or detached the volume, shows at a glance.
+func (d *ebsVolumeDriver) Describe(name string) (VolumeDescription, error) {
+	volume, _ := parsePath(name)
+	id, err := d.volumeId(volume)
+	if err != nil {
+		return VolumeDescription{}, err
+	}
+	res, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return VolumeDescription{}, err
+	}
+	vol := res.Volumes[0]
+
+	desc := VolumeDescription{
+		Name: volume,
+		Host: map[string]string{},
+		Backend: map[string]string{
+			"VolumeId":         id,
+			"State":            aws.StringValue(vol.State),
+			"Size":             strconv.FormatInt(aws.Int64Value(vol.Size), 10),
+			"VolumeType":       aws.StringValue(vol.VolumeType),
+			"AvailabilityZone": aws.StringValue(vol.AvailabilityZone),
+		},
+	}
+	for _, m := range d.mounts.list() {
+		if m.Volume == volume {
+			m := m
+			desc.Mount = &m
+		}
+	}
+
+	mnt := d.mountPath(volume)
+	mounted := exec.Command("mountpoint", "-q", mnt).Run() == nil
+	dev := volumeDevice(mnt)
+	desc.Host["Mountpoint"] = mnt
+	desc.Host["Mounted"] = strconv.FormatBool(mounted)
+	if dev != "" {
+		desc.Host["Device"] = dev
+	}
+
+	// Which device EC2's attachment to this instance is, if there is one.
+	var local string
+	attachedHere := false
+	for _, a := range vol.Attachments {
+		instance := aws.StringValue(a.InstanceId)
+		desc.Backend["AttachedTo"] = instance
+		desc.Backend["AttachDevice"] = aws.StringValue(a.Device)
+		desc.Backend["AttachmentState"] = aws.StringValue(a.State)
+		if instance == d.instanceId() {
+			attachedHere = true
+			if local = findDevice(id, aws.StringValue(a.Device)); local != "" {
+				desc.Host["AttachedDevice"] = local
+			}
+		}
+	}
+
+	disagree := func(format string, a ...interface{}) {
+		desc.Discrepancies = append(desc.Discrepancies, fmt.Sprintf(format, a...))
+	}
+	if desc.Mount != nil && dev == "" {
+		disagree("The mount table has the volume mounted at %v, but nothing is "+
+			"mounted there.", desc.Mount.Mountpoint)
+	}
+	if desc.Mount == nil && dev != "" {
+		disagree("%v is mounted at %v, but the mount table has no entry for "+
+			"the volume.", dev, mnt)
+	}
+	if desc.Mount != nil && dev != "" && !sameDevice(desc.Mount.Device, dev) {
+		disagree("The mount table has the volume on %v, but %v is mounted.",
+			desc.Mount.Device, dev)
+	}
+	if (desc.Mount != nil || dev != "") && !attachedHere {
+		disagree("The volume is mounted here, but EC2 has it attached to %v.",
+			attachmentOwner(vol))
+	}
+	if attachedHere && local == "" {
+		disagree("EC2 has the volume attached to this instance as %v, but "+
+			"its device is missing.", desc.Backend["AttachDevice"])
+	}
+	if attachedHere && local != "" && dev != "" && !sameDevice(local, dev) {
+		disagree("EC2's attachment is %v, but %v is mounted.", local, dev)
+	}
+	return desc, nil
+}
+
+// attachmentOwner describes which instance a volume is attached to, if any.
+func attachmentOwner(vol *ec2.Volume) string {
+	if len(vol.Attachments) == 0 {
+		return "no instance"
+	}
+	return aws.StringValue(vol.Attachments[0].InstanceId)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The device letters EBS volumes are attached with, as /dev/sd<letters>, and
+// the ranges they were given as.  See
+// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/device_naming.html for
+// the recommended naming scheme, which hosts attaching more than 11 volumes
+// have to go beyond.
+var (
+	deviceRanges     = "f-p"
+	deviceLetters, _ = parseDeviceRanges(deviceRanges)
+)
+
+// parseDeviceRanges parses comma-separated device letters and ranges of them,
+// e.g. "f-z,aa-az", into the device letters they cover, in order.  The two
+// ends of a range must have the same number of letters.
+func parseDeviceRanges(s string) ([]string, error) {
+	var letters []string
+	seen := make(map[string]bool)
+	for _, r := range strings.Split(s, ",") {
+		from, to := r, r
+		if i := strings.Index(r, "-"); i >= 0 {
+			from, to = r[:i], r[i+1:]
+		}
+		if !deviceLetterRegexp.MatchString(from) || len(from) != len(to) ||
+			!deviceLetterRegexp.MatchString(to) || from > to {
+			return nil, fmt.Errorf("Invalid device range %q.", r)
+		}
+		for l := from; l <= to; l = nextDeviceLetters(l) {
+			if !seen[l] {
+				seen[l] = true
+				letters = append(letters, l)
+			}
+			if l == to {
+				break
+			}
+		}
+	}
+	return letters, nil
+}
+
+var deviceLetterRegexp = regexp.MustCompile("^[a-z]{1,2}$")
+
+// nextDeviceLetters returns the device letters after l of the same length,
+// e.g. ab after aa and ba after az.
+func nextDeviceLetters(l string) string {
+	b := []byte(l)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 'z' {
+			b[i]++
+			return string(b)
+		}
+		b[i] = 'a'
+	}
+	return string(b)
+}
+
+// How often AWS refused an attach because its device was taken after all.
+var deviceSlotConflicts = expvar.NewInt("device_slot_conflicts")
+
+// deviceSlots tracks which device letters EC2 has attached something to on
+// this instance, along with the volume ID attached with each ("" if unknown).
+// Unlike probing /dev, this covers attachments still in progress, and devices
+// that other tools attached under names the kernel then changed.  It is seeded
+// from the instance's block device mappings, kept up to date by blocker's own
+// attaches and detaches, and refreshed when it runs out of letters.
+type deviceSlots struct {
+	mu    sync.Mutex
+	taken map[string]string
+	// Letters claimed by attaches still in progress, which EC2 may not
+	// report yet.
+	attaching map[string]bool
+}
+
+func newDeviceSlots() *deviceSlots {
+	return &deviceSlots{
+		taken:     make(map[string]string),
+		attaching: make(map[string]bool),
+	}
+}
+
+// seed replaces what is known of the taken letters with an instance's block
+// device mappings, keeping those claimed by attaches in progress.
+func (s *deviceSlots) seed(mappings []*ec2.InstanceBlockDeviceMapping) {
+	taken := make(map[string]string)
+	for _, m := range mappings {
+		name := strings.TrimPrefix(aws.StringValue(m.DeviceName), "/dev/")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "xvd"), "sd")
+		if !deviceLetterRegexp.MatchString(name) {
+			// E.g. the root device /dev/sda1.
+			continue
+		}
+		id := ""
+		if m.Ebs != nil {
+			id = aws.StringValue(m.Ebs.VolumeId)
+		}
+		taken[name] = id
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for letter := range s.attaching {
+		taken[letter] = s.taken[letter]
+	}
+	s.taken = taken
+}
+
+// claim marks a letter taken by the volume id for an attach, unless it
+// already is.  The attach must then settle or release the letter.
+func (s *deviceSlots) claim(letter string, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.taken[letter]; ok {
+		return false
+	}
+	s.taken[letter] = id
+	s.attaching[letter] = true
+	return true
+}
+
+// settle records that the attach that claimed a letter has finished, whether
+// or not it got the letter: either way, it is taken.
+func (s *deviceSlots) settle(letter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attaching, letter)
+}
+
+// takenElsewhere records that something other than blocker has a letter.
+func (s *deviceSlots) takenElsewhere(letter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.taken[letter] = ""
+}
+
+// release marks a letter free again.
+func (s *deviceSlots) release(letter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.taken, letter)
+	delete(s.attaching, letter)
+}
+
+// releaseVolume marks the letter a volume was attached with free again.
+func (s *deviceSlots) releaseVolume(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for letter, taken := range s.taken {
+		if taken == id {
+			delete(s.taken, letter)
+		}
+	}
+}
+
+// free returns how many letters are neither taken nor in use locally.
+func (s *deviceSlots) free() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, l := range deviceLetters {
+		if _, ok := s.taken[l]; !ok && !deviceInUse("/dev/sd"+l) {
+			n++
+		}
+	}
+	return n
+}
+
+// refreshDeviceSlots reloads the taken device letters from this instance's
+// block device mappings.
+func (d *ebsVolumeDriver) refreshDeviceSlots() error {
+	instances, err := d.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(d.instanceId())},
+	})
+	if err != nil {
+		return err
+	}
+	var mappings []*ec2.InstanceBlockDeviceMapping
+	for _, r := range instances.Reservations {
+		for _, i := range r.Instances {
+			mappings = append(mappings, i.BlockDeviceMappings...)
+		}
+	}
+	d.slots.seed(mappings)
+	return nil
+}
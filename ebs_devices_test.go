@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDeviceRanges(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"f", []string{"f"}},
+		{"f-j", []string{"f", "g", "h", "i", "j"}},
+		{"f-p", strings.Split("fghijklmnop", "")},
+		{"y-z,aa-ac", []string{"y", "z", "aa", "ab", "ac"}},
+		// Ranges wrap from z to the next first letter.
+		{"ay-bb", []string{"ay", "az", "ba", "bb"}},
+		// Letters are only listed once, in the order first given.
+		{"h,f-h", []string{"h", "f", "g"}},
+		{"f-g,f-g", []string{"f", "g"}},
+	}
+	for _, test := range tests {
+		got, err := parseDeviceRanges(test.in)
+		if err != nil {
+			t.Errorf("parseDeviceRanges(%q) failed: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseDeviceRanges(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseDeviceRangesInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"f-",
+		"-p",
+		"p-f",
+		"z-aa",
+		"F-P",
+		"f1",
+		"aaa",
+		"f-p,",
+		"f--p",
+	} {
+		if got, err := parseDeviceRanges(in); err == nil {
+			t.Errorf("parseDeviceRanges(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestNextDeviceLetters(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"a", "b"},
+		{"f", "g"},
+		{"y", "z"},
+		{"aa", "ab"},
+		{"az", "ba"},
+		{"bz", "ca"},
+		// The last letters wrap around to the first of the same length.
+		{"z", "a"},
+		{"zz", "aa"},
+	}
+	for _, test := range tests {
+		if got := nextDeviceLetters(test.in); got != test.want {
+			t.Errorf("nextDeviceLetters(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
@@ -3,99 +3,620 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 type ebsVolumeDriver struct {
-	ec2                 *ec2.EC2
-	ec2meta             *ec2metadata.EC2Metadata
-	awsInstanceId       string
-	awsRegion           string
-	awsAvailabilityZone string
+	ec2       *ec2.EC2
+	ec2meta   *ec2metadata.EC2Metadata
+	s3        *s3.S3
+	awsRegion string
+	identity  *instanceIdentity
+	tenant    *tenant
+	mounts    *mountTable
+	freezer   *freezer
+	poller    *volumePoller
+	idle      *idleDetacher
+	creating  *keyedLocks
+	slots     *deviceSlots
+	// Tags of mounted volumes exported as metric labels, and their resize
+	// policies, by volume name.
+	labelsMu sync.Mutex
+	labels   map[string]map[string]string
+	policies map[string]ResizePolicy
+	// The last description of each volume, for when AWS is unavailable.
+	cacheMu sync.Mutex
+	cache   map[string]cachedVolumeInfo
+	// Serializes the quota checks of creations, so that concurrent ones
+	// can't both squeeze into the tenant's last bit of quota.
+	quotaMu sync.Mutex
 }
 
-func NewEbsVolumeDriver() (VolumeDriver, error) {
-	d := &ebsVolumeDriver{}
-
-	ec2sess := session.New()
-	d.ec2meta = ec2metadata.New(ec2sess)
+type cachedVolumeInfo struct {
+	info VolumeInfo
+	at   time.Time
+}
 
-	// Fetch AWS information, validating along the way.
-	if !d.ec2meta.Available() {
-		return nil, errors.New("Not running on an EC2 instance.")
-	}
-	var err error
-	if d.awsInstanceId, err = d.ec2meta.GetMetadata("instance-id"); err != nil {
-		return nil, err
+// NewEbsVolumeDriver creates a driver for EBS volumes in the availability zone
+// of this instance.  The instance ID, region, and zone are looked up through
+// the instance metadata service, unless all of them are given.  AWS calls use
+// creds, or the SDK's default credential chain if nil.
+func NewEbsVolumeDriver(instanceId string, region string, zone string,
+	creds *credentials.Credentials) (VolumeDriver, error) {
+	d := &ebsVolumeDriver{
+		identity: &instanceIdentity{},
+		tenant:   defaultTenant(),
+		mounts:   newMountTable(),
+		freezer:  newFreezer(),
+		idle:     newIdleDetacher(),
+		creating: newKeyedLocks(),
+		slots:    newDeviceSlots(),
+		labels:   make(map[string]map[string]string),
+		policies: make(map[string]ResizePolicy),
+		cache:    make(map[string]cachedVolumeInfo),
 	}
-	if d.awsRegion, err = d.ec2meta.Region(); err != nil {
-		return nil, err
-	}
-	if d.awsAvailabilityZone, err =
-		d.ec2meta.GetMetadata("placement/availability-zone"); err != nil {
-		return nil, err
+
+	ec2sess := session.New(&aws.Config{Credentials: creds})
+	d.ec2meta = ec2metadata.New(ec2sess, &aws.Config{
+		HTTPClient: &http.Client{Timeout: metadataTimeout},
+		MaxRetries: aws.Int(metadataRetries),
+	})
+	source := "Auto-detected"
+
+	if instanceId != "" && region != "" && zone != "" {
+		// Some environments block the metadata service, or proxy it such
+		// that Available() fails, despite running on EC2.
+		d.identity.instanceId, d.awsRegion, d.identity.zone =
+			instanceId, region, zone
+		source = "Configured"
+	} else if instanceId != "" || region != "" || zone != "" {
+		return nil, errors.New(
+			"Instance ID, region, and availability zone must be configured together.")
+	} else {
+		// Fetch AWS information, validating along the way.
+		var err error
+		if d.identity.instanceId, err =
+			d.ec2meta.GetMetadata("instance-id"); err == nil {
+			d.awsRegion, err = d.ec2meta.Region()
+		}
+		if err == nil {
+			d.identity.zone, err =
+				d.ec2meta.GetMetadata("placement/availability-zone")
+		}
+		if err != nil {
+			return nil, errorf(ErrMetadataUnavailable,
+				"The instance metadata service did not answer within %v "+
+					"(%d retries); is this an EC2 instance? %v",
+				metadataTimeout, metadataRetries, err)
+		}
 	}
 
 	d.ec2 = ec2.New(ec2sess, &aws.Config{Region: aws.String(d.awsRegion)})
+	probe := ec2.New(ec2sess, &aws.Config{Region: aws.String(d.awsRegion)})
+	newAwsBreaker(func() error {
+		_, err := probe.DescribeAvailabilityZones(
+			&ec2.DescribeAvailabilityZonesInput{})
+		return err
+	}).install(&d.ec2.Handlers)
+	d.s3 = s3.New(ec2sess, &aws.Config{Region: aws.String(d.awsRegion)})
+	d.poller = newVolumePoller(d.ec2)
+	if err := d.refreshDeviceSlots(); err != nil {
+		// Attaches refresh them again once AWS is back.
+		logError("Loading the instance's block device mappings failed: %v\n", err)
+	}
 
 	// Print some diagnostic information and then return the driver.
-	log("Auto-detected EC2 information:\n")
-	log("\tInstanceId        : %v\n", d.awsInstanceId)
+	log("%s EC2 information:\n", source)
+	log("\tInstanceId        : %v\n", d.instanceId())
 	log("\tRegion            : %v\n", d.awsRegion)
-	log("\tAvailability Zone : %v\n", d.awsAvailabilityZone)
+	log("\tAvailability Zone : %v\n", d.zone())
+	if source == "Auto-detected" && identityCheckInterval > 0 {
+		d.watchIdentity(identityCheckInterval)
+	}
+	if tagRepairInterval > 0 {
+		d.watchTags(tagRepairInterval)
+	}
 	return d, nil
 }
 
-func (d *ebsVolumeDriver) Create(path string) error {
+// forTenant creates a driver serving a tenant the EBS volumes with its managed
+// tag, mounted beneath its own mount root.  The driver shares this one's AWS
+// clients, identity, and device slots, as they belong to the instance.
+func (d *ebsVolumeDriver) forTenant(t *tenant) *ebsVolumeDriver {
+	td := &ebsVolumeDriver{
+		ec2:       d.ec2,
+		ec2meta:   d.ec2meta,
+		s3:        d.s3,
+		awsRegion: d.awsRegion,
+		identity:  d.identity,
+		tenant:    t,
+		mounts:    newMountTableAt(t.mountState),
+		freezer:   newFreezer(),
+		poller:    d.poller,
+		idle:      newIdleDetacher(),
+		creating:  newKeyedLocks(),
+		slots:     d.slots,
+		labels:    make(map[string]map[string]string),
+		policies:  make(map[string]ResizePolicy),
+		cache:     make(map[string]cachedVolumeInfo),
+	}
+	log("Serving tenant %v, with managed tag %v, beneath %v.\n",
+		t.Name, t.ManagedTag, t.MountRoot)
+	if tagRepairInterval > 0 {
+		td.watchTags(tagRepairInterval)
+	}
+	return td
+}
+
+func (d *ebsVolumeDriver) Create(path string, opts map[string]string) error {
+	volume, _ := parsePath(path)
+	if err := checkOptionKinds(opts); err != nil {
+		return err
+	}
+	if err := validateOptions(opts); err != nil {
+		return err
+	}
+	if err := validateCreateOptions(opts); err != nil {
+		return err
+	}
+	if _, ok := opts["import-from"]; ok && d.tenant.Name != "" {
+		// The instance's S3 access isn't the tenant's to use.
+		return errorf(ErrInvalidOption,
+			"The import-from option is not available to tenants.")
+	}
+	if url, ok := opts["import-from"]; ok {
+		if err := d.importVolume(volume, url, opts); err != nil {
+			return err
+		}
+	}
+	if snap, ok := opts["snapshot-id"]; ok {
+		if err := d.restoreVolume(volume, snap, opts); err != nil {
+			return err
+		}
+	}
+	if _, ok := opts["size"]; ok && !isSeeded(opts) {
+		if err := d.createVolume(volume, opts); err != nil {
+			return err
+		}
+	}
+
+	// Remember any options needed when mounting the volume later on.
+	for _, key := range persistentOptions {
+		if _, ok := opts[key]; ok {
+			id, err := d.volumeId(volume)
+			if err != nil {
+				return err
+			}
+			return d.saveOptions(id, opts)
+		}
+	}
 	return nil
 }
 
-func (d *ebsVolumeDriver) Mount(path string) (string, error) {
+func (d *ebsVolumeDriver) Mount(path string, id string) (string, error) {
 	volume, folder := parsePath(path)
-	mnt, err := d.doMount(volume)
+
+	// Docker repeats mounts, e.g. for running containers after it restarts;
+	// hand back the same mountpoint without touching the attachment.
+	if dev, ok := d.mounts.existing(volume); ok {
+		mnt := d.mountPath(volume)
+		log("\tVolume %v is already mounted at %v.\n", volume, mnt)
+		d.mounts.add(volume, dev, mnt, id, mnt+folder)
+		return mnt + folder, nil
+	}
+	mnt, dev, err := d.doMount(volume)
 	if err != nil {
 		return "", err
 	}
+	d.mounts.add(volume, dev, mnt, id, mnt+folder)
 	return mnt + folder, nil
 }
 
+// Path is called by dockerd far more often than anything else, so volumes
+// known to be mounted are answered from the mount table.  Others, e.g. those
+// mounted before Blocker restarted, are looked for on the host.
 func (d *ebsVolumeDriver) Path(path string) (string, error) {
 	volume, folder := parsePath(path)
-	mnt := fmt.Sprintf("/mnt/blocker/%s%s", volume, folder)
+	if _, ok := d.mounts.existing(volume); ok {
+		return d.mountPath(volume) + folder, nil
+	}
+	mnt := d.mountPath(volume) + folder
 	if stat, err := os.Stat(mnt); err != nil || !stat.IsDir() {
-		return "", errors.New("Volume not mounted.")
+		return "", errorf(ErrNotMounted, "Volume not mounted.")
 	}
 	return mnt, nil
 }
 
+// Get describes a volume.  If the EC2 API can't be reached, it falls back to
+// the last description of the volume, or failing that what is known of it
+// locally, marked as stale, so that hosts stay manageable during outages.
+func (d *ebsVolumeDriver) Get(path string) (VolumeInfo, error) {
+	info, err := d.describe(path)
+	if err == nil {
+		d.cacheMu.Lock()
+		d.cache[path] = cachedVolumeInfo{info: info, at: time.Now()}
+		d.cacheMu.Unlock()
+		return info, nil
+	}
+	if code := errorCode(err); code != ErrAwsApi && code != ErrAwsUnavailable {
+		return VolumeInfo{}, err
+	}
+
+	d.cacheMu.Lock()
+	cached, ok := d.cache[path]
+	d.cacheMu.Unlock()
+	stale := VolumeInfo{Name: path, Status: map[string]interface{}{}}
+	if ok {
+		stale.Mountpoint = cached.info.Mountpoint
+		for k, v := range cached.info.Status {
+			stale.Status[k] = v
+		}
+		stale.Status["CachedAt"] = cached.at
+	} else {
+		volume, folder := parsePath(path)
+		if _, ok := d.mounts.existing(volume); !ok &&
+			volumeDevice(d.mountPath(volume)) == "" {
+			return VolumeInfo{}, err
+		}
+		stale.Mountpoint = d.mountPath(volume) + folder
+	}
+	logError("Describing %v failed; serving stale information: %v\n", path, err)
+	stale.Status["Stale"] = true
+	return stale, nil
+}
+
+// List describes the volumes mounted on this host.
+func (d *ebsVolumeDriver) List() ([]VolumeInfo, error) {
+	volumes := []VolumeInfo{}
+	for _, m := range d.mounts.list() {
+		info, err := d.Get(m.Volume)
+		if err != nil {
+			info = VolumeInfo{Name: m.Volume, Mountpoint: m.Mountpoint}
+		}
+		volumes = append(volumes, info)
+	}
+	return volumes, nil
+}
+
+func (d *ebsVolumeDriver) describe(path string) (VolumeInfo, error) {
+	volume, _ := parsePath(path)
+	id, err := d.volumeId(volume)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	opts, _, err := d.loadOptions(id)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+
+	info := VolumeInfo{
+		Name:   path,
+		Status: map[string]interface{}{"VolumeId": id},
+	}
+	for _, key := range throttleOptions {
+		if v, ok := opts[key]; ok {
+			info.Status[key] = v
+		}
+	}
+	mnt := d.mountPath(volume)
+	dev := mountedDevice(mnt)
+	if dev == "" {
+		if dev = partitionedDisk(mnt); dev != "" {
+			var parts []string
+			for _, m := range mountedPartitions(mnt) {
+				parts = append(parts, m.Mountpoint)
+			}
+			info.Status["Partitions"] = parts
+		} else if dev = linkedDevice(mnt); dev != "" {
+			info.Status["AttachOnly"] = true
+		}
+	}
+	if dev != "" {
+		info.Mountpoint = mnt
+		info.Status["Device"] = dev
+		info.Status["DeviceNumber"] = deviceNumber(dev)
+	}
+	return info, nil
+}
+
+// Remove unmounts a volume, and with the delete reclaim policy also deletes
+// its EBS volume.
 func (d *ebsVolumeDriver) Remove(path string) error {
 	volume, _ := parsePath(path)
-	err := d.doUnmount(volume)
+	id, err := d.volumeId(volume)
+	if err != nil {
+		return err
+	}
+	policy, opts, vol, err := d.reclaimPolicy(id)
 	if err != nil {
 		return err
 	}
+	if policy == ReclaimPolicyDelete {
+		if err := d.reclaim(volume, id, vol, opts["wipe"] == "true"); err != nil {
+			d.mounts.invalidate(volume)
+			return err
+		}
+		return nil
+	}
+
+	err = d.doUnmount(volume, DetachPolicyDetach)
+	if err != nil {
+		d.mounts.invalidate(volume)
+		return err
+	}
+	d.mounts.remove(volume)
 	return nil
 }
 
-func (d *ebsVolumeDriver) Unmount(path string) error {
+func (d *ebsVolumeDriver) Unmount(path string, id string) error {
+	volume, folder := parsePath(path)
+
+	// Containers may share one attachment of a volume, even at different
+	// sub-paths of it; only detach once the last of them is done with it.
+	if d.mounts.release(volume, id, d.mountPath(volume)+folder) > 0 {
+		log("\tVolume %v still in use; leaving it mounted.\n", volume)
+		return nil
+	}
+	err := d.doUnmount(volume, "")
+	if err != nil {
+		d.mounts.invalidate(volume)
+		return err
+	}
+	d.mounts.remove(volume)
+	return nil
+}
+
+func (d *ebsVolumeDriver) Mounts() []MountInfo {
+	return d.mounts.list()
+}
+
+func (d *ebsVolumeDriver) RestoreMounts(mounts []MountInfo) {
+	d.mounts.restore(mounts)
+}
+
+func (d *ebsVolumeDriver) HandOverDetaches() []PendingDetach {
+	return d.idle.handOver()
+}
+
+func (d *ebsVolumeDriver) TakeOverDetaches(detaches []PendingDetach) {
+	d.idle.takeOver(detaches, d.detachIdle)
+}
+
+func (d *ebsVolumeDriver) VolumeLabels(name string) map[string]string {
+	d.labelsMu.Lock()
+	defer d.labelsMu.Unlock()
+	return d.labels[name]
+}
+
+// rememberLabels records the tags of a volume being mounted that are exported
+// as metric labels, so scrapes don't need to call the EC2 API.
+func (d *ebsVolumeDriver) rememberLabels(name string, vol *ec2.Volume) {
+	labels := make(map[string]string)
+	for _, tag := range vol.Tags {
+		for _, key := range metricLabelTags {
+			if *tag.Key == key {
+				labels[key] = *tag.Value
+			}
+		}
+	}
+	d.labelsMu.Lock()
+	d.labels[name] = labels
+	d.labelsMu.Unlock()
+}
+
+func (d *ebsVolumeDriver) Features() []string {
+	var fs []string
+	if hasNvme() {
+		fs = append(fs, "nvme")
+	}
+	if featureAvailable("wipe") {
+		fs = append(fs, "wipe")
+	}
+	return fs
+}
+
+// Placement reports the availability zone whose volumes this instance can
+// attach, and how many more it has room for.
+func (d *ebsVolumeDriver) Placement() map[string]string {
+	free := d.slots.free()
+	return map[string]string{
+		"blocker.region":            d.awsRegion,
+		"blocker.zone":              d.zone(),
+		"blocker.free-device-slots": strconv.Itoa(free),
+	}
+}
+
+// rememberPolicy records the resize policy of a volume being mounted, if any.
+func (d *ebsVolumeDriver) rememberPolicy(name string, opts map[string]string) {
+	d.labelsMu.Lock()
+	defer d.labelsMu.Unlock()
+	delete(d.policies, name)
+	if s, ok := opts["autoresize"]; ok {
+		if p, err := parseResizePolicy(s); err == nil {
+			d.policies[name] = p
+		}
+	}
+}
+
+func (d *ebsVolumeDriver) Info() map[string]string {
+	return map[string]string{
+		"InstanceId":       d.instanceId(),
+		"Region":           d.awsRegion,
+		"AvailabilityZone": d.zone(),
+	}
+}
+
+func (d *ebsVolumeDriver) State() interface{} {
+	procMounts, err := readMounts(d.tenant.MountRoot + "/")
+	state := struct {
+		Instance   map[string]string
+		Mounts     []MountInfo
+		ProcMounts []mountEntry
+		Err        string `json:",omitempty"`
+	}{
+		Instance:   d.Info(),
+		Mounts:     d.mounts.list(),
+		ProcMounts: procMounts,
+	}
+	if err != nil {
+		state.Err = err.Error()
+	}
+	return state
+}
+
+func (d *ebsVolumeDriver) Freeze(path string, timeout time.Duration) error {
+	volume, _ := parsePath(path)
+	return d.freezer.freeze(d.mountPath(volume), timeout)
+}
+
+func (d *ebsVolumeDriver) Thaw(path string) error {
+	volume, _ := parsePath(path)
+	return d.freezer.thaw(d.mountPath(volume))
+}
+
+// PreAttach attaches a volume to this instance ahead of time, e.g. on a warm
+// standby, so that mounting it only needs the mount itself.  It stays
+// attached until it has been mounted and unmounted again.
+func (d *ebsVolumeDriver) PreAttach(path string) error {
+	volume, _ := parsePath(path)
+	id, err := d.volumeId(volume)
+	if err != nil {
+		return err
+	}
+	opts, vol, err := d.loadOptions(id)
+	if err != nil {
+		return err
+	}
+	pinned, err := d.checkPin(id, opts)
+	if err != nil {
+		return err
+	}
+	if err := d.steal(id, opts, vol); err != nil {
+		if pinned {
+			d.unpin(id)
+		}
+		return err
+	}
+	d.idle.cancel(id)
+	dev, err := d.attachVolume(id)
+	if err != nil {
+		if pinned {
+			d.unpin(id)
+		}
+		return err
+	}
+	log("\tPre-attached EBS volume %v at %v.\n", volume, dev)
+	return nil
+}
+
+func (d *ebsVolumeDriver) ForceDetach(path string) error {
 	volume, _ := parsePath(path)
-	err := d.doUnmount(volume)
+	if err := exec.Command("mountpoint", "-q", d.mountPath(volume)).Run(); err == nil {
+		return errorf(ErrInUse, "Volume %v is mounted on this host; unmount it instead.",
+			volume)
+	}
+	id, err := d.volumeId(volume)
 	if err != nil {
 		return err
 	}
+	if _, err := d.ec2.DetachVolume(&ec2.DetachVolumeInput{
+		Force:    aws.Bool(true),
+		VolumeId: aws.String(id),
+	}); err != nil {
+		return err
+	}
+
+	log("\tForcibly detached EBS volume %v.\n", volume)
 	return nil
 }
 
+// volumeId resolves a Docker volume name to an EBS volume ID.  Names of the
+// form vol-XXXXXXXX already are IDs; anything else is looked up by the Name
+// tag of volumes in this availability zone (only those Blocker created, with
+// -managed-only).
+func (d *ebsVolumeDriver) volumeId(name string) (string, error) {
+	if strings.HasPrefix(name, "vol-") {
+		return d.checkManaged(name)
+	}
+	volumes, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: d.nameFilters(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	switch len(volumes.Volumes) {
+	case 0:
+		return "", errorf(ErrNotFound, "No EBS volume named %v in %v.",
+			name, d.zone())
+	case 1:
+		return *volumes.Volumes[0].VolumeId, nil
+	default:
+		return "", errorf(ErrAmbiguousName, "Found %v EBS volumes named %v in %v.",
+			len(volumes.Volumes), name, d.zone())
+	}
+}
+
+// checkManaged returns a volume ID as is, unless -managed-only is set, or the
+// driver serves a tenant, and the volume lacks the managed tag or a name, in
+// which case it is treated as not existing at all.
+func (d *ebsVolumeDriver) checkManaged(id string) (string, error) {
+	if !d.tenant.managedOnly {
+		return id, nil
+	}
+	volumes, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + d.tenant.ManagedTag),
+				Values: []*string{aws.String("true")}},
+			{Name: aws.String("tag-key"), Values: []*string{aws.String(nameTag)}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(volumes.Volumes) == 0 {
+		return "", errorf(ErrNotFound, "No EBS volume %v managed by Blocker.", id)
+	}
+	return id, nil
+}
+
+// nameFilters selects the volumes in this availability zone that a name may
+// refer to.
+func (d *ebsVolumeDriver) nameFilters(name string) []*ec2.Filter {
+	filters := []*ec2.Filter{
+		{Name: aws.String("tag:" + nameTag), Values: []*string{aws.String(name)}},
+		{Name: aws.String("availability-zone"),
+			Values: []*string{aws.String(d.zone())}},
+	}
+	if d.tenant.managedOnly {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + d.tenant.ManagedTag),
+			Values: []*string{aws.String("true")},
+		})
+	}
+	return filters
+}
+
+// mountPath returns where a volume is mounted, beneath the mount root of the
+// driver's tenant.
+func (d *ebsVolumeDriver) mountPath(volume string) string {
+	return d.tenant.MountRoot + "/" + volume
+}
+
 func parsePath(path string) (string, string) {
 	sep := strings.Index(path, "/")
 	if sep < 0 {
@@ -104,40 +625,207 @@ func parsePath(path string) (string, string) {
 	return path[:sep], path[sep:]
 }
 
-func (d *ebsVolumeDriver) doMount(name string) (string, error) {
+func (d *ebsVolumeDriver) doMount(name string) (string, string, error) {
 	// Auto-generate a random mountpoint.
-	mnt := "/mnt/blocker/" + name
+	mnt := d.mountPath(name)
 
-	// Ensure the directory /mnt/blocker/<m> exists.
+	// Ensure the directory <mount root>/<m> exists.
 	if err := os.MkdirAll(mnt, os.ModeDir|0700); err != nil {
-		return "", err
+		return "", "", err
 	}
 	if stat, err := os.Stat(mnt); err != nil || !stat.IsDir() {
-		return "", fmt.Errorf("Mountpoint %v is not a directory: %v", mnt, err)
+		return "", "", fmt.Errorf("Mountpoint %v is not a directory: %v", mnt, err)
 	}
 
+	id, err := d.volumeId(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Something may already be mounted there, but make sure it's really this
+	// volume rather than, say, leftovers from another tool.
 	if err := exec.Command("mountpoint", "-q", mnt).Run(); err == nil {
-		return mnt, nil
+		mounted := mountedDevice(mnt)
+		dev, err := d.localDevice(id)
+		if err != nil {
+			return "", "", err
+		}
+		if dev == "" || !sameDevice(mounted, dev) {
+			return "", "", errorf(ErrMountConflict,
+				"%v already has %v mounted on it, which is not volume %v.",
+				mnt, mounted, id)
+		}
+		return mnt, mounted, nil
+	}
+	if linked := linkedDevice(mnt); linked != "" {
+		dev, err := d.localDevice(id)
+		if err != nil {
+			return "", "", err
+		}
+		if dev == "" || !sameDevice(linked, dev) {
+			return "", "", errorf(ErrMountConflict,
+				"%v links to %v, which is not volume %v.", mnt, linked, id)
+		}
+		return mnt, linked, nil
+	}
+	if disk := partitionedDisk(mnt); disk != "" {
+		dev, err := d.localDevice(id)
+		if err != nil {
+			return "", "", err
+		}
+		if dev == "" || !sameDevice(disk, dev) {
+			return "", "", errorf(ErrMountConflict,
+				"%v has partitions of %v mounted beneath it, which is not volume %v.",
+				mnt, disk, id)
+		}
+		return mnt, disk, nil
 	}
 
-	// Attach the EBS device to the current EC2 instance.
-	dev, err := d.attachVolume(name)
+	opts, vol, err := d.loadOptions(id)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	pinned, err := d.checkPin(id, opts)
+	if err != nil {
+		return "", "", err
+	}
+
+	// undo reverts what this mount has done to the volume so far, should a
+	// later step fail, so that the volume is left free to be used elsewhere.
+	undo := func(detach bool) {
+		if detach {
+			d.detachVolume(id)
+		}
+		if pinned {
+			d.unpin(id)
+		}
+	}
+
+	if err := d.steal(id, opts, vol); err != nil {
+		undo(false)
+		return "", "", err
+	}
+
+	// Attach the EBS device to the current EC2 instance, unless it was left
+	// attached by an earlier unmount.
+	d.idle.cancel(id)
+	beginPhase(name, "attach")
+	dev, err := d.attachVolume(id)
+	if err != nil {
+		undo(false)
+		return "", "", err
+	}
+
+	d.rememberLabels(name, vol)
+	d.rememberPolicy(name, opts)
+
+	readAhead, scheduler := tuning(opts, vol)
+	tuneDevice(dev, readAhead, scheduler)
+
+	// Volumes whose filesystems are managed elsewhere, e.g. as LVM physical
+	// volumes, are only attached; point the mountpoint at the device.
+	if opts["manage-fs"] == "false" {
+		if err := linkDevice(mnt, dev); err != nil {
+			undo(true)
+			return "", "", err
+		}
+		log("\tAttached %v at %v without mounting it.\n", dev, mnt)
+		return mnt, dev, nil
+	}
+
+	// Partitioned volumes have each partition mounted beneath the mountpoint
+	// instead, as sub-volumes name/part1, name/part2, and so on.
+	if opts["partitions"] == "true" {
+		beginPhase(name, "mount")
+		if err := mountPartitions(name, dev, mnt, opts); err != nil {
+			undo(true)
+			return "", "", err
+		}
+		return mnt, dev, nil
+	}
+
+	// Don't blindly mount filesystems left dirty by a crash.
+	beginPhase(name, "fsck")
+	readOnly, err := checkDirty(name, dev, opts["dirty-policy"])
+	if err != nil {
+		undo(true)
+		return "", "", err
 	}
 
 	// Now go ahead and mount the EBS device to the desired mountpoint.
 	// TODO: support encrypted filesystems.
-	if out, err := exec.Command("mount", dev, mnt).CombinedOutput(); err != nil {
+	beginPhase(name, "mount")
+	args := mountArgs(dev, mnt, opts, readOnly)
+	out, err := mountWithRetry(args)
+	if fallback := mountArgs(dev, mnt, nil, readOnly); err != nil &&
+		errorCode(err) != ErrCommandTimeout &&
+		strings.Join(fallback, " ") != strings.Join(args, " ") {
+		// The volume's options may no longer be supported, e.g. after a
+		// kernel upgrade; rather than failing the container outright, try
+		// again without them.
+		logError("Mounting %v with options %v failed: %v\n%v"+
+			"Retrying without the volume's mount options.\n",
+			name, args[1], err, string(out))
+		if out, err = mountWithRetry(fallback); err == nil {
+			degradedMounts.Add(name, 1)
+		}
+	}
+	if err != nil {
+		code := ErrMountFailed
+		if errorCode(err) == ErrCommandTimeout {
+			// The killed mount may have got as far as mounting the device,
+			// which would keep the detach below from completing.
+			code = ErrCommandTimeout
+			runWithTimeout(mountTimeout, "umount", "-l", mnt)
+		}
 		// Make sure to detach the instance before quitting (ignoring errors).
-		d.detachVolume(name)
+		undo(true)
 
-		return "", fmt.Errorf("Mounting device %v to %v failed: %v\n%v",
+		return "", "", errorf(code, "Mounting device %v to %v failed: %v\n%v",
 			dev, mnt, err, string(out))
 	}
 
+	// Catch up with any growth of the volume since it was last mounted.
+	if opts["auto-grow"] == "true" && !readOnly {
+		beginPhase(name, "growfs")
+		if err := growToDevice(name, dev, mnt); err != nil {
+			logError("Growing the filesystem on %v failed: %v\n", name, err)
+		}
+	}
+
 	// And finally set and return it.
-	return mnt, nil
+	return mnt, dev, nil
+}
+
+// Signs in mount's output that a failure may be transient, e.g. because the
+// device is still settling after the attach.
+var transientMountErrors = []string{
+	"busy",
+	"does not exist",
+	"No such device",
+}
+
+// mountWithRetry runs mount, retrying a few times if it fails in ways that
+// may be transient, rather than giving up on the whole attach.
+func mountWithRetry(args []string) ([]byte, error) {
+	for delay := time.Second; ; delay *= 2 {
+		out, err := runWithTimeout(mountTimeout, "mount", args...)
+		if err == nil {
+			return out, nil
+		}
+		transient := false
+		for _, s := range transientMountErrors {
+			if strings.Contains(string(out), s) {
+				transient = true
+			}
+		}
+		if !transient || delay > 4*time.Second {
+			return out, err
+		}
+		log("\tMount failed: %v; retrying in %v...\n",
+			strings.TrimSpace(string(out)), delay)
+		time.Sleep(delay)
+	}
 }
 
 func (d *ebsVolumeDriver) waitUntilState(
@@ -149,27 +837,25 @@ func (d *ebsVolumeDriver) waitUntilState(
 	for {
 		tries++
 
-		volumes, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
-			VolumeIds: []*string{aws.String(name)},
-		})
-		if err != nil {
+		// Newly created volumes may briefly not be found, so keep trying.
+		volume, err := d.poller.describe(name)
+		if err != nil && errorCode(err) != ErrNotFound {
 			return err
 		}
 
 		// Check to see if the volume reached the intended state; if yes, return.
-		err = check(volumes.Volumes[0])
 		if err == nil {
-			return nil
+			if err = check(volume); err == nil {
+				return nil
+			}
 		}
 		if tries == 12 {
-			return err
+			return errorf(ErrStateTimeout, "Timed out waiting for %v: %v", name, err)
 		}
 
 		log("\tWaiting for EBS attach to complete...\n")
 		time.Sleep(5 * time.Second)
 	}
-
-	return nil
 }
 
 func (d *ebsVolumeDriver) waitUntilAttached(name string) error {
@@ -204,8 +890,9 @@ func (d *ebsVolumeDriver) waitUntilAvailable(name string) error {
 	})
 }
 
-func (d *ebsVolumeDriver) attachVolume(name string) (string, error) {
-	// Check if the volume is already attached to instance
+// localDevice returns the local device of a volume attached to this instance,
+// or "" if it is not attached here.
+func (d *ebsVolumeDriver) localDevice(name string) (string, error) {
 	info, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
 		VolumeIds: []*string{aws.String(name)},
 	})
@@ -213,90 +900,246 @@ func (d *ebsVolumeDriver) attachVolume(name string) (string, error) {
 		return "", err
 	}
 	if len(info.Volumes[0].Attachments) == 1 {
-		if *info.Volumes[0].Attachments[0].State == ec2.VolumeAttachmentStateAttached &&
-			*info.Volumes[0].Attachments[0].InstanceId == d.awsInstanceId {
-			re := regexp.MustCompile("/dev/(xv|s)d([f-p])")
-			res := re.FindStringSubmatch(*info.Volumes[0].Attachments[0].Device)
-			if len(res) != 3 {
-				return "", errors.New("Unable to find mount device for " + name)
-			}
-			if _, err := os.Lstat("/dev/sd" + res[2]); err == nil {
-				return "/dev/sd" + res[2], nil
-			}
-			if _, err := os.Lstat("/dev/xvd" + res[2]); err == nil {
-				return "/dev/xvd" + res[2], nil
+		attachment := info.Volumes[0].Attachments[0]
+		if *attachment.State == ec2.VolumeAttachmentStateAttached &&
+			*attachment.InstanceId == d.instanceId() {
+			dev := findDevice(name, *attachment.Device)
+			if dev == "" {
+				return "", errorf(ErrDeviceMissing, "Unable to find mount device for %v.", name)
 			}
+			return dev, nil
 		}
 	}
+	return "", nil
+}
+
+func (d *ebsVolumeDriver) attachVolume(name string) (string, error) {
+	// Check if the volume is already attached to instance
+	if dev, err := d.localDevice(name); dev != "" || err != nil {
+		return dev, err
+	}
 
 	// Since detaching is asynchronous, we want to check first to see if the
 	// target volume is in the process of being detached.  If it is, we'll wait
 	// a little bit until it's ready to use.
-	err = d.waitUntilAvailable(name)
-	if err != nil {
+	if err := d.waitUntilAvailable(name); err != nil {
 		return "", err
 	}
 
-	// Now find the first free device to attach the EBS volume to.  See
-	// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/device_naming.html
-	// for recommended naming scheme (/dev/sd[f-p]).
-	for _, c := range "fghijklmnop" {
-		dev := "/dev/sd" + string(c)
-		altdev := "/dev/xvd" + string(c)
-
-		if _, err := os.Lstat(dev); err == nil {
-			continue
+	// Now find the first free device to attach the EBS volume to.  Prefer
+	// the device the volume last used on this instance, so its device path
+	// stays stable.  Should all seem taken, the block device mappings may be
+	// out of date, so reload them and look again.
+	letters := deviceLetters
+	if hint := d.deviceHint(name); hint != "" {
+		letters = []string{hint}
+		for _, l := range deviceLetters {
+			if l != hint {
+				letters = append(letters, l)
+			}
 		}
-		if _, err := os.Lstat(altdev); err == nil {
-			continue
+	}
+	for refreshed := false; ; refreshed = true {
+		for _, l := range letters {
+			dev, err := d.attachAt(name, l)
+			if dev != "" || err != nil {
+				return dev, err
+			}
+		}
+		if refreshed {
+			break
+		}
+		if err := d.refreshDeviceSlots(); err != nil {
+			return "", err
 		}
+	}
 
-		if _, err := d.ec2.AttachVolume(&ec2.AttachVolumeInput{
-			Device:     aws.String(dev),
-			InstanceId: aws.String(d.awsInstanceId),
-			VolumeId:   aws.String(name),
-		}); err != nil {
-			if awsErr, ok := err.(awserr.Error); ok &&
-				awsErr.Code() == "InvalidParameterValue" {
-				// If AWS is simply reporting that the device is already in
-				// use, then go ahead and check the next one.
-				continue
-			}
+	return "", errorf(ErrNoDeviceSlots,
+		"No devices available for attach: /dev/sd[%v] taken.", deviceRanges)
+}
 
-			return "", err
+// attachAt attaches a volume with a device letter and returns the local
+// device, or "" if the letter turns out to be taken.
+func (d *ebsVolumeDriver) attachAt(name string, letter string) (string, error) {
+	dev := "/dev/sd" + letter
+	if deviceInUse(dev) || !d.slots.claim(letter, name) {
+		return "", nil
+	}
+	defer d.slots.settle(letter)
+
+	if err := d.requestAttach(name, dev); err != nil {
+		if awsErr, ok := err.(awserr.Error); ok &&
+			awsErr.Code() == "InvalidParameterValue" &&
+			strings.Contains(awsErr.Message(), "in use") {
+			// If AWS is simply reporting that the device is already in
+			// use, then go ahead and check the next one, remembering that
+			// something else has this one.  Other invalid parameters would
+			// fail with every device.
+			deviceSlotConflicts.Add(1)
+			d.slots.takenElsewhere(letter)
+			return "", nil
 		}
 
-		err = d.waitUntilAttached(name)
-		if err != nil {
-			return "", err
+		d.slots.release(letter)
+		return "", err
+	}
+
+	if err := d.waitUntilAttached(name); err != nil {
+		// Don't leave the attachment behind, half-done.
+		d.detachVolume(name)
+		return "", err
+	}
+	d.ensureNoDeleteOnTermination(name, dev)
+	d.saveDeviceHint(name, letter)
+
+	// Finally, the attach is complete.  The kernel is free to name the
+	// device differently than requested (e.g. /dev/xvdf or /dev/nvme1n1),
+	// so look it up rather than assuming, giving udev time to create it.
+	log("\tAttached EBS volume %v to %v:%v.\n", name, d.instanceId(), dev)
+	local := waitForDevice(name, dev)
+	if local == "" && rescanOnAttach {
+		local = rescanForDevice(name, dev)
+	}
+	if local == "" {
+		d.detachVolume(name)
+		return "", errorf(ErrDeviceMissing, "Device %v is missing after attach.", dev)
+	}
+	if local != dev {
+		log("\tLocal device name is %v\n", local)
+	}
+
+	return local, nil
+}
+
+// requestAttach asks EC2 to attach a volume as dev.  EC2 sometimes refuses
+// while the volume is still being modified, so that is retried for up to a
+// minute before giving up with BLOCKER_VOLUME_BUSY.
+func (d *ebsVolumeDriver) requestAttach(name string, dev string) error {
+	deadline := time.Now().Add(busyVolumeTimeout)
+	for {
+		_, err := d.ec2.AttachVolume(&ec2.AttachVolumeInput{
+			Device:     aws.String(dev),
+			InstanceId: aws.String(d.instanceId()),
+			VolumeId:   aws.String(name),
+		})
+		if err == nil {
+			return nil
+		}
+		err = d.modificationError(name, "attach", err)
+		if errorCode(err) != ErrVolumeBusy || time.Now().After(deadline) {
+			return err
 		}
+		log("\t%v  Retrying...\n", err)
+		time.Sleep(5 * time.Second)
+	}
+}
 
-		// Finally, the attach is complete.
-		log("\tAttached EBS volume %v to %v:%v.\n", name, d.awsInstanceId, dev)
-		if _, err := os.Lstat(dev); os.IsNotExist(err) {
-			// On newer Linux kernels, /dev/sd* is mapped to /dev/xvd*.  See
-			// if that's the case.
-			if _, err := os.Lstat(altdev); os.IsNotExist(err) {
-				d.detachVolume(name)
-				return "", fmt.Errorf("Device %v is missing after attach.", dev)
-			}
+// The tag recording the instance and device letter a volume was last attached
+// with, as <instance-id>:<letter>.
+const deviceHintTag = optionTagPrefix + "last-device"
 
-			log("\tLocal device name is %v\n", altdev)
-			dev = altdev
+// deviceHint returns the /dev/sd* letter a volume was last attached with on
+// this instance, or "" if none.
+func (d *ebsVolumeDriver) deviceHint(name string) string {
+	_, vol, err := d.loadOptions(name)
+	if err != nil {
+		return ""
+	}
+	for _, tag := range vol.Tags {
+		if *tag.Key != deviceHintTag {
+			continue
 		}
+		parts := strings.SplitN(*tag.Value, ":", 2)
+		if len(parts) != 2 || parts[0] != d.instanceId() {
+			continue
+		}
+		for _, l := range deviceLetters {
+			if l == parts[1] {
+				return l
+			}
+		}
+	}
+	return ""
+}
+
+func (d *ebsVolumeDriver) saveDeviceHint(name string, letter string) {
+	if _, err := d.ec2.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(name)},
+		Tags: []*ec2.Tag{{
+			Key:   aws.String(deviceHintTag),
+			Value: aws.String(d.instanceId() + ":" + letter),
+		}},
+	}); err != nil {
+		logError("Recording the device of %v failed: %v\n", name, err)
+	}
+}
 
-		return dev, nil
+// ensureNoDeleteOnTermination makes sure a volume attached at dev will not be
+// deleted along with this instance.  Attachments default to keeping the
+// volume, but some AMIs' block device mappings say otherwise, and losing a
+// data volume to an instance termination is not something to leave to chance.
+func (d *ebsVolumeDriver) ensureNoDeleteOnTermination(name string, dev string) {
+	instances, err := d.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(d.instanceId())},
+	})
+	if err != nil {
+		logError("Checking DeleteOnTermination for %v failed: %v\n", name, err)
+		return
 	}
+	for _, r := range instances.Reservations {
+		for _, i := range r.Instances {
+			for _, m := range i.BlockDeviceMappings {
+				if m.Ebs == nil || aws.StringValue(m.Ebs.VolumeId) != name ||
+					!aws.BoolValue(m.Ebs.DeleteOnTermination) {
+					continue
+				}
 
-	return "", errors.New("No devices available for attach: /dev/sd[f-p] taken.")
+				log("\tClearing DeleteOnTermination for %v on %v.\n", name, dev)
+				if _, err := d.ec2.ModifyInstanceAttribute(
+					&ec2.ModifyInstanceAttributeInput{
+						InstanceId: aws.String(d.instanceId()),
+						BlockDeviceMappings: []*ec2.InstanceBlockDeviceMappingSpecification{{
+							DeviceName: m.DeviceName,
+							Ebs: &ec2.EbsInstanceBlockDeviceSpecification{
+								VolumeId:            aws.String(name),
+								DeleteOnTermination: aws.Bool(false),
+							},
+						}},
+					}); err != nil {
+					logError("Volume %v WILL BE DELETED when instance %v terminates: "+
+						"clearing DeleteOnTermination failed: %v\n",
+						name, d.instanceId(), err)
+				}
+			}
+		}
+	}
 }
 
-func (d *ebsVolumeDriver) doUnmount(name string) error {
-	mnt := "/mnt/blocker/" + name
+// doUnmount unmounts a volume and then deals with its attachment according
+// to a detach policy, or the volume's own policy if that is "".
+func (d *ebsVolumeDriver) doUnmount(name string, policy string) error {
+	mnt := d.mountPath(name)
+
+	// Unmounting a frozen filesystem would block until it is thawed.
+	d.freezer.thawIfFrozen(mnt)
 
-	// First unmount the device.
-	if out, err := exec.Command("umount", mnt).CombinedOutput(); err != nil {
-		return fmt.Errorf("Unmounting %v failed: %v\n%v", mnt, err, string(out))
+	// First unmount the device, or its partitions, or for attach-only volumes
+	// just remove the link to it.
+	beginPhase(name, "umount")
+	if linkedDevice(mnt) != "" {
+		if err := unlinkDevice(mnt); err != nil {
+			return err
+		}
+	} else if partitionedDisk(mnt) != "" {
+		if err := unmountPartitions(mnt); err != nil {
+			return err
+		}
+	} else if out, err := runWithTimeout(mountTimeout, "umount", mnt); err != nil {
+		if errorCode(err) == ErrCommandTimeout {
+			return err
+		}
+		return errorf(ErrUnmountFailed,
+			"Unmounting %v failed: %v\n%v", mnt, err, string(out))
 	}
 
 	// Remove the mountpoint from the filesystem.
@@ -305,7 +1148,30 @@ func (d *ebsVolumeDriver) doUnmount(name string) error {
 	}
 
 	// Detach the EBS volume from this AWS instance.
-	if err := d.detachVolume(name); err != nil {
+	id, err := d.volumeId(name)
+	if err != nil {
+		return err
+	}
+	if policy == "" {
+		opts, _, err := d.loadOptions(id)
+		if err != nil {
+			return err
+		}
+		if policy = opts["detach-policy"]; policy == "" {
+			policy = defaultDetachPolicy
+		}
+	}
+	switch policy {
+	case DetachPolicyKeepAttached:
+		log("\tLeaving EBS volume %v attached.\n", id)
+		return nil
+	case DetachPolicyAfterIdle:
+		log("\tDetaching EBS volume %v if idle for %v.\n", id, detachIdleTimeout)
+		d.idle.schedule(id, name, detachIdleTimeout, d.detachIdle)
+		return nil
+	}
+	beginPhase(name, "detach")
+	if err := d.detachVolume(id); err != nil {
 		return err
 	}
 
@@ -313,14 +1179,25 @@ func (d *ebsVolumeDriver) doUnmount(name string) error {
 	return nil
 }
 
+// detachIdle detaches a detach-after-idle volume once its delay is up, under
+// the volume's lock, unless it has been mounted here again.
+func (d *ebsVolumeDriver) detachIdle(name string, id string) error {
+	if _, ok := d.mounts.existing(name); ok {
+		log("\tVolume %v is mounted again; leaving it attached.\n", name)
+		return nil
+	}
+	return d.detachVolume(id)
+}
+
 func (d *ebsVolumeDriver) detachVolume(name string) error {
 	if _, err := d.ec2.DetachVolume(&ec2.DetachVolumeInput{
-		InstanceId: aws.String(d.awsInstanceId),
+		InstanceId: aws.String(d.instanceId()),
 		VolumeId:   aws.String(name),
 	}); err != nil {
 		return err
 	}
+	d.slots.releaseVolume(name)
 
-	log("\tDetached EBS volume %v from %v.\n", name, d.awsInstanceId)
+	log("\tDetached EBS volume %v from %v.\n", name, d.instanceId())
 	return nil
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Encrypt replaces an unencrypted, detached volume with an encrypted copy.
+// The volume is snapshotted, the snapshot copied with encryption under the
+// given KMS key (or the account's default EBS key if empty), and a new volume
+// created from it carrying the original's tags.  The original's name tag, if
+// any, is suffixed with ".unencrypted", and only then set on the new volume,
+// so lookups by name find one volume or the other but never both.
+// Returns the ID of the new volume.
+func (d *ebsVolumeDriver) Encrypt(
+	path string, kmsKeyId string, deleteOriginal bool) (string, error) {
+	volume, _ := parsePath(path)
+	name, err := d.volumeId(volume)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(name)},
+	})
+	if err != nil {
+		return "", err
+	}
+	vol := info.Volumes[0]
+	if aws.BoolValue(vol.Encrypted) {
+		return "", fmt.Errorf("Volume %v is already encrypted.", name)
+	}
+	if *vol.State != ec2.VolumeStateAvailable {
+		return "", fmt.Errorf(
+			"Volume %v must be detached before encrypting; current state is %v.",
+			name, *vol.State)
+	}
+
+	log("\tSnapshotting %v for encryption...\n", name)
+	snap, err := d.ec2.CreateSnapshot(&ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(name),
+		Description: aws.String("blocker: encryption of " + name),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer d.deleteSnapshot(*snap.SnapshotId)
+	if err := d.ec2.WaitUntilSnapshotCompleted(&ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{snap.SnapshotId},
+	}); err != nil {
+		return "", err
+	}
+
+	log("\tCopying snapshot %v with encryption...\n", *snap.SnapshotId)
+	copyInput := &ec2.CopySnapshotInput{
+		SourceSnapshotId: snap.SnapshotId,
+		SourceRegion:     aws.String(d.awsRegion),
+		Encrypted:        aws.Bool(true),
+		Description:      aws.String("blocker: encrypted copy of " + name),
+	}
+	if kmsKeyId != "" {
+		copyInput.KmsKeyId = aws.String(kmsKeyId)
+	}
+	encSnap, err := d.ec2.CopySnapshot(copyInput)
+	if err != nil {
+		return "", err
+	}
+	defer d.deleteSnapshot(*encSnap.SnapshotId)
+	if err := d.ec2.WaitUntilSnapshotCompleted(&ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{encSnap.SnapshotId},
+	}); err != nil {
+		return "", err
+	}
+
+	// The new volume only takes the original's name once the original has
+	// given it up, so that the two never share it.
+	input := replaceVolumeInput(vol, *encSnap.SnapshotId)
+	original, named := volumeName(vol)
+	if named {
+		setNameTag(input, original+replacementSuffix)
+	}
+	newVol, err := d.ec2.CreateVolume(input)
+	if err != nil {
+		return "", err
+	}
+	if err := d.waitUntilAvailable(*newVol.VolumeId); err != nil {
+		d.deleteVolume(*newVol.VolumeId)
+		return "", err
+	}
+	log("\tCreated encrypted volume %v from %v.\n", *newVol.VolumeId, name)
+
+	if deleteOriginal {
+		if _, err := d.ec2.DeleteVolume(&ec2.DeleteVolumeInput{
+			VolumeId: aws.String(name),
+		}); err != nil {
+			d.deleteVolume(*newVol.VolumeId)
+			return "", err
+		}
+		log("\tDeleted unencrypted volume %v.\n", name)
+		if named {
+			if err := d.setVolumeName(*newVol.VolumeId, original); err != nil {
+				return *newVol.VolumeId, err
+			}
+		}
+	} else if err := d.swapInReplacement(
+		vol, *newVol.VolumeId, ".unencrypted"); err != nil {
+		d.deleteVolume(*newVol.VolumeId)
+		return "", err
+	}
+
+	return *newVol.VolumeId, nil
+}
+
+func (d *ebsVolumeDriver) deleteSnapshot(id string) {
+	if _, err := d.ec2.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+		SnapshotId: aws.String(id),
+	}); err != nil {
+		logError("Deleting snapshot %v failed: %v\n", id, err)
+	}
+}
+
+// replaceVolumeInput describes a new volume restored from a snapshot that is
+// otherwise a replacement for vol: in the same availability zone, with the
+// same type, performance, and user tags.
+func replaceVolumeInput(vol *ec2.Volume, snapshotId string) *ec2.CreateVolumeInput {
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: vol.AvailabilityZone,
+		SnapshotId:       aws.String(snapshotId),
+		VolumeType:       vol.VolumeType,
+	}
+	switch *vol.VolumeType {
+	case ec2.VolumeTypeGp3:
+		input.Iops = vol.Iops
+		input.Throughput = vol.Throughput
+	case ec2.VolumeTypeIo1, ec2.VolumeTypeIo2:
+		input.Iops = vol.Iops
+	}
+
+	var tags []*ec2.Tag
+	for _, tag := range vol.Tags {
+		if !isAwsReservedTag(*tag.Key) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		input.TagSpecifications = []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeVolume),
+			Tags:         tags,
+		}}
+	}
+	return input
+}
+
+// renameVolume appends a suffix to a replaced volume's name tag, if it has
+// one, so that lookups by name find its replacement instead.
+func (d *ebsVolumeDriver) renameVolume(vol *ec2.Volume, suffix string) error {
+	for _, tag := range vol.Tags {
+		if *tag.Key != nameTag {
+			continue
+		}
+		_, err := d.ec2.CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{vol.VolumeId},
+			Tags: []*ec2.Tag{{
+				Key:   aws.String(nameTag),
+				Value: aws.String(*tag.Value + suffix),
+			}},
+		})
+		return err
+	}
+	return nil
+}
+
+// Replacement volumes are created under the original's name with this suffix,
+// and only take the name itself once the original has given it up.
+const replacementSuffix = ".replacement"
+
+// volumeName returns the name tag of a volume, if it has one.
+func volumeName(vol *ec2.Volume) (string, bool) {
+	for _, tag := range vol.Tags {
+		if *tag.Key == nameTag {
+			return *tag.Value, true
+		}
+	}
+	return "", false
+}
+
+// setVolumeName sets the name tag of a volume.
+func (d *ebsVolumeDriver) setVolumeName(id string, name string) error {
+	_, err := d.ec2.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{{Key: aws.String(nameTag), Value: aws.String(name)}},
+	})
+	return err
+}
+
+// swapInReplacement hands the name of vol, if it has one, over to the volume
+// replacing it, suffixing the original's name first.  EC2 can't retag both
+// volumes at once, so the first step is undone should the second fail;
+// lookups of the name fail in between.
+func (d *ebsVolumeDriver) swapInReplacement(
+	vol *ec2.Volume, replacementId string, suffix string) error {
+	name, ok := volumeName(vol)
+	if !ok {
+		return nil
+	}
+	if err := d.renameVolume(vol, suffix); err != nil {
+		return err
+	}
+	if err := d.setVolumeName(replacementId, name); err != nil {
+		if undoErr := d.setVolumeName(*vol.VolumeId, name); undoErr != nil {
+			logError("Restoring the name of %v failed: %v\n", *vol.VolumeId, undoErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// isAwsReservedTag reports whether a tag key is in the aws: namespace, which
+// users may not set.
+func isAwsReservedTag(key string) bool {
+	return strings.HasPrefix(key, "aws:")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestReplaceVolumeInput(t *testing.T) {
+	vol := &ec2.Volume{
+		AvailabilityZone: aws.String("us-east-1a"),
+		VolumeType:       aws.String(ec2.VolumeTypeGp3),
+		Iops:             aws.Int64(4000),
+		Throughput:       aws.Int64(250),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("data")},
+			{Key: aws.String("team"), Value: aws.String("storage")},
+			{Key: aws.String("aws:cloudformation:stack-name"),
+				Value: aws.String("stack")},
+		},
+	}
+	input := replaceVolumeInput(vol, "snap-1")
+	if aws.StringValue(input.AvailabilityZone) != "us-east-1a" ||
+		aws.StringValue(input.SnapshotId) != "snap-1" ||
+		aws.StringValue(input.VolumeType) != ec2.VolumeTypeGp3 ||
+		aws.Int64Value(input.Iops) != 4000 ||
+		aws.Int64Value(input.Throughput) != 250 {
+		t.Errorf("replaceVolumeInput = %v, want a gp3 volume like the original",
+			input)
+	}
+	tags := make(map[string]string)
+	for _, tag := range input.TagSpecifications[0].Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+	if len(tags) != 2 || tags["Name"] != "data" || tags["team"] != "storage" {
+		t.Errorf("Replacement is tagged %v, want the original's tags but aws:*",
+			tags)
+	}
+
+	// Only the volume types that take them are given performance settings.
+	vol.VolumeType = aws.String(ec2.VolumeTypeGp2)
+	vol.Tags = nil
+	input = replaceVolumeInput(vol, "snap-1")
+	if input.Iops != nil || input.Throughput != nil {
+		t.Errorf("replaceVolumeInput of a gp2 volume = %v, want no IOPS or "+
+			"throughput", input)
+	}
+	if input.TagSpecifications != nil {
+		t.Errorf("Untagged volume's replacement is tagged %v",
+			input.TagSpecifications)
+	}
+}
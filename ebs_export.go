@@ -0,0 +1,147 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3 object metadata recording an exported volume's size in GiB.
+const exportSizeMetadata = "Blocker-Size-Gib"
+
+// Export streams a gzip-compressed raw image of a volume to an s3://bucket/key
+// URL.  The image is taken from a snapshot, so the volume may stay in use.
+// The SHA-256 of the uncompressed image is written alongside, to key.sha256.
+func (d *ebsVolumeDriver) Export(path string, url string) error {
+	volume, _ := parsePath(path)
+	name, err := d.volumeId(volume)
+	if err != nil {
+		return err
+	}
+	bucket, key, err := parseS3Url(url)
+	if err != nil {
+		return err
+	}
+	return d.withTemporaryClone(name, func(dev string, sizeGiB int64) error {
+		f, err := os.Open(dev)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		hash := sha256.New()
+		pr, pw := io.Pipe()
+		go func() {
+			gz := gzip.NewWriter(pw)
+			_, err := io.Copy(io.MultiWriter(gz, hash), f)
+			if err == nil {
+				err = gz.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+
+		log("\tExporting %v to s3://%v/%v...\n", name, bucket, key)
+		uploader := s3manager.NewUploaderWithClient(d.s3)
+		if _, err := uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   pr,
+			Metadata: map[string]*string{
+				exportSizeMetadata: aws.String(strconv.FormatInt(sizeGiB, 10)),
+			},
+		}); err != nil {
+			pr.CloseWithError(err)
+			return err
+		}
+
+		sum := hex.EncodeToString(hash.Sum(nil))
+		if _, err := d.s3.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key + ".sha256"),
+			Body:   strings.NewReader(sum + "\n"),
+		}); err != nil {
+			return err
+		}
+		log("\tExported %v (sha256 %v).\n", name, sum)
+		return nil
+	})
+}
+
+// withTemporaryClone snapshots a volume, restores the snapshot to a scratch
+// volume attached to this instance, and calls f with its local device and
+// size.  The scratch volume and snapshot are deleted afterwards.
+func (d *ebsVolumeDriver) withTemporaryClone(
+	name string, f func(dev string, sizeGiB int64) error) error {
+	snap, err := d.ec2.CreateSnapshot(&ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(name),
+		Description: aws.String("blocker: temporary clone of " + name),
+	})
+	if err != nil {
+		return err
+	}
+	defer d.deleteSnapshot(*snap.SnapshotId)
+	if err := d.ec2.WaitUntilSnapshotCompleted(&ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{snap.SnapshotId},
+	}); err != nil {
+		return err
+	}
+
+	clone, err := d.ec2.CreateVolume(&ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(d.zone()),
+		SnapshotId:       snap.SnapshotId,
+	})
+	if err != nil {
+		return err
+	}
+	defer d.deleteVolume(*clone.VolumeId)
+	if err := d.waitUntilAvailable(*clone.VolumeId); err != nil {
+		return err
+	}
+
+	dev, err := d.attachVolume(*clone.VolumeId)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := d.detachVolume(*clone.VolumeId); err != nil {
+			logError("Detaching clone %v failed: %v\n", *clone.VolumeId, err)
+			return
+		}
+		d.waitUntilAvailable(*clone.VolumeId)
+	}()
+
+	return f(dev, *clone.Size)
+}
+
+// deleteVolume deletes a volume, logging rather than returning failures, for
+// use when cleaning up.
+func (d *ebsVolumeDriver) deleteVolume(name string) {
+	if _, err := d.ec2.DeleteVolume(&ec2.DeleteVolumeInput{
+		VolumeId: aws.String(name),
+	}); err != nil {
+		logError("Deleting volume %v failed: %v\n", name, err)
+		return
+	}
+	log("\tDeleted EBS volume %v.\n", name)
+}
+
+func parseS3Url(url string) (string, string, error) {
+	if !strings.HasPrefix(url, "s3://") {
+		return "", "", fmt.Errorf("Not an s3:// URL: %v", url)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("S3 URL %v must name a bucket and key.", url)
+	}
+	return parts[0], parts[1], nil
+}
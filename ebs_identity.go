@@ -0,0 +1,110 @@
+package main
+
+import (
+	"expvar"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What to do on finding that the instance metadata service reports another
+// instance ID or availability zone than Blocker started with, e.g. because
+// the host's image was moved to a new instance while Blocker was suspended.
+const (
+	// Carry on as the instance the metadata service now reports.
+	IdentityChangeRefresh = "refresh"
+	// Exit, so that a supervisor restarts Blocker from scratch.
+	IdentityChangeExit = "exit"
+)
+
+var identityChangePolicies = map[string]bool{
+	IdentityChangeRefresh: true,
+	IdentityChangeExit:    true,
+}
+
+// How often the instance's identity is checked, and what happens when it has
+// changed.  Identities configured with -aws-instance-id and friends are never
+// checked.
+var (
+	identityCheckInterval = 5 * time.Minute
+	identityChangePolicy  = IdentityChangeRefresh
+)
+
+// How long each call to the instance metadata service may take, and how many
+// times a failed one is retried, so that a slow or half-broken metadata
+// service can't hold up startup indefinitely.
+var (
+	metadataTimeout = 5 * time.Second
+	metadataRetries = 3
+)
+
+var identityChanges = expvar.NewInt("identity_changes")
+
+// The instance ID and availability zone Blocker acts as, which watchIdentity
+// may change, shared by the drivers of all tenants.
+type instanceIdentity struct {
+	mu         sync.RWMutex
+	instanceId string
+	zone       string
+}
+
+func (d *ebsVolumeDriver) instanceId() string {
+	d.identity.mu.RLock()
+	defer d.identity.mu.RUnlock()
+	return d.identity.instanceId
+}
+
+func (d *ebsVolumeDriver) zone() string {
+	d.identity.mu.RLock()
+	defer d.identity.mu.RUnlock()
+	return d.identity.zone
+}
+
+// watchIdentity checks the instance's identity at intervals.
+func (d *ebsVolumeDriver) watchIdentity(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			d.checkIdentity()
+		}
+	}()
+}
+
+// checkIdentity compares the instance ID and availability zone reported by
+// the instance metadata service with those Blocker is using, and deals with
+// any difference according to identityChangePolicy.  AWS clients are bound to
+// a region, so a move to another region always makes Blocker exit.
+func (d *ebsVolumeDriver) checkIdentity() {
+	instanceId, err := d.ec2meta.GetMetadata("instance-id")
+	if err != nil {
+		logError("Checking the instance ID failed: %v\n", err)
+		return
+	}
+	zone, err := d.ec2meta.GetMetadata("placement/availability-zone")
+	if err != nil {
+		logError("Checking the availability zone failed: %v\n", err)
+		return
+	}
+
+	exit := identityChangePolicy == IdentityChangeExit ||
+		!strings.HasPrefix(zone, d.awsRegion)
+	d.identity.mu.Lock()
+	oldInstanceId, oldZone := d.identity.instanceId, d.identity.zone
+	changed := instanceId != oldInstanceId || zone != oldZone
+	if changed && !exit {
+		d.identity.instanceId, d.identity.zone = instanceId, zone
+	}
+	d.identity.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	identityChanges.Add(1)
+	logError("Instance identity changed from %v in %v to %v in %v.\n",
+		oldInstanceId, oldZone, instanceId, zone)
+	if exit {
+		logError("Exiting to restart with the new identity.\n")
+		os.Exit(1)
+	}
+	log("Now acting as %v in %v.\n", instanceId, zone)
+}
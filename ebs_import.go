@@ -0,0 +1,171 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// importVolume provisions a new volume called name, seeded from an image
+// previously written by Export.  The volume is sized from the image's
+// metadata unless a size option (in GiB) is given.  If anything goes wrong,
+// including a checksum mismatch, the new volume is deleted again.
+func (d *ebsVolumeDriver) importVolume(
+	name string, url string, opts map[string]string) error {
+	defer d.creating.lock(name)()
+	if _, err := d.volumeId(name); err == nil {
+		return errorf(ErrAlreadyExists, "An EBS volume named %v already exists.", name)
+	}
+	bucket, key, err := parseS3Url(url)
+	if err != nil {
+		return err
+	}
+
+	head, err := d.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	sizeStr := opts["size"]
+	if sizeStr == "" {
+		sizeStr = aws.StringValue(head.Metadata[exportSizeMetadata])
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || size <= 0 {
+		return fmt.Errorf(
+			"Image %v does not record its size; pass -o size=<GiB>.", url)
+	}
+	if err := checkVolumeSize(opts, size); err != nil {
+		return err
+	}
+
+	sumObj, err := d.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key + ".sha256"),
+	})
+	if err != nil {
+		return fmt.Errorf("Fetching checksum for %v failed: %v", url, err)
+	}
+	sumBytes, err := ioutil.ReadAll(sumObj.Body)
+	sumObj.Body.Close()
+	if err != nil {
+		return err
+	}
+	expected := strings.TrimSpace(string(sumBytes))
+
+	timeout, err := provisionTimeout(opts)
+	if err != nil {
+		return err
+	}
+
+	release, err := d.reserveQuota(1, size)
+	if err != nil {
+		return err
+	}
+	vol, err := d.ec2.CreateVolume(d.newVolumeInput(name, size, opts))
+	release()
+	if err != nil {
+		return err
+	}
+	id := *vol.VolumeId
+	log("\tCreated EBS volume %v (%v) to import %v.\n", id, name, url)
+	if err := d.checkDuplicate(name, id); err != nil {
+		d.deleteVolume(id)
+		return err
+	}
+	beginPhase(name, "provision")
+
+	if err := d.writeImage(id, bucket, key, expected, timeout); err != nil {
+		d.deleteVolume(id)
+		return err
+	}
+	return nil
+}
+
+// checkDuplicate makes sure a volume just created under a name is the only
+// one with it, since another host may have been creating one at the same
+// time.  The oldest volume wins; if that isn't ours, it's an error.
+func (d *ebsVolumeDriver) checkDuplicate(name string, id string) error {
+	volumes, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: d.nameFilters(name),
+	})
+	if err != nil {
+		return err
+	}
+	winner := id
+	var winnerCreated time.Time
+	for _, vol := range volumes.Volumes {
+		if *vol.VolumeId == id {
+			winnerCreated = *vol.CreateTime
+		}
+	}
+	for _, vol := range volumes.Volumes {
+		created := *vol.CreateTime
+		if created.Before(winnerCreated) ||
+			(created.Equal(winnerCreated) && *vol.VolumeId < winner) {
+			winner, winnerCreated = *vol.VolumeId, created
+		}
+	}
+	if winner != id {
+		return errorf(ErrAlreadyExists,
+			"EBS volume %v named %v was created concurrently.", winner, name)
+	}
+	return nil
+}
+
+// writeImage decompresses an S3 image onto a freshly created volume and
+// verifies its checksum.
+func (d *ebsVolumeDriver) writeImage(id string, bucket string, key string,
+	expected string, timeout time.Duration) error {
+	return d.provision(id, timeout, func(ctx context.Context, dev string) error {
+		obj, err := d.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+		defer obj.Body.Close()
+		gz, err := gzip.NewReader(obj.Body)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(dev, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		log("\tWriting s3://%v/%v to %v...\n", bucket, key, dev)
+		hash := sha256.New()
+		progress := newProgressWriter(ctx, f, "Import of "+id)
+		if _, err := io.Copy(io.MultiWriter(progress, hash), gz); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != expected {
+			return errorf(ErrChecksumMismatch,
+				"Checksum mismatch importing s3://%v/%v: got %v, want %v",
+				bucket, key, sum, expected)
+		}
+		return nil
+	})
+}
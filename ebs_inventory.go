@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// InventoryVolumes describes the EBS volumes attached to this instance, with
+// their tags and snapshots.
+func (d *ebsVolumeDriver) InventoryVolumes() ([]InventoryVolume, error) {
+	volumes, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("attachment.instance-id"),
+			Values: []*string{aws.String(d.instanceId())},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes.Volumes) == 0 {
+		return nil, nil
+	}
+
+	var ids []*string
+	for _, vol := range volumes.Volumes {
+		ids = append(ids, vol.VolumeId)
+	}
+	snapshots := make(map[string][]InventorySnapshot)
+	err = d.ec2.DescribeSnapshotsPages(&ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters:  []*ec2.Filter{{Name: aws.String("volume-id"), Values: ids}},
+	}, func(page *ec2.DescribeSnapshotsOutput, _ bool) bool {
+		for _, snap := range page.Snapshots {
+			id := aws.StringValue(snap.VolumeId)
+			snapshots[id] = append(snapshots[id], InventorySnapshot{
+				SnapshotId:  aws.StringValue(snap.SnapshotId),
+				StartTime:   aws.TimeValue(snap.StartTime),
+				State:       aws.StringValue(snap.State),
+				Description: aws.StringValue(snap.Description),
+				Tags:        tagMap(snap.Tags),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var inv []InventoryVolume
+	for _, vol := range volumes.Volumes {
+		id := aws.StringValue(vol.VolumeId)
+		tags := tagMap(vol.Tags)
+		v := InventoryVolume{
+			VolumeId:   id,
+			Name:       tags[nameTag],
+			Type:       aws.StringValue(vol.VolumeType),
+			SizeGiB:    aws.Int64Value(vol.Size),
+			State:      aws.StringValue(vol.State),
+			Encrypted:  aws.BoolValue(vol.Encrypted),
+			CreateTime: aws.TimeValue(vol.CreateTime),
+			Tags:       tags,
+			Snapshots:  snapshots[id],
+		}
+		for _, a := range vol.Attachments {
+			if aws.StringValue(a.InstanceId) == d.instanceId() {
+				v.Device = aws.StringValue(a.Device)
+			}
+		}
+		inv = append(inv, v)
+	}
+	return inv, nil
+}
+
+// tagMap turns EC2 tags into a map, or nil if there are none.
+func tagMap(tags []*ec2.Tag) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		m[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return m
+}
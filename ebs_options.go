@@ -0,0 +1,660 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The tag holding volumes' names, for referring to them other than by ID.
+// Organizations that reserve Name for other tooling may use another, such as
+// blocker:name.
+var nameTag = "Name"
+
+// Volume options that are applied at mount time are remembered as tags on the
+// EBS volume itself, named with this prefix, so that they follow the volume
+// from host to host.
+const optionTagPrefix = "blocker:"
+
+// The create options persisted on the volume for use at mount time.
+var persistentOptions = []string{
+	"compress",
+	"dirty-policy",
+	"detach-policy",
+	"reclaim",
+	"wipe",
+	"steal",
+	"pin-to-instance",
+	"autoresize",
+	"auto-grow",
+	"manage-fs",
+	"partitions",
+	"read-ahead-kb",
+	"io-scheduler",
+	"read-bps", "write-bps", "read-iops", "write-iops",
+}
+
+// Throttling hints for orchestrators, which may apply them as blkio limits on
+// the volume's device.  Blocker only records them and reports them from Get.
+var throttleOptions = []string{"read-bps", "write-bps", "read-iops", "write-iops"}
+
+var ioSchedulerRegexp = regexp.MustCompile("^[a-z0-9-]+$")
+
+var compressRegexp = regexp.MustCompile("^(zlib|lzo|zstd)(:[0-9]+)?$")
+
+var pinRegexp = regexp.MustCompile("^(true|false|i-[0-9a-f]+)$")
+
+// The tag recording the instance a volume with pin-to-instance=true was
+// first mounted on.
+const pinnedInstanceTag = optionTagPrefix + "pinned-instance"
+
+// The kinds of values options take, as described in errors.
+type optionKind string
+
+const (
+	optionString   optionKind = "a string"
+	optionBool     optionKind = "true or false"
+	optionNumber   optionKind = "a non-negative integer"
+	optionPositive optionKind = "a positive integer"
+	optionDuration optionKind = "a duration such as 10m"
+)
+
+// The options EBS volumes may be created with, and the kind of value each
+// takes, besides tag.<key> options.  validateOptions and validateCreateOptions
+// check their values further.
+var ebsOptionKinds = map[string]optionKind{
+	"compress":          optionString,
+	"dirty-policy":      optionString,
+	"detach-policy":     optionString,
+	"reclaim":           optionString,
+	"wipe":              optionBool,
+	"steal":             optionString,
+	"pin-to-instance":   optionString,
+	"autoresize":        optionString,
+	"auto-grow":         optionBool,
+	"manage-fs":         optionBool,
+	"partitions":        optionBool,
+	"read-ahead-kb":     optionNumber,
+	"io-scheduler":      optionString,
+	"read-bps":          optionPositive,
+	"write-bps":         optionPositive,
+	"read-iops":         optionPositive,
+	"write-iops":        optionPositive,
+	"import-from":       optionString,
+	"snapshot-id":       optionString,
+	"size":              optionPositive,
+	"provision-timeout": optionDuration,
+	"volume-type":       optionString,
+	"iops":              optionPositive,
+	"throughput":        optionPositive,
+	"encrypted":         optionBool,
+	"kms-key-id":        optionString,
+	"fstype":            optionString,
+}
+
+// Whether options Blocker doesn't know are only warned about, rather than
+// failing the create, for clients that pass options meant for other drivers.
+var allowUnknownOptions bool
+
+// checkOptionKinds makes sure every option in opts is one Blocker knows, so
+// that typos fail the create rather than being silently ignored, and that its
+// value is of the right kind.
+func checkOptionKinds(opts map[string]string) error {
+	var keys []string
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := opts[key]
+		kind, ok := ebsOptionKinds[key]
+		if !ok && strings.HasPrefix(key, userTagPrefix) {
+			continue
+		} else if !ok {
+			msg := fmt.Sprintf("Unknown option %q", key)
+			if similar := similarOption(key); similar != "" {
+				msg += fmt.Sprintf("; did you mean %q?", similar)
+			} else {
+				msg += "."
+			}
+			if !allowUnknownOptions {
+				return errorf(ErrInvalidOption, "%s", msg)
+			}
+			logError("%s  Ignoring it.\n", msg)
+			continue
+		}
+
+		valid := true
+		switch kind {
+		case optionBool:
+			valid = v == "true" || v == "false"
+		case optionNumber:
+			_, err := strconv.ParseUint(v, 10, 32)
+			valid = err == nil
+		case optionPositive:
+			n, err := strconv.ParseUint(v, 10, 64)
+			valid = err == nil && n > 0
+		case optionDuration:
+			t, err := time.ParseDuration(v)
+			valid = err == nil && t > 0
+		}
+		if !valid {
+			return errorf(ErrInvalidOption, "Invalid %v option %q: expected %v.",
+				key, v, kind)
+		}
+	}
+	return nil
+}
+
+// similarOption returns the known option closest to an unknown one, if any is
+// close enough to be what was meant.
+func similarOption(key string) string {
+	var known []string
+	for k := range ebsOptionKinds {
+		known = append(known, k)
+	}
+	sort.Strings(known)
+	best, bestDistance := "", 3
+	for _, k := range known {
+		if d := editDistance(key, k); d < bestDistance {
+			best, bestDistance = k, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cur[j] = prev[j-1]
+			if a[i-1] != b[j-1] {
+				cur[j]++
+			}
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// validateOptions checks the persistent options in opts for sanity.
+func validateOptions(opts map[string]string) error {
+	if c, ok := opts["compress"]; ok && !compressRegexp.MatchString(c) {
+		return errorf(ErrInvalidOption,
+			"Invalid compress option %q: expected zlib, lzo, or zstd[:level].", c)
+	}
+	if p, ok := opts["dirty-policy"]; ok && !dirtyPolicies[p] {
+		return errorf(ErrInvalidOption,
+			"Invalid dirty-policy option %q: expected fsck, readonly, refuse, or mount.",
+			p)
+	}
+	if p, ok := opts["detach-policy"]; ok && !detachPolicies[p] {
+		return errorf(ErrInvalidOption,
+			"Invalid detach-policy option %q: expected detach, keep-attached, "+
+				"or detach-after-idle.", p)
+	}
+	if p, ok := opts["reclaim"]; ok && !reclaimPolicies[p] {
+		return errorf(ErrInvalidOption,
+			"Invalid reclaim option %q: expected retain or delete.", p)
+	}
+	if opts["wipe"] == "true" {
+		// Without a reclaim option, the volume gets the daemon's default.
+		policy := opts["reclaim"]
+		if policy == "" {
+			policy = defaultReclaimPolicy
+		}
+		if policy != ReclaimPolicyDelete {
+			return errorf(ErrInvalidOption,
+				"The wipe option only applies to volumes with reclaim=delete, "+
+					"but this volume's reclaim policy is %v.", policy)
+		}
+	}
+	if opts["wipe"] == "true" && !featureAvailable("wipe") {
+		return errorf(ErrInvalidOption,
+			"The wipe option needs blkdiscard, which is not installed.")
+	}
+	if p, ok := opts["steal"]; ok && !stealPolicies[p] {
+		return errorf(ErrInvalidOption,
+			"Invalid steal option %q: expected never, stopped, or always.", p)
+	}
+	if v, ok := opts["pin-to-instance"]; ok && !pinRegexp.MatchString(v) {
+		return errorf(ErrInvalidOption,
+			"Invalid pin-to-instance option %q: expected true, false, or an "+
+				"instance ID.", v)
+	}
+	if opts["partitions"] == "true" && opts["manage-fs"] == "false" {
+		return errorf(ErrInvalidOption,
+			"The partitions option needs manage-fs, which mounts them.")
+	}
+	if v, ok := opts["autoresize"]; ok {
+		if _, err := parseResizePolicy(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := opts["io-scheduler"]; ok && !ioSchedulerRegexp.MatchString(v) {
+		return errorf(ErrInvalidOption, "Invalid io-scheduler option %q.", v)
+	}
+	return nil
+}
+
+// The EBS volume types Blocker can create, and the smallest size of each in
+// GiB.
+var volumeTypeMinSize = map[string]int64{
+	ec2.VolumeTypeStandard: 1,
+	ec2.VolumeTypeGp2:      1,
+	ec2.VolumeTypeGp3:      1,
+	ec2.VolumeTypeIo1:      4,
+	ec2.VolumeTypeIo2:      4,
+	ec2.VolumeTypeSt1:      125,
+	ec2.VolumeTypeSc1:      125,
+}
+
+// The tag marking volumes Blocker created, and whether names and IDs only
+// refer to such volumes, so that volumes of unrelated tooling, or of another
+// Blocker with its own managed tag, are never touched.
+var managedTag = optionTagPrefix + "managed"
+
+var managedOnly bool
+
+// Options named tag.<key> become tags on the volumes Blocker creates, e.g. for
+// cost allocation.
+const userTagPrefix = "tag."
+
+// Whether every volume Blocker creates is encrypted, whatever its options, and
+// the KMS key to encrypt them with if not the account's default.
+var (
+	forceEncryption bool
+	defaultKmsKeyId string
+)
+
+// The performance limits of gp3 volumes: the IOPS they may be provisioned
+// with, at most so many per GiB of their size, and their throughput in MiB/s,
+// at most a quarter of their IOPS.
+const (
+	gp3MinIops             = 3000
+	gp3MaxIops             = 80000
+	gp3IopsPerGiB          = 500
+	gp3MinThroughput       = 125
+	gp3MaxThroughput       = 2000
+	gp3IopsPerMiBPerSecond = 4
+)
+
+// The limits on provisioned IOPS for the volume types that support them: the
+// range allowed, and the most per GiB of the volume's size.
+var volumeTypeIops = map[string]struct{ min, max, perGiB int64 }{
+	ec2.VolumeTypeGp3: {gp3MinIops, gp3MaxIops, gp3IopsPerGiB},
+	ec2.VolumeTypeIo1: {100, 64000, 50},
+	ec2.VolumeTypeIo2: {100, 256000, 500},
+}
+
+// The options describing a new EBS volume, besides tag.<key> options.  Any of
+// them makes Create provision the volume.
+var newVolumeOptions = []string{
+	"size", "volume-type", "iops", "throughput", "encrypted", "kms-key-id",
+	"fstype", "provision-timeout",
+}
+
+// isSeeded reports whether opts create a volume from existing data, with
+// import-from or snapshot-id, rather than an empty one.
+func isSeeded(opts map[string]string) bool {
+	_, importing := opts["import-from"]
+	_, restoring := opts["snapshot-id"]
+	return importing || restoring
+}
+
+// validateCreateOptions checks the options describing a volume to create.
+// Blocker creates one when given import-from or snapshot-id, which size it,
+// or else a size.
+func validateCreateOptions(opts map[string]string) error {
+	_, importing := opts["import-from"]
+	_, restoring := opts["snapshot-id"]
+	if importing && restoring {
+		return errorf(ErrInvalidOption,
+			"The import-from and snapshot-id options cannot be combined.")
+	}
+	if _, ok := opts["fstype"]; ok && isSeeded(opts) {
+		return errorf(ErrInvalidOption,
+			"The fstype option only applies to new, empty volumes; volumes "+
+				"created with import-from or snapshot-id keep their filesystem.")
+	}
+	if _, ok := opts["size"]; !ok && !isSeeded(opts) {
+		keys := append([]string{}, newVolumeOptions...)
+		for key := range opts {
+			if strings.HasPrefix(key, userTagPrefix) {
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range keys {
+			if _, ok := opts[key]; ok {
+				return errorf(ErrInvalidOption,
+					"The %v option describes a new volume, which needs the size "+
+						"option (in GiB), or import-from or snapshot-id.", key)
+			}
+		}
+	}
+	if v, ok := opts["fstype"]; ok {
+		if _, known := filesystems[v]; !known {
+			return errorf(ErrInvalidOption,
+				"Invalid fstype option %q: expected ext2, ext3, ext4, xfs, or btrfs.",
+				v)
+		}
+	}
+	for key := range opts {
+		if !strings.HasPrefix(key, userTagPrefix) {
+			continue
+		}
+		tag := strings.TrimPrefix(key, userTagPrefix)
+		if tag == "" || tag == nameTag || tag == managedTag ||
+			strings.HasPrefix(tag, "aws:") ||
+			strings.HasPrefix(tag, optionTagPrefix) {
+			return errorf(ErrInvalidOption, "Invalid %v option: tag %q is reserved.",
+				key, tag)
+		}
+	}
+	if opts["encrypted"] == "false" {
+		if forceEncryption {
+			return errorf(ErrInvalidOption,
+				"Unencrypted volumes are not allowed on this host.")
+		}
+		if _, ok := opts["kms-key-id"]; ok {
+			return errorf(ErrInvalidOption,
+				"The kms-key-id option requires encryption.")
+		}
+	}
+	t, ok := opts["volume-type"]
+	if ok {
+		if _, ok := volumeTypeMinSize[t]; !ok {
+			return errorf(ErrInvalidOption,
+				"Invalid volume-type option %q: expected gp2, gp3, io1, io2, st1, "+
+					"sc1, or standard.", t)
+		}
+	}
+	limits, provisioned := volumeTypeIops[t]
+	if v, ok := opts["iops"]; ok {
+		if !provisioned {
+			return errorf(ErrInvalidOption,
+				"The iops option requires volume-type gp3, io1, or io2.")
+		}
+		iops, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || iops < limits.min || iops > limits.max {
+			return errorf(ErrInvalidOption,
+				"Invalid iops option %q: %v volumes allow %v to %v IOPS.",
+				v, t, limits.min, limits.max)
+		}
+	} else if t == ec2.VolumeTypeIo1 || t == ec2.VolumeTypeIo2 {
+		return errorf(ErrInvalidOption, "%v volumes require the iops option.", t)
+	}
+	if v, ok := opts["throughput"]; ok {
+		if t != ec2.VolumeTypeGp3 {
+			return errorf(ErrInvalidOption,
+				"The throughput option requires volume-type gp3.")
+		}
+		throughput, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || throughput < gp3MinThroughput ||
+			throughput > gp3MaxThroughput {
+			return errorf(ErrInvalidOption,
+				"Invalid throughput option %q: expected %v to %v MiB/s.",
+				v, gp3MinThroughput, gp3MaxThroughput)
+		}
+		iops := int64(gp3MinIops)
+		if v, ok := opts["iops"]; ok {
+			iops, _ = strconv.ParseInt(v, 10, 64)
+		}
+		if throughput*gp3IopsPerMiBPerSecond > iops {
+			return errorf(ErrInvalidOption,
+				"Throughput of %v MiB/s needs at least %v IOPS, not %v.",
+				throughput, throughput*gp3IopsPerMiBPerSecond, iops)
+		}
+	}
+	return nil
+}
+
+// checkVolumeSize makes sure a volume of the given size (in GiB) may be
+// created with the volume-type and iops options in opts.
+func checkVolumeSize(opts map[string]string, size int64) error {
+	if size <= 0 {
+		return errorf(ErrInvalidOption, "Invalid volume size %v GiB.", size)
+	}
+	t, ok := opts["volume-type"]
+	if !ok {
+		return nil
+	}
+	if size < volumeTypeMinSize[t] {
+		return errorf(ErrInvalidOption,
+			"%v volumes must be at least %v GiB, not %v.",
+			t, volumeTypeMinSize[t], size)
+	}
+	if v, ok := opts["iops"]; ok {
+		iops, _ := strconv.ParseInt(v, 10, 64)
+		if perGiB := volumeTypeIops[t].perGiB; iops > perGiB*size {
+			return errorf(ErrInvalidOption,
+				"%v volumes allow at most %v IOPS per GiB; %v GiB is too small "+
+					"for %v IOPS.", t, perGiB, size, iops)
+		}
+	}
+	return nil
+}
+
+// newVolumeInput describes a new volume called name in this availability
+// zone, of the given size in GiB, as requested by the volume-type, iops,
+// throughput, encrypted, kms-key-id, and tag.<key> options in opts, which
+// must already have been validated.  Tags, including the managed tag of the
+// driver's tenant, are applied as part of the creation, so the volume never
+// exists without them.
+func (d *ebsVolumeDriver) newVolumeInput(name string, size int64,
+	opts map[string]string) *ec2.CreateVolumeInput {
+	tags := []*ec2.Tag{
+		{Key: aws.String(nameTag), Value: aws.String(name)},
+		{Key: aws.String(d.tenant.ManagedTag), Value: aws.String("true")},
+	}
+	var keys []string
+	for key := range opts {
+		if strings.HasPrefix(key, userTagPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tags = append(tags, &ec2.Tag{
+			Key:   aws.String(strings.TrimPrefix(key, userTagPrefix)),
+			Value: aws.String(opts[key]),
+		})
+	}
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(d.zone()),
+		Size:             aws.Int64(size),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeVolume),
+			Tags:         tags,
+		}},
+	}
+	if t, ok := opts["volume-type"]; ok {
+		input.VolumeType = aws.String(t)
+	}
+	if v, ok := opts["iops"]; ok {
+		iops, _ := strconv.ParseInt(v, 10, 64)
+		input.Iops = aws.Int64(iops)
+	}
+	if v, ok := opts["throughput"]; ok {
+		throughput, _ := strconv.ParseInt(v, 10, 64)
+		input.Throughput = aws.Int64(throughput)
+	}
+	keyId, ok := opts["kms-key-id"]
+	if forceEncryption || opts["encrypted"] == "true" || ok {
+		input.Encrypted = aws.Bool(true)
+		if !ok {
+			keyId = defaultKmsKeyId
+		}
+		if keyId != "" {
+			input.KmsKeyId = aws.String(keyId)
+		}
+	}
+	return input
+}
+
+// checkPin makes sure a volume with the pin-to-instance option may be
+// attached to this instance, pinning it here if it isn't pinned yet.  It
+// reports whether it did, so that the pin can be undone should the attach
+// fail.
+func (d *ebsVolumeDriver) checkPin(id string, opts map[string]string) (bool, error) {
+	pin := opts["pin-to-instance"]
+	switch pin {
+	case "", "false":
+		return false, nil
+	case "true":
+		if pin = opts["pinned-instance"]; pin == "" {
+			log("\tPinning EBS volume %v to %v.\n", id, d.instanceId())
+			_, err := d.ec2.CreateTags(&ec2.CreateTagsInput{
+				Resources: []*string{aws.String(id)},
+				Tags: []*ec2.Tag{{
+					Key:   aws.String(pinnedInstanceTag),
+					Value: aws.String(d.instanceId()),
+				}},
+			})
+			return err == nil, err
+		}
+	}
+	if pin != d.instanceId() {
+		return false, errorf(ErrPinned, "Volume %v is pinned to instance %v.", id, pin)
+	}
+	return false, nil
+}
+
+// unpin removes a pin to this instance placed by checkPin (ignoring errors).
+func (d *ebsVolumeDriver) unpin(id string) {
+	if _, err := d.ec2.DeleteTags(&ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags: []*ec2.Tag{{
+			Key:   aws.String(pinnedInstanceTag),
+			Value: aws.String(d.instanceId()),
+		}},
+	}); err != nil {
+		logError("Unpinning EBS volume %v failed: %v\n", id, err)
+		return
+	}
+	log("\tUnpinned EBS volume %v from %v.\n", id, d.instanceId())
+}
+
+// saveOptions records the persistent options in opts as tags on a volume.
+func (d *ebsVolumeDriver) saveOptions(id string, opts map[string]string) error {
+	var tags []*ec2.Tag
+	for _, key := range persistentOptions {
+		if value, ok := opts[key]; ok {
+			tags = append(tags, &ec2.Tag{
+				Key:   aws.String(optionTagPrefix + key),
+				Value: aws.String(value),
+			})
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	_, err := d.ec2.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      tags,
+	})
+	return err
+}
+
+// loadOptions returns the options previously saved on a volume, along with
+// the volume's description.
+func (d *ebsVolumeDriver) loadOptions(
+	id string) (map[string]string, *ec2.Volume, error) {
+	volumes, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	vol := volumes.Volumes[0]
+	opts := make(map[string]string)
+	for _, tag := range vol.Tags {
+		if strings.HasPrefix(*tag.Key, optionTagPrefix) {
+			opts[strings.TrimPrefix(*tag.Key, optionTagPrefix)] = *tag.Value
+		}
+	}
+	return opts, vol, nil
+}
+
+// Mounts that only succeeded without their volume's options, by volume.
+var degradedMounts = expvar.NewMap("degraded_mounts")
+
+// mountArgs builds the mount command line for a device, applying whichever
+// of the volume's options its filesystem supports.
+func mountArgs(
+	dev string, mnt string, opts map[string]string, readOnly bool) []string {
+	var flags []string
+	if readOnly {
+		flags = append(flags, "ro")
+	}
+	fstype := filesystemType(dev)
+	for _, key := range mountOptionKeys {
+		v, ok := opts[key]
+		if !ok {
+			continue
+		}
+		if fs, known := filesystems[fstype]; known {
+			if flag, ok := fs.mountOption(key, v); ok {
+				flags = append(flags, flag)
+				continue
+			}
+		}
+		log("\tWarning: %v filesystem on %v does not support %v; "+
+			"ignoring %v=%v.\n", fstype, dev, key, key, v)
+	}
+
+	args := []string{dev, mnt}
+	if len(flags) > 0 {
+		args = append([]string{"-o", strings.Join(flags, ",")}, args...)
+	}
+	return args
+}
+
+// filesystemType returns the type of filesystem on a device, or "" if it
+// cannot be determined.
+func filesystemType(dev string) string {
+	out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", dev).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// tuning returns the read-ahead and IO scheduler for a volume: its options if
+// given, otherwise defaults suited to its EBS volume type.  The kernel's own
+// defaults are poor for EBS: the hypervisor already schedules IO, and the
+// throughput-optimized HDD types need large sequential reads to perform.
+func tuning(opts map[string]string, vol *ec2.Volume) (string, string) {
+	readAhead, scheduler := "128", "none"
+	switch aws.StringValue(vol.VolumeType) {
+	case ec2.VolumeTypeSt1, ec2.VolumeTypeSc1:
+		readAhead = "1024"
+	}
+	if v, ok := opts["read-ahead-kb"]; ok {
+		readAhead = v
+	}
+	if v, ok := opts["io-scheduler"]; ok {
+		scheduler = v
+	}
+	return readAhead, scheduler
+}
@@ -0,0 +1,240 @@
+package main
+
+import "testing"
+
+func TestValidateCreateOptions(t *testing.T) {
+	tests := []struct {
+		opts  map[string]string
+		valid bool
+	}{
+		{map[string]string{}, true},
+		{map[string]string{"import-from": "s3://b/k"}, true},
+		{map[string]string{"snapshot-id": "snap-1"}, true},
+		{map[string]string{"import-from": "s3://b/k", "snapshot-id": "snap-1"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "size": "10"}, true},
+		// New, empty volumes are created given their size.
+		{map[string]string{"size": "10"}, true},
+		{map[string]string{"size": "10", "volume-type": "gp3", "iops": "6000",
+			"throughput": "500", "encrypted": "true", "tag.team": "storage"}, true},
+		{map[string]string{"volume-type": "gp3"}, false},
+		{map[string]string{"encrypted": "true"}, false},
+		{map[string]string{"tag.team": "storage"}, false},
+		{map[string]string{"size": "10", "fstype": "xfs"}, true},
+		{map[string]string{"size": "10", "fstype": "zfs"}, false},
+		{map[string]string{"fstype": "xfs"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "fstype": "xfs"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp2"}, true},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "st1"}, true},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp4"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": ""}, false},
+		{map[string]string{"snapshot-id": "snap-1", "tag.team": "storage"}, true},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"iops": "3000"}, true},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"iops": "80000"}, true},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"iops": "2999"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"iops": "80001"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "io2",
+			"iops": "100"}, true},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "io1",
+			"iops": "-100"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "io1"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp2",
+			"iops": "3000"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "iops": "3000"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"throughput": "125"}, true},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"throughput": "750"}, true},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"throughput": "751"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"throughput": "1000", "iops": "4000"}, true},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"throughput": "2000", "iops": "8000"}, true},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"throughput": "2001", "iops": "80000"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"throughput": "124"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"throughput": "0"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "gp3",
+			"throughput": "fast"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "volume-type": "io2",
+			"iops": "1000", "throughput": "125"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "throughput": "125"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "tag.": "x"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "tag.Name": "x"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "tag.aws:x": "x"}, false},
+		{map[string]string{"snapshot-id": "snap-1", "tag.blocker:x": "x"}, false},
+	}
+	for _, test := range tests {
+		err := validateCreateOptions(test.opts)
+		if (err == nil) != test.valid {
+			t.Errorf("validateCreateOptions(%v) = %v, want valid: %v",
+				test.opts, err, test.valid)
+		}
+		if err != nil && errorCode(err) != ErrInvalidOption {
+			t.Errorf("validateCreateOptions(%v) = %v, want %v",
+				test.opts, errorString(err), ErrInvalidOption)
+		}
+	}
+}
+
+func TestValidateOptionsWipe(t *testing.T) {
+	saved := defaultReclaimPolicy
+	defer func() { defaultReclaimPolicy = saved }()
+
+	tests := []struct {
+		defaultPolicy string
+		opts          map[string]string
+		valid         bool
+	}{
+		{ReclaimPolicyRetain, map[string]string{"wipe": "false"}, true},
+		{ReclaimPolicyRetain, map[string]string{"wipe": "true",
+			"reclaim": "retain"}, false},
+		// Without a reclaim option the daemon's default applies.
+		{ReclaimPolicyRetain, map[string]string{"wipe": "true"}, false},
+		{ReclaimPolicyDelete, map[string]string{"wipe": "true",
+			"reclaim": "retain"}, false},
+		// Wiping also needs blkdiscard installed.
+		{ReclaimPolicyRetain, map[string]string{"wipe": "true",
+			"reclaim": "delete"}, featureAvailable("wipe")},
+		{ReclaimPolicyDelete, map[string]string{"wipe": "true"},
+			featureAvailable("wipe")},
+	}
+	for _, test := range tests {
+		defaultReclaimPolicy = test.defaultPolicy
+		err := validateOptions(test.opts)
+		if (err == nil) != test.valid {
+			t.Errorf("validateOptions(%v) with default reclaim %v = %v, "+
+				"want valid: %v", test.opts, test.defaultPolicy, err, test.valid)
+		}
+	}
+}
+
+func TestCheckVolumeSize(t *testing.T) {
+	tests := []struct {
+		opts  map[string]string
+		size  int64
+		valid bool
+	}{
+		{map[string]string{}, 1, true},
+		{map[string]string{}, 16384, true},
+		{map[string]string{}, 0, false},
+		{map[string]string{}, -1, false},
+		{map[string]string{"volume-type": "gp3"}, 1, true},
+		{map[string]string{"volume-type": "gp3"}, 0, false},
+		{map[string]string{"volume-type": "gp3"}, -10, false},
+		{map[string]string{"volume-type": "st1"}, 125, true},
+		{map[string]string{"volume-type": "st1"}, 124, false},
+		{map[string]string{"volume-type": "sc1"}, 1, false},
+		{map[string]string{"volume-type": "io1", "iops": "200"}, 4, true},
+		{map[string]string{"volume-type": "io1", "iops": "201"}, 4, false},
+		{map[string]string{"volume-type": "io2", "iops": "64000"}, 128, true},
+		{map[string]string{"volume-type": "io2", "iops": "64000"}, 127, false},
+		{map[string]string{"volume-type": "gp3", "iops": "3000"}, 6, true},
+		{map[string]string{"volume-type": "gp3", "iops": "3000"}, 5, false},
+	}
+	for _, test := range tests {
+		err := checkVolumeSize(test.opts, test.size)
+		if (err == nil) != test.valid {
+			t.Errorf("checkVolumeSize(%v, %d) = %v, want valid: %v",
+				test.opts, test.size, err, test.valid)
+		}
+	}
+}
+
+func TestCheckOptionKinds(t *testing.T) {
+	tests := []struct {
+		opts  map[string]string
+		valid bool
+	}{
+		{map[string]string{}, true},
+		{map[string]string{"auto-grow": "true"}, true},
+		{map[string]string{"auto-grow": "yes"}, false},
+		{map[string]string{"read-ahead-kb": "0"}, true},
+		{map[string]string{"read-ahead-kb": "-1"}, false},
+		{map[string]string{"read-ahead-kb": "4294967296"}, false},
+		{map[string]string{"size": "1"}, true},
+		{map[string]string{"size": "0"}, false},
+		{map[string]string{"size": "-5"}, false},
+		{map[string]string{"size": "1.5"}, false},
+		{map[string]string{"provision-timeout": "10m"}, true},
+		{map[string]string{"provision-timeout": "0s"}, false},
+		{map[string]string{"provision-timeout": "-1m"}, false},
+		{map[string]string{"provision-timeout": "10"}, false},
+		{map[string]string{"reclaim": "anything"}, true},
+		{map[string]string{"tag.team": "storage"}, true},
+		{map[string]string{"sise": "10"}, false},
+		{map[string]string{"no-such-option": "true"}, false},
+	}
+	for _, test := range tests {
+		err := checkOptionKinds(test.opts)
+		if (err == nil) != test.valid {
+			t.Errorf("checkOptionKinds(%v) = %v, want valid: %v",
+				test.opts, err, test.valid)
+		}
+		if err != nil && errorCode(err) != ErrInvalidOption {
+			t.Errorf("checkOptionKinds(%v) = %v, want %v",
+				test.opts, errorString(err), ErrInvalidOption)
+		}
+	}
+}
+
+func TestCheckOptionKindsAllowUnknown(t *testing.T) {
+	defer func(allow bool) { allowUnknownOptions = allow }(allowUnknownOptions)
+	allowUnknownOptions = true
+	if err := checkOptionKinds(map[string]string{"no-such-option": "x"}); err != nil {
+		t.Errorf("Unknown option failed with -allow-unknown-options: %v", err)
+	}
+	// Known options are still checked.
+	if err := checkOptionKinds(map[string]string{"size": "x"}); err == nil {
+		t.Errorf("Invalid size passed with -allow-unknown-options.")
+	}
+}
+
+func TestSimilarOption(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"sise", "size"},
+		{"autogrow", "auto-grow"},
+		{"auto_grow", "auto-grow"},
+		{"reclam", "reclaim"},
+		{"iopss", "iops"},
+		{"size", "size"},
+		// Nothing within two edits.
+		{"no-such-option", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := similarOption(test.in); got != test.want {
+			t.Errorf("similarOption(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"size", "size", 0},
+		{"size", "sise", 1},
+		{"size", "sizes", 1},
+		{"sizes", "size", 1},
+		{"size", "ize", 1},
+		{"kitten", "sitting", 3},
+		{"ab", "ba", 2},
+	}
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d",
+				test.a, test.b, got, test.want)
+		}
+	}
+}
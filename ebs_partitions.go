@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A partition of a disk.
+type partition struct {
+	Number int
+	Device string
+}
+
+// partitionDir returns where partition n of a partitioned volume mounted at
+// mnt is mounted, which is where sub-volumes such as name/part1 point.
+func partitionDir(mnt string, n int) string {
+	return filepath.Join(mnt, fmt.Sprintf("part%d", n))
+}
+
+// diskPartitions lists the partitions of a disk in order, as the kernel sees
+// them.
+func diskPartitions(dev string) ([]partition, error) {
+	if resolved, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = resolved
+	}
+	base := filepath.Base(dev)
+	dir := filepath.Join("/sys/class/block", base)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var parts []partition
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), base) {
+			continue
+		}
+		n, err := strconv.Atoi(readSysfs(filepath.Join(dir, entry.Name(), "partition")))
+		if err != nil {
+			continue
+		}
+		parts = append(parts, partition{Number: n, Device: "/dev/" + entry.Name()})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	return parts, nil
+}
+
+// parentDisk returns the disk a partition belongs to, or "" if unknown.
+func parentDisk(dev string) string {
+	if resolved, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = resolved
+	}
+	// Partitions' sysfs entries live in their disk's.
+	sys, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", filepath.Base(dev)))
+	if err != nil || readSysfs(filepath.Join(sys, "partition")) == "" {
+		return ""
+	}
+	return "/dev/" + filepath.Base(filepath.Dir(sys))
+}
+
+// mountedPartitions returns the mounts on the partition directories beneath a
+// partitioned volume's mountpoint.
+func mountedPartitions(mnt string) []mountEntry {
+	mounts, err := readMounts(mnt + "/")
+	if err != nil {
+		return nil
+	}
+	var parts []mountEntry
+	for _, m := range mounts {
+		if filepath.Dir(m.Mountpoint) == mnt &&
+			strings.HasPrefix(filepath.Base(m.Mountpoint), "part") {
+			parts = append(parts, m)
+		}
+	}
+	return parts
+}
+
+// partitionedDisk returns the disk whose partitions are mounted beneath a
+// partitioned volume's mountpoint, or "" if none are.
+func partitionedDisk(mnt string) string {
+	for _, m := range mountedPartitions(mnt) {
+		if disk := parentDisk(m.Device); disk != "" {
+			return disk
+		}
+	}
+	return ""
+}
+
+// mountPartitions mounts each partition of a partitioned volume's disk in a
+// directory of its own beneath the volume's mountpoint, applying the volume's
+// dirty policy and mount options to each.  If any fails, those already
+// mounted are unmounted again.
+func mountPartitions(name string, dev string, mnt string,
+	opts map[string]string) error {
+	// The kernel reads the partition table once the disk shows up, so its
+	// partitions may lag behind it.
+	var parts []partition
+	for tries := 0; len(parts) == 0; tries++ {
+		var err error
+		if parts, err = diskPartitions(dev); err != nil {
+			return err
+		}
+		if len(parts) == 0 && tries == 5 {
+			return errorf(ErrMountFailed, "Volume %v has no partitions on %v.",
+				name, dev)
+		}
+		if len(parts) == 0 {
+			time.Sleep(time.Second)
+		}
+	}
+
+	for _, p := range parts {
+		dir := partitionDir(mnt, p.Number)
+		err := os.MkdirAll(dir, os.ModeDir|0700)
+		readOnly := false
+		if err == nil {
+			readOnly, err = checkDirty(name, p.Device, opts["dirty-policy"])
+		}
+		if err == nil {
+			var out []byte
+			if out, err = mountWithRetry(mountArgs(p.Device, dir, opts, readOnly)); err != nil {
+				err = errorf(ErrMountFailed, "Mounting partition %v to %v failed: %v\n%v",
+					p.Device, dir, err, string(out))
+			}
+		}
+		if err != nil {
+			unmountPartitions(mnt)
+			return err
+		}
+		log("\tMounted partition %v at %v.\n", p.Device, dir)
+	}
+	return nil
+}
+
+// unmountPartitions unmounts the partitions mounted beneath a partitioned
+// volume's mountpoint and removes their directories.
+func unmountPartitions(mnt string) error {
+	for _, m := range mountedPartitions(mnt) {
+		if out, err := runWithTimeout(mountTimeout, "umount", m.Mountpoint); err != nil {
+			if errorCode(err) == ErrCommandTimeout {
+				return err
+			}
+			return errorf(ErrUnmountFailed,
+				"Unmounting %v failed: %v\n%v", m.Mountpoint, err, string(out))
+		}
+	}
+	dirs, _ := filepath.Glob(filepath.Join(mnt, "part*"))
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	// How long the poller waits for more requests before describing a batch.
+	pollBatchWindow = 250 * time.Millisecond
+	// The most values DescribeVolumes accepts in a single filter.
+	pollBatchSize = 200
+)
+
+type pollResult struct {
+	volume *ec2.Volume
+	err    error
+}
+
+// volumePoller batches the DescribeVolumes calls of everything waiting on
+// volume state transitions, so that mounting many volumes at once, e.g. when
+// a node starts up, doesn't cost one API call per volume per poll.
+type volumePoller struct {
+	ec2     *ec2.EC2
+	mu      sync.Mutex
+	waiting map[string][]chan pollResult
+	wake    chan struct{}
+}
+
+func newVolumePoller(svc *ec2.EC2) *volumePoller {
+	p := &volumePoller{
+		ec2:     svc,
+		waiting: make(map[string][]chan pollResult),
+		wake:    make(chan struct{}, 1),
+	}
+	go p.run()
+	return p
+}
+
+// describe returns the current state of a volume, as of the next batch.
+func (p *volumePoller) describe(id string) (*ec2.Volume, error) {
+	ch := make(chan pollResult, 1)
+	p.mu.Lock()
+	p.waiting[id] = append(p.waiting[id], ch)
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	r := <-ch
+	return r.volume, r.err
+}
+
+func (p *volumePoller) run() {
+	for range p.wake {
+		time.Sleep(pollBatchWindow)
+		p.mu.Lock()
+		waiting := p.waiting
+		p.waiting = make(map[string][]chan pollResult)
+		p.mu.Unlock()
+
+		ids := make([]*string, 0, len(waiting))
+		for id := range waiting {
+			ids = append(ids, aws.String(id))
+		}
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > pollBatchSize {
+				n = pollBatchSize
+			}
+			p.poll(ids[:n], waiting)
+			ids = ids[n:]
+		}
+	}
+}
+
+// poll describes a batch of volumes and hands the results to their waiters.
+// Volumes are selected with a filter rather than by ID, so that one unknown
+// volume doesn't fail the whole batch.
+func (p *volumePoller) poll(ids []*string, waiting map[string][]chan pollResult) {
+	found := make(map[string]*ec2.Volume)
+	err := p.ec2.DescribeVolumesPages(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("volume-id"),
+			Values: ids,
+		}},
+	}, func(page *ec2.DescribeVolumesOutput, last bool) bool {
+		for _, vol := range page.Volumes {
+			found[*vol.VolumeId] = vol
+		}
+		return true
+	})
+
+	for _, id := range ids {
+		r := pollResult{volume: found[*id], err: err}
+		if r.err == nil && r.volume == nil {
+			r.err = errorf(ErrNotFound, "Volume %v not found.", *id)
+		}
+		for _, ch := range waiting[*id] {
+			ch <- r
+		}
+	}
+}
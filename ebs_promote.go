@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Clone creates a volume called clone from the latest snapshot of a volume,
+// with the same type, performance, and tags, so that changes such as schema
+// migrations can be tried out against a copy of its data.
+func (d *ebsVolumeDriver) Clone(path string, clone string) error {
+	volume, _ := parsePath(path)
+	defer d.creating.lock(clone)()
+	if _, err := d.volumeId(clone); err == nil {
+		return errorf(ErrAlreadyExists, "An EBS volume named %v already exists.", clone)
+	}
+	id, err := d.volumeId(volume)
+	if err != nil {
+		return err
+	}
+	info, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return err
+	}
+	vol := info.Volumes[0]
+	snapshotId, err := d.latestSnapshot(id)
+	if err != nil {
+		return err
+	}
+
+	input := replaceVolumeInput(vol, snapshotId)
+	input.Size = vol.Size
+	setNameTag(input, clone)
+	newVol, err := d.ec2.CreateVolume(input)
+	if err != nil {
+		return err
+	}
+	cloneId := *newVol.VolumeId
+	log("\tCreated EBS volume %v (%v) from snapshot %v of %v.\n",
+		cloneId, clone, snapshotId, volume)
+	if err := d.checkDuplicate(clone, cloneId); err != nil {
+		d.deleteVolume(cloneId)
+		return err
+	}
+	if err := d.waitUntilAvailable(cloneId); err != nil {
+		d.deleteVolume(cloneId)
+		return err
+	}
+	return nil
+}
+
+// latestSnapshot returns the ID of the most recent completed snapshot of a
+// volume.
+func (d *ebsVolumeDriver) latestSnapshot(id string) (string, error) {
+	snaps, err := d.ec2.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			{Name: aws.String("volume-id"), Values: []*string{aws.String(id)}},
+			{Name: aws.String("status"),
+				Values: []*string{aws.String(ec2.SnapshotStateCompleted)}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	var latest *ec2.Snapshot
+	for _, snap := range snaps.Snapshots {
+		if latest == nil || snap.StartTime.After(*latest.StartTime) {
+			latest = snap
+		}
+	}
+	if latest == nil {
+		return "", errorf(ErrNotFound, "EBS volume %v has no completed snapshots.", id)
+	}
+	return *latest.SnapshotId, nil
+}
+
+// setNameTag names the volume a CreateVolumeInput describes.
+func setNameTag(input *ec2.CreateVolumeInput, name string) {
+	if len(input.TagSpecifications) == 0 {
+		input.TagSpecifications = []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeVolume),
+		}}
+	}
+	spec := input.TagSpecifications[0]
+	for _, tag := range spec.Tags {
+		if *tag.Key == nameTag {
+			tag.Value = aws.String(name)
+			return
+		}
+	}
+	spec.Tags = append(spec.Tags, &ec2.Tag{
+		Key: aws.String(nameTag), Value: aws.String(name),
+	})
+}
+
+// Promote swaps a candidate volume, e.g. one made by Clone and since migrated,
+// in for the volume called name: the candidate takes over the name, and the
+// original is kept, its Name suffixed with ".pre-promote-<timestamp>", in case
+// it is needed after all.  Neither volume may be attached while this happens.
+func (d *ebsVolumeDriver) Promote(path string, candidate string) error {
+	volume, _ := parsePath(path)
+	candidate, _ = parsePath(candidate)
+	if strings.HasPrefix(volume, "vol-") {
+		return fmt.Errorf(
+			"Cannot promote to %v: only volumes referred to by Name can be replaced.",
+			volume)
+	}
+	id, err := d.volumeId(volume)
+	if err != nil {
+		return err
+	}
+	candidateId, err := d.volumeId(candidate)
+	if err != nil {
+		return err
+	}
+	if candidateId == id {
+		return errorf(ErrInvalidOption, "%v is already %v.", candidate, volume)
+	}
+	info, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id), aws.String(candidateId)},
+	})
+	if err != nil {
+		return err
+	}
+	var original *ec2.Volume
+	for _, vol := range info.Volumes {
+		if len(vol.Attachments) > 0 {
+			return errorf(ErrInUse,
+				"EBS volume %v is attached to %v; stop its users before promoting.",
+				*vol.VolumeId, *vol.Attachments[0].InstanceId)
+		}
+		if *vol.VolumeId == id {
+			original = vol
+		}
+	}
+
+	// EC2 can't retag both volumes at once, so undo the first step should the
+	// second fail; lookups of the name fail in between.
+	suffix := ".pre-promote-" + time.Now().UTC().Format("20060102T150405Z")
+	if err := d.renameVolume(original, suffix); err != nil {
+		return err
+	}
+	if _, err := d.ec2.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(candidateId)},
+		Tags:      []*ec2.Tag{{Key: aws.String(nameTag), Value: aws.String(volume)}},
+	}); err != nil {
+		if _, undoErr := d.ec2.CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{aws.String(id)},
+			Tags:      []*ec2.Tag{{Key: aws.String(nameTag), Value: aws.String(volume)}},
+		}); undoErr != nil {
+			logError("Restoring the name of %v failed: %v\n", id, undoErr)
+		}
+		return err
+	}
+	log("\tPromoted %v (%v) to %v; original kept as %v%v.\n",
+		candidate, candidateId, volume, volume, suffix)
+	return nil
+}
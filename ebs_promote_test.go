@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestSetNameTag(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []*ec2.Tag
+		want int
+	}{
+		{"untagged", nil, 1},
+		{"named", []*ec2.Tag{
+			{Key: aws.String(nameTag), Value: aws.String("data")},
+			{Key: aws.String("team"), Value: aws.String("storage")},
+		}, 2},
+		{"unnamed", []*ec2.Tag{
+			{Key: aws.String("team"), Value: aws.String("storage")},
+		}, 2},
+	}
+	for _, test := range tests {
+		input := &ec2.CreateVolumeInput{}
+		if test.tags != nil {
+			input.TagSpecifications = []*ec2.TagSpecification{{
+				ResourceType: aws.String(ec2.ResourceTypeVolume),
+				Tags:         test.tags,
+			}}
+		}
+		setNameTag(input, "data-clone")
+
+		if len(input.TagSpecifications) != 1 {
+			t.Errorf("%v: %d tag specifications, want 1", test.name,
+				len(input.TagSpecifications))
+			continue
+		}
+		tags := input.TagSpecifications[0].Tags
+		var names []string
+		for _, tag := range tags {
+			if *tag.Key == nameTag {
+				names = append(names, *tag.Value)
+			}
+		}
+		if len(tags) != test.want || len(names) != 1 || names[0] != "data-clone" {
+			t.Errorf("%v: tagged %v, want %d tags named data-clone",
+				test.name, tags, test.want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// reserveQuota checks that the driver's tenant may have another volumes EBS
+// volumes, and gib more GiB of them, counting the volumes in any availability
+// zone that carry its managed tag.  On success, it returns a function to call
+// once the volumes have been created, or their sizes modified, so that EBS
+// counts them; until then, other creations wait for their quota checks.
+func (d *ebsVolumeDriver) reserveQuota(volumes int, gib int64) (func(), error) {
+	if !d.tenant.limited() {
+		return func() {}, nil
+	}
+	d.quotaMu.Lock()
+	count, used := 0, int64(0)
+	err := d.ec2.DescribeVolumesPages(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("tag:" + d.tenant.ManagedTag),
+			Values: []*string{aws.String("true")},
+		}},
+	}, func(page *ec2.DescribeVolumesOutput, _ bool) bool {
+		for _, vol := range page.Volumes {
+			count++
+			used += aws.Int64Value(vol.Size)
+		}
+		return true
+	})
+	if err == nil {
+		err = d.tenant.checkQuota(count, used, volumes, gib)
+	}
+	if err != nil {
+		d.quotaMu.Unlock()
+		return nil, err
+	}
+	return d.quotaMu.Unlock, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"expvar"
+	"os/exec"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// What to do with a volume's EBS volume when Docker removes it.
+const (
+	// Keep the EBS volume; removing the Docker volume only unmounts it.
+	ReclaimPolicyRetain = "retain"
+	// Detach and delete the EBS volume, and with it all its data.
+	ReclaimPolicyDelete = "delete"
+)
+
+var reclaimPolicies = map[string]bool{
+	ReclaimPolicyRetain: true,
+	ReclaimPolicyDelete: true,
+}
+
+// The reclaim policy of volumes without a reclaim option.
+var defaultReclaimPolicy = ReclaimPolicyRetain
+
+var volumesWiped = expvar.NewInt("volumes_wiped")
+
+// reclaimPolicy returns the reclaim policy of an EBS volume, along with its
+// options and the volume as last described.
+func (d *ebsVolumeDriver) reclaimPolicy(
+	id string) (string, map[string]string, *ec2.Volume, error) {
+	opts, vol, err := d.loadOptions(id)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if policy := opts["reclaim"]; policy != "" {
+		return policy, opts, vol, nil
+	}
+	return defaultReclaimPolicy, opts, vol, nil
+}
+
+// reclaim deletes a volume being removed, first unmounting and detaching it
+// from this host if need be.  Volumes attached to any other instance are left
+// alone, since something else is still using them.  With wipe, the volume is
+// zeroed before it is deleted, and is not deleted at all if that fails.
+func (d *ebsVolumeDriver) reclaim(name string, id string, vol *ec2.Volume,
+	wipe bool) error {
+	for _, a := range vol.Attachments {
+		if instance := aws.StringValue(a.InstanceId); instance != d.instanceId() {
+			return errorf(ErrInUse,
+				"EBS volume %v is attached to %v; not deleting it.", id, instance)
+		}
+	}
+
+	// Wiping needs the volume attached here, so leave it attached.
+	detachPolicy := DetachPolicyDetach
+	if wipe {
+		detachPolicy = DetachPolicyKeepAttached
+	}
+	mnt := d.mountPath(name)
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err == nil ||
+		volumeDevice(mnt) != "" {
+		if err := d.doUnmount(name, detachPolicy); err != nil {
+			return err
+		}
+		d.mounts.remove(name)
+	} else if len(vol.Attachments) > 0 && !wipe {
+		// Left attached by its detach policy after it was last unmounted.
+		d.idle.cancel(id)
+		if err := d.detachVolume(id); err != nil {
+			return err
+		}
+	}
+	if wipe {
+		if err := d.wipe(name, id); err != nil {
+			return err
+		}
+	}
+	if err := d.waitUntilAvailable(id); err != nil {
+		return err
+	}
+
+	// Should another host attach the volume in the meantime, EC2 refuses to
+	// delete it.
+	if _, err := d.ec2.DeleteVolume(&ec2.DeleteVolumeInput{
+		VolumeId: aws.String(id),
+	}); err != nil {
+		return err
+	}
+	log("\tDeleted EBS volume %v (%v).\n", id, name)
+	return nil
+}
+
+// wipe overwrites the whole of a volume with zeros, attaching it here if need
+// be, and then detaches it.  EBS makes no promises about what becomes of the
+// data of deleted volumes, and discarding blocks doesn't erase them either, so
+// regulated workloads have to destroy the data themselves first.
+func (d *ebsVolumeDriver) wipe(name string, id string) error {
+	d.idle.cancel(id)
+	beginPhase(name, "attach")
+	dev, err := d.attachVolume(id)
+	if err != nil {
+		return err
+	}
+	beginPhase(name, "wipe")
+	log("\tWiping EBS volume %v (%v) on %v...\n", id, name, dev)
+	if out, err := runStreaming(name, "blkdiscard", "--zeroout", dev); err != nil {
+		if errorCode(err) == ErrCommandTimeout {
+			return err
+		}
+		return errorf(ErrWipeFailed, "Wiping %v failed, so it was not deleted: "+
+			"%v\n%v", id, err, string(out))
+	}
+	volumesWiped.Add(1)
+	beginPhase(name, "detach")
+	return d.detachVolume(id)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// restoreVolume provisions a new volume called name from an existing EBS
+// snapshot, keeping the snapshot's data.  The volume is the size of the
+// snapshot unless a larger size option (in GiB) is given.
+func (d *ebsVolumeDriver) restoreVolume(
+	name string, snapshotId string, opts map[string]string) error {
+	defer d.creating.lock(name)()
+	if _, err := d.volumeId(name); err == nil {
+		return errorf(ErrAlreadyExists, "An EBS volume named %v already exists.", name)
+	}
+	snaps, err := d.ec2.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snapshotId)},
+	})
+	if err != nil {
+		return err
+	}
+	snap := snaps.Snapshots[0]
+	if state := aws.StringValue(snap.State); state != ec2.SnapshotStateCompleted {
+		return errorf(ErrInvalidOption, "Snapshot %v is %v, not completed.",
+			snapshotId, state)
+	}
+	if d.tenant.Name != "" {
+		// Tenants may only restore the snapshots of their own volumes.
+		if _, err := d.checkManaged(aws.StringValue(snap.VolumeId)); err != nil {
+			return errorf(ErrNotFound, "No snapshot %v of tenant %v's volumes.",
+				snapshotId, d.tenant.Name)
+		}
+	}
+	size := aws.Int64Value(snap.VolumeSize)
+	if v, ok := opts["size"]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < size {
+			return errorf(ErrInvalidOption,
+				"Invalid size option %q: snapshot %v needs at least %v GiB.",
+				v, snapshotId, size)
+		}
+		size = n
+	}
+	if err := checkVolumeSize(opts, size); err != nil {
+		return err
+	}
+
+	input := d.newVolumeInput(name, size, opts)
+	input.SnapshotId = aws.String(snapshotId)
+	release, err := d.reserveQuota(1, size)
+	if err != nil {
+		return err
+	}
+	vol, err := d.ec2.CreateVolume(input)
+	release()
+	if err != nil {
+		return err
+	}
+	id := *vol.VolumeId
+	log("\tCreated EBS volume %v (%v) from snapshot %v.\n", id, name, snapshotId)
+	if err := d.checkDuplicate(name, id); err != nil {
+		d.deleteVolume(id)
+		return err
+	}
+	beginPhase(name, "provision")
+	if err := d.waitUntilAvailable(id); err != nil {
+		d.deleteVolume(id)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Rollback replaces a volume with a new one restored from a snapshot.  The
+// new volume inherits the original's name tag, options, type, and size, so
+// existing references to the name resolve to it; the original is kept, its
+// Name suffixed with ".pre-rollback-<timestamp>", in case it is needed after
+// all.  Containers using the volume must be stopped first; if it is still
+// mounted or attached here without users, it is unmounted and detached.
+func (d *ebsVolumeDriver) Rollback(path string, snapshotId string) error {
+	volume, _ := parsePath(path)
+	if strings.HasPrefix(volume, "vol-") {
+		return fmt.Errorf(
+			"Cannot roll back %v: only volumes referred to by Name can be replaced.",
+			volume)
+	}
+	id, err := d.volumeId(volume)
+	if err != nil {
+		return err
+	}
+	info, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return err
+	}
+	vol := info.Volumes[0]
+	for _, attachment := range vol.Attachments {
+		if *attachment.InstanceId != d.instanceId() {
+			return errorf(ErrInUse, "Volume %v is attached to another instance, %v.",
+				volume, *attachment.InstanceId)
+		}
+	}
+	for _, m := range d.mounts.list() {
+		if m.Volume == volume && m.Refcount > 0 {
+			return errorf(ErrInUse,
+				"Volume %v is used by %d containers; stop them before rolling back.",
+				volume, m.Refcount)
+		}
+	}
+
+	// Nothing uses the volume, but it may have been left attached.
+	if len(vol.Attachments) > 0 {
+		log("\tUnmounting %v for rollback...\n", volume)
+		d.idle.cancel(id)
+		if err := d.doUnmount(volume, DetachPolicyDetach); err != nil {
+			return err
+		}
+		d.mounts.remove(volume)
+		if err := d.waitUntilAvailable(id); err != nil {
+			return err
+		}
+	}
+
+	// The new volume only takes the name once the original has given it up,
+	// so that the two never share it.
+	input := replaceVolumeInput(vol, snapshotId)
+	input.Size = vol.Size
+	setNameTag(input, volume+replacementSuffix)
+	newVol, err := d.ec2.CreateVolume(input)
+	if err != nil {
+		return err
+	}
+	if err := d.waitUntilAvailable(*newVol.VolumeId); err != nil {
+		d.deleteVolume(*newVol.VolumeId)
+		return err
+	}
+	suffix := ".pre-rollback-" + time.Now().UTC().Format("20060102T150405Z")
+	if err := d.swapInReplacement(vol, *newVol.VolumeId, suffix); err != nil {
+		d.deleteVolume(*newVol.VolumeId)
+		return err
+	}
+	log("\tRolled back %v to snapshot %v as %v; original kept as %v%v.\n",
+		volume, snapshotId, *newVol.VolumeId, volume, suffix)
+	return nil
+}
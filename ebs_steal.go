@@ -0,0 +1,109 @@
+package main
+
+import (
+	"expvar"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// What mounting a volume still attached to another instance does.
+const (
+	// Wait for the other instance to let go of it, failing if it doesn't.
+	StealPolicyNever = "never"
+	// Forcibly detach it from the other instance if that is stopped or
+	// terminated, and otherwise wait.
+	StealPolicyStopped = "stopped"
+	// Forcibly detach it from the other instance, whatever its state.
+	StealPolicyAlways = "always"
+)
+
+var stealPolicies = map[string]bool{
+	StealPolicyNever:   true,
+	StealPolicyStopped: true,
+	StealPolicyAlways:  true,
+}
+
+// The steal policy of volumes without a steal option.
+var defaultStealPolicy = StealPolicyNever
+
+// The states of instances that are no longer using their volumes.
+var deadInstanceStates = map[string]bool{
+	ec2.InstanceStateNameStopped:      true,
+	ec2.InstanceStateNameShuttingDown: true,
+	ec2.InstanceStateNameTerminated:   true,
+}
+
+var volumesStolen = expvar.NewInt("volumes_stolen")
+
+// steal forcibly detaches a volume about to be attached here from any other
+// instance it is still attached to, as its steal policy allows, so that it can
+// fail over from a host that died without unmounting it.  Forcing a detach
+// risks the data the other instance has yet to write, which is why the
+// default is never to.
+func (d *ebsVolumeDriver) steal(id string, opts map[string]string,
+	vol *ec2.Volume) error {
+	policy := opts["steal"]
+	if policy == "" {
+		policy = defaultStealPolicy
+	}
+	if policy == StealPolicyNever {
+		return nil
+	}
+
+	for _, a := range vol.Attachments {
+		instance := aws.StringValue(a.InstanceId)
+		state := aws.StringValue(a.State)
+		if instance == d.instanceId() || state == ec2.VolumeAttachmentStateDetached {
+			continue
+		}
+		instanceState := "unknown"
+		if policy == StealPolicyStopped {
+			var err error
+			if instanceState, err = d.instanceState(instance); err != nil {
+				return err
+			}
+			if !deadInstanceStates[instanceState] {
+				log("\tEBS volume %v is attached to %v, which is %v; not "+
+					"stealing it.\n", id, instance, instanceState)
+				continue
+			}
+		}
+
+		logError("Forcibly detaching EBS volume %v from %v (%v) to mount it "+
+			"here.\n", id, instance, instanceState)
+		if _, err := d.ec2.DetachVolume(&ec2.DetachVolumeInput{
+			Force:      aws.Bool(true),
+			InstanceId: aws.String(instance),
+			VolumeId:   aws.String(id),
+		}); err != nil {
+			return err
+		}
+		volumesStolen.Add(1)
+	}
+	return nil
+}
+
+// instanceState returns the state of an instance, e.g. running or stopped.
+// Instances EC2 no longer knows of are terminated.
+func (d *ebsVolumeDriver) instanceState(instance string) (string, error) {
+	res, err := d.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instance)},
+	})
+	if aerr, ok := err.(awserr.Error); ok &&
+		aerr.Code() == "InvalidInstanceID.NotFound" {
+		return ec2.InstanceStateNameTerminated, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, r := range res.Reservations {
+		for _, i := range r.Instances {
+			if i.State != nil {
+				return aws.StringValue(i.State.Name), nil
+			}
+		}
+	}
+	return ec2.InstanceStateNameTerminated, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// How often the tags of mounted volumes are checked and repaired.  Zero
+// disables the repairs.
+var tagRepairInterval time.Duration
+
+var tagRepairs = expvar.NewInt("tag_repairs")
+
+// watchTags repairs the tags of mounted volumes at intervals.
+func (d *ebsVolumeDriver) watchTags(interval time.Duration) {
+	log("Repairing the tags of mounted volumes every %v.\n", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if err := d.repairTags(); err != nil {
+				logError("Repairing volume tags failed: %v\n", err)
+			}
+		}
+	}()
+}
+
+// repairTags restores the tags that volumes mounted by name need to be found
+// by that name, should something such as an overzealous tag policy have
+// stripped them: the name tag, and with -managed-only the blocker:managed tag.
+// Which EBS volume a mount is comes from the instance's block device mappings
+// and the mount's device, not from tags.  Tags with other values are left
+// alone, since someone may have changed them on purpose.
+func (d *ebsVolumeDriver) repairTags() error {
+	named := make(map[string]MountInfo)
+	for _, m := range d.mounts.list() {
+		if !strings.HasPrefix(m.Volume, "vol-") {
+			named[m.Device] = m
+		}
+	}
+	if len(named) == 0 {
+		return nil
+	}
+
+	instances, err := d.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(d.instanceId())},
+	})
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	var ids []*string
+	for _, r := range instances.Reservations {
+		for _, i := range r.Instances {
+			for _, bdm := range i.BlockDeviceMappings {
+				if bdm.Ebs == nil {
+					continue
+				}
+				id := aws.StringValue(bdm.Ebs.VolumeId)
+				dev := findDevice(id, aws.StringValue(bdm.DeviceName))
+				for mounted, m := range named {
+					if sameDevice(dev, mounted) {
+						names[id] = m.Volume
+						ids = append(ids, aws.String(id))
+					}
+				}
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	volumes, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{VolumeIds: ids})
+	if err != nil {
+		return err
+	}
+	for _, vol := range volumes.Volumes {
+		id := aws.StringValue(vol.VolumeId)
+		tags := tagMap(vol.Tags)
+		var missing []*ec2.Tag
+		if _, ok := tags[nameTag]; !ok {
+			missing = append(missing,
+				&ec2.Tag{Key: aws.String(nameTag), Value: aws.String(names[id])})
+		}
+		if _, ok := tags[d.tenant.ManagedTag]; !ok && d.tenant.managedOnly {
+			missing = append(missing,
+				&ec2.Tag{Key: aws.String(d.tenant.ManagedTag), Value: aws.String("true")})
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		if _, err := d.ec2.CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{vol.VolumeId},
+			Tags:      missing,
+		}); err != nil {
+			logError("Repairing the tags of %v (%v) failed: %v\n", id, names[id], err)
+			continue
+		}
+		for _, tag := range missing {
+			log("Restored tag %v=%v on %v.\n", *tag.Key, *tag.Value, id)
+		}
+		tagRepairs.Add(int64(len(missing)))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Stable, machine-readable error codes prefixed to the errors returned to
+// Docker and admin API clients, so that orchestrators and alerting can tell
+// failures apart without parsing messages.  Never change an existing code.
+const (
+	ErrUnknown          = "BLOCKER_ERROR"
+	ErrAwsApi           = "BLOCKER_AWS_ERROR"
+	ErrAwsUnavailable   = "BLOCKER_AWS_UNAVAILABLE"
+	ErrNotFound         = "BLOCKER_NOT_FOUND"
+	ErrAmbiguousName    = "BLOCKER_AMBIGUOUS_NAME"
+	ErrAlreadyExists    = "BLOCKER_ALREADY_EXISTS"
+	ErrAzMismatch       = "BLOCKER_AZ_MISMATCH"
+	ErrInvalidOption    = "BLOCKER_INVALID_OPTION"
+	ErrNotMounted       = "BLOCKER_NOT_MOUNTED"
+	ErrCommandTimeout   = "BLOCKER_COMMAND_TIMEOUT"
+	ErrInjectedFault    = "BLOCKER_INJECTED_FAULT"
+	ErrDraining         = "BLOCKER_DRAINING"
+	ErrPinned           = "BLOCKER_PINNED"
+	ErrInUse            = "BLOCKER_IN_USE"
+	ErrNoDeviceSlots    = "BLOCKER_NO_DEVICE_SLOTS"
+	ErrDeviceMissing    = "BLOCKER_DEVICE_MISSING"
+	ErrStateTimeout     = "BLOCKER_STATE_TIMEOUT"
+	ErrMountFailed      = "BLOCKER_MOUNT_FAILED"
+	ErrMountConflict    = "BLOCKER_MOUNT_CONFLICT"
+	ErrUnmountFailed    = "BLOCKER_UNMOUNT_FAILED"
+	ErrDirtyFilesystem  = "BLOCKER_DIRTY_FILESYSTEM"
+	ErrFsckFailed       = "BLOCKER_FSCK_FAILED"
+	ErrChecksumMismatch = "BLOCKER_CHECKSUM_MISMATCH"
+	ErrProvisionTimeout = "BLOCKER_PROVISION_TIMEOUT"
+	ErrFreezeFailed     = "BLOCKER_FREEZE_FAILED"
+	ErrVolumeBusy       = "BLOCKER_VOLUME_BUSY"
+
+	// Startup failures.
+	ErrMetadataUnavailable = "BLOCKER_METADATA_UNAVAILABLE"
+	ErrNotReady            = "BLOCKER_NOT_READY"
+
+	// Resize failures.
+	ErrResizeLimit  = "BLOCKER_RESIZE_LIMIT"
+	ErrResizeFailed = "BLOCKER_RESIZE_FAILED"
+
+	// Reclaim failures.
+	ErrWipeFailed = "BLOCKER_WIPE_FAILED"
+
+	// Quota failures.
+	ErrQuotaExceeded = "BLOCKER_QUOTA_EXCEEDED"
+)
+
+// A codedError is an error carrying one of the codes above.
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// errorf formats an error carrying the given code.
+func errorf(code string, format string, a ...interface{}) error {
+	return &codedError{code: code, msg: fmt.Sprintf(format, a...)}
+}
+
+// errorCode returns the code for an error.  AWS errors that callers can act
+// on get specific codes; other uncoded errors are BLOCKER_ERROR.
+func errorCode(err error) string {
+	switch e := err.(type) {
+	case *codedError:
+		return e.code
+	case awserr.Error:
+		switch e.Code() {
+		case "InvalidVolume.ZoneMismatch":
+			return ErrAzMismatch
+		case "InvalidVolume.NotFound":
+			return ErrNotFound
+		case "VolumeInUse":
+			return ErrInUse
+		case "IncorrectModificationState":
+			return ErrVolumeBusy
+		}
+		return ErrAwsApi
+	}
+	return ErrUnknown
+}
+
+// errorString renders an error for a response, prefixed with its code.
+func errorString(err error) string {
+	return errorCode(err) + ": " + err.Error()
+}
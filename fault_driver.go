@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// faultyVolumeDriver wraps another driver, delaying each operation and
+// failing some of them at random, to exercise timeout handling, Docker's
+// retries, and the errors users see.  It is for testing only, and hides the
+// wrapped driver's optional interfaces.
+type faultyVolumeDriver struct {
+	VolumeDriver
+	latency     time.Duration
+	failureRate float64
+}
+
+func NewFaultyVolumeDriver(
+	d VolumeDriver, latency time.Duration, failureRate float64) VolumeDriver {
+	log("Injecting faults: up to %v latency, %.0f%% failures.\n",
+		latency, failureRate*100)
+	return &faultyVolumeDriver{
+		VolumeDriver: d,
+		latency:      latency,
+		failureRate:  failureRate,
+	}
+}
+
+// inject delays an operation by a random fraction of the latency, and then
+// decides whether it fails.
+func (d *faultyVolumeDriver) inject(op string, name string) error {
+	if d.latency > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(d.latency))))
+	}
+	if rand.Float64() < d.failureRate {
+		return errorf(ErrInjectedFault, "Injected failure of %v on %v.", op, name)
+	}
+	return nil
+}
+
+func (d *faultyVolumeDriver) Create(name string, opts map[string]string) error {
+	if err := d.inject("Create", name); err != nil {
+		return err
+	}
+	return d.VolumeDriver.Create(name, opts)
+}
+
+func (d *faultyVolumeDriver) Mount(name string, id string) (string, error) {
+	if err := d.inject("Mount", name); err != nil {
+		return "", err
+	}
+	return d.VolumeDriver.Mount(name, id)
+}
+
+func (d *faultyVolumeDriver) Path(name string) (string, error) {
+	if err := d.inject("Path", name); err != nil {
+		return "", err
+	}
+	return d.VolumeDriver.Path(name)
+}
+
+func (d *faultyVolumeDriver) Remove(name string) error {
+	if err := d.inject("Remove", name); err != nil {
+		return err
+	}
+	return d.VolumeDriver.Remove(name)
+}
+
+func (d *faultyVolumeDriver) Unmount(name string, id string) error {
+	if err := d.inject("Unmount", name); err != nil {
+		return err
+	}
+	return d.VolumeDriver.Unmount(name, id)
+}
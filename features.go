@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// features lists the optional features a driver supports on this host, so
+// orchestrators can adapt to them rather than find out by trial and error.
+func features(d VolumeDriver) []string {
+	var fs []string
+	if _, ok := d.(Snapshotter); ok {
+		fs = append(fs, "snapshots")
+	}
+	if _, ok := d.(RollBacker); ok {
+		fs = append(fs, "rollback")
+	}
+	if _, ok := d.(Promoter); ok {
+		fs = append(fs, "promote")
+	}
+	if _, ok := d.(Exporter); ok {
+		fs = append(fs, "export")
+	}
+	if _, ok := d.(Encrypter); ok {
+		fs = append(fs, "encrypt")
+	}
+	if _, ok := d.(Freezer); ok && featureAvailable("freeze") {
+		fs = append(fs, "freeze")
+	}
+	if _, ok := d.(Resizer); ok && featureAvailable("resize") {
+		fs = append(fs, "resize")
+	}
+	if _, ok := d.(PreAttacher); ok {
+		fs = append(fs, "pre-attach")
+	}
+	if _, ok := d.(MountLister); ok {
+		fs = append(fs, "drain")
+	}
+	if fd, ok := d.(FeatureDriver); ok {
+		fs = append(fs, fd.Features()...)
+	}
+	sort.Strings(fs)
+	return fs
+}
+
+// hasNvme reports whether this host has any NVMe block devices, meaning EBS
+// volumes show up as NVMe devices here.
+func hasNvme() bool {
+	entries, err := ioutil.ReadDir(sysBlock)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "nvme") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// filesystemHandler knows how to format, check, mount, grow, and scrub one
+// type of filesystem.  Commands are returned as argument lists rather than
+// run, so that callers keep control of timeouts and logging.
+type filesystemHandler interface {
+	// formatArgs returns the arguments to mkfs, after -t <type>, that
+	// format dev.  force overwrites whatever dev already holds.
+	formatArgs(dev string, opts map[string]string, force bool) []string
+	// isDirty reports whether the filesystem on dev was left in an unclean
+	// state.
+	isDirty(dev string) bool
+	// repairCommand returns the command that repairs the filesystem on dev
+	// unattended, or nil if there is none.
+	repairCommand(dev string) []string
+	// mountOption returns the mount option that implements a volume option,
+	// or false if the filesystem does not support it.
+	mountOption(key string, value string) (string, bool)
+	// growCommand returns the command that grows the filesystem on dev,
+	// mounted at mnt, to fill dev.
+	growCommand(dev string, mnt string) []string
+	// size returns the size in bytes of the filesystem on dev, mounted at
+	// mnt, as it records it, or 0 if unknown.
+	size(dev string, mnt string) int64
+	// scrubCommand returns the command that verifies the filesystem mounted
+	// at mnt online, or nil if there is none.
+	scrubCommand(mnt string) []string
+}
+
+// The filesystems blocker knows how to handle, by type as blkid reports it.
+var filesystems = map[string]filesystemHandler{
+	"ext2":  extFilesystem{"ext2"},
+	"ext3":  extFilesystem{"ext3"},
+	"ext4":  extFilesystem{"ext4"},
+	"xfs":   xfsFilesystem{},
+	"btrfs": btrfsFilesystem{},
+}
+
+// The volume options that are passed to mount as mount options, by those
+// filesystems that support them.
+var mountOptionKeys = []string{"compress"}
+
+// mkfs formats dev with a filesystem of type fstype for volume, passing extra
+// arguments to mkfs after those the filesystem's handler asks for.  Hosts
+// without the tools to do so format it in a container of -mkfs-image, if
+// given.  Returns mkfs's output, like runStreaming.
+func mkfs(volume string, dev string, fstype string, opts map[string]string,
+	force bool, extra []string) ([]byte, error) {
+	args := filesystems[fstype].formatArgs(dev, opts, force)
+	args = append(args, extra...)
+	if mkfsImage != "" && !hostHasMkfs(fstype) {
+		return mkfsInContainer(volume, dev, fstype, args)
+	}
+	args = append([]string{"-t", fstype}, args...)
+	return runStreaming(volume, "mkfs", append(args, dev)...)
+}
+
+// extFilesystem handles the ext family.
+type extFilesystem struct {
+	fstype string
+}
+
+func (f extFilesystem) formatArgs(
+	dev string, opts map[string]string, force bool) []string {
+	var args []string
+	if opts["lazy-init"] == "false" {
+		// Initialize inode tables and the journal up front, rather than in
+		// the background during the first hours of use.
+		args = append(args, "-E", "lazy_itable_init=0,lazy_journal_init=0")
+	}
+	if force {
+		// mkfs.ext4 may otherwise ask first.
+		args = append(args, "-F")
+	}
+	return args
+}
+
+// Only the ext family records an unclean unmount cheaply.
+func (f extFilesystem) isDirty(dev string) bool {
+	sb, err := readSuperblock(dev)
+	if err != nil {
+		logError("Reading superblock of %v failed: %v\n", dev, err)
+		return false
+	}
+	if state, ok := sb["Filesystem state"]; ok && state != "clean" {
+		return true
+	}
+	return strings.Contains(sb["Filesystem features"], "needs_recovery")
+}
+
+// Preen mode only fixes problems that are safe to fix unattended.
+func (f extFilesystem) repairCommand(dev string) []string {
+	return []string{"fsck", "-t", f.fstype, "-p", dev}
+}
+
+func (f extFilesystem) mountOption(key string, value string) (string, bool) {
+	return "", false
+}
+
+func (f extFilesystem) growCommand(dev string, mnt string) []string {
+	return []string{"resize2fs", dev}
+}
+
+func (f extFilesystem) size(dev string, mnt string) int64 {
+	sb, err := readSuperblock(dev)
+	if err != nil {
+		return 0
+	}
+	blocks, _ := strconv.ParseInt(sb["Block count"], 10, 64)
+	size, _ := strconv.ParseInt(sb["Block size"], 10, 64)
+	return blocks * size
+}
+
+func (f extFilesystem) scrubCommand(mnt string) []string {
+	return nil
+}
+
+// xfsFilesystem handles XFS.
+type xfsFilesystem struct{}
+
+func (xfsFilesystem) formatArgs(
+	dev string, opts map[string]string, force bool) []string {
+	if force {
+		// mkfs.xfs otherwise refuses to overwrite an existing filesystem.
+		return []string{"-f"}
+	}
+	return nil
+}
+
+// XFS replays its log on mount, and doesn't record being left dirty.
+func (xfsFilesystem) isDirty(dev string) bool {
+	return false
+}
+
+func (xfsFilesystem) repairCommand(dev string) []string {
+	return nil
+}
+
+func (xfsFilesystem) mountOption(key string, value string) (string, bool) {
+	return "", false
+}
+
+func (xfsFilesystem) growCommand(dev string, mnt string) []string {
+	return []string{"xfs_growfs", mnt}
+}
+
+func (xfsFilesystem) size(dev string, mnt string) int64 {
+	out, err := exec.Command("xfs_info", mnt).Output()
+	if err != nil {
+		return 0
+	}
+	m := xfsDataRegexp.FindStringSubmatch(string(out))
+	if m == nil {
+		return 0
+	}
+	size, _ := strconv.ParseInt(m[1], 10, 64)
+	blocks, _ := strconv.ParseInt(m[2], 10, 64)
+	return blocks * size
+}
+
+var xfsDataRegexp = regexp.MustCompile(`data\s+=\s+bsize=([0-9]+)\s+blocks=([0-9]+)`)
+
+func (xfsFilesystem) scrubCommand(mnt string) []string {
+	return []string{"ionice", "-c", "3", "xfs_scrub", "-n", mnt}
+}
+
+// btrfsFilesystem handles btrfs.
+type btrfsFilesystem struct{}
+
+func (btrfsFilesystem) formatArgs(
+	dev string, opts map[string]string, force bool) []string {
+	if force {
+		// mkfs.btrfs otherwise refuses to overwrite an existing filesystem.
+		return []string{"-f"}
+	}
+	return nil
+}
+
+// btrfs is copy-on-write, so it is never left inconsistent.
+func (btrfsFilesystem) isDirty(dev string) bool {
+	return false
+}
+
+func (btrfsFilesystem) repairCommand(dev string) []string {
+	return nil
+}
+
+func (btrfsFilesystem) mountOption(key string, value string) (string, bool) {
+	if key == "compress" {
+		return "compress=" + value, true
+	}
+	return "", false
+}
+
+func (btrfsFilesystem) growCommand(dev string, mnt string) []string {
+	return []string{"btrfs", "filesystem", "resize", "max", mnt}
+}
+
+func (btrfsFilesystem) size(dev string, mnt string) int64 {
+	return 0
+}
+
+func (btrfsFilesystem) scrubCommand(mnt string) []string {
+	return []string{"btrfs", "scrub", "start", "-B", "-c", "3", mnt}
+}
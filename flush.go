@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type flushRequest struct {
+	Name string
+}
+
+type flushResponse struct {
+	// How many users the volume has, including the caller; it is unmounted
+	// once the last of them has stopped.
+	Consumers int
+	Err       string
+}
+
+// serveFlush writes out a mounted volume's dirty data, for containers to call
+// from pre-stop hooks so that their data is safely on disk before they and
+// their volume are stopped.  The volume itself stays mounted until Docker
+// unmounts it for its last user, as usual.
+func serveFlush(d MountLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var req flushRequest
+		var resp flushResponse
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			defer beginOperation(r.URL.Path, req.Name)()
+			resp.Consumers, err = flush(d, req.Name)
+			log("\tdone: (%s): (%d, %v)\n", req.Name, resp.Consumers, err)
+		}
+		if err != nil {
+			operationFailed(r.URL.Path, req.Name)
+			resp.Err = errorString(err)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func flush(d MountLister, name string) (int, error) {
+	volume, _ := parsePath(name)
+	for _, m := range d.Mounts() {
+		if m.Volume != volume {
+			continue
+		}
+		if linkedDevice(m.Mountpoint) != "" {
+			// Attach-only volumes have no filesystem of ours to flush.
+			return m.Refcount, nil
+		}
+		mountpoints := []string{m.Mountpoint}
+		if parts := mountedPartitions(m.Mountpoint); len(parts) > 0 {
+			mountpoints = nil
+			for _, p := range parts {
+				mountpoints = append(mountpoints, p.Mountpoint)
+			}
+		}
+		for _, mnt := range mountpoints {
+			if out, err := runWithTimeout(mountTimeout,
+				"sync", "-f", mnt); err != nil {
+				return m.Refcount, errorf(ErrUnknown, "Flushing %v failed: %v\n%v",
+					volume, err, string(out))
+			}
+		}
+		return m.Refcount, nil
+	}
+	return 0, errorf(ErrNotMounted, "Volume %v is not mounted on this host.", volume)
+}
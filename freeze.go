@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// The longest a filesystem may be left frozen, and the default if callers
+// don't say.  Applications block on writes to a frozen filesystem, so a
+// backup agent that dies mid-backup must not be able to wedge them forever.
+const (
+	maxFreezeTimeout     = 10 * time.Minute
+	defaultFreezeTimeout = time.Minute
+)
+
+// freezer freezes and thaws mounted filesystems, thawing each automatically
+// when its timeout expires.
+type freezer struct {
+	mu     sync.Mutex
+	frozen map[string]*time.Timer
+}
+
+func newFreezer() *freezer {
+	return &freezer{frozen: make(map[string]*time.Timer)}
+}
+
+func (f *freezer) freeze(mnt string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultFreezeTimeout
+	}
+	if timeout > maxFreezeTimeout {
+		return fmt.Errorf("Freeze timeout %v exceeds the maximum of %v.",
+			timeout, maxFreezeTimeout)
+	}
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err != nil {
+		return errorf(ErrNotMounted, "%v is not mounted.", mnt)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.frozen[mnt]; ok {
+		return fmt.Errorf("%v is already frozen.", mnt)
+	}
+	if out, err := exec.Command("fsfreeze", "-f", mnt).CombinedOutput(); err != nil {
+		return errorf(ErrFreezeFailed,
+			"Freezing %v failed: %v\n%v", mnt, err, string(out))
+	}
+	f.frozen[mnt] = time.AfterFunc(timeout, func() {
+		logError("%v still frozen after %v; thawing it.\n", mnt, timeout)
+		if err := f.thaw(mnt); err != nil {
+			logError("%v\n", err)
+		}
+	})
+	log("\tFroze %v for at most %v.\n", mnt, timeout)
+	return nil
+}
+
+func (f *freezer) thaw(mnt string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	timer, ok := f.frozen[mnt]
+	if !ok {
+		return fmt.Errorf("%v is not frozen.", mnt)
+	}
+	if out, err := exec.Command("fsfreeze", "-u", mnt).CombinedOutput(); err != nil {
+		return fmt.Errorf("Thawing %v failed: %v\n%v", mnt, err, string(out))
+	}
+	timer.Stop()
+	delete(f.frozen, mnt)
+	log("\tThawed %v.\n", mnt)
+	return nil
+}
+
+// thawIfFrozen thaws mnt if it is frozen, e.g. before unmounting it.
+func (f *freezer) thawIfFrozen(mnt string) {
+	f.mu.Lock()
+	_, ok := f.frozen[mnt]
+	f.mu.Unlock()
+	if ok {
+		if err := f.thaw(mnt); err != nil {
+			logError("%v\n", err)
+		}
+	}
+}
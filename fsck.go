@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// What to do when a filesystem was not cleanly unmounted, e.g. because the
+// host it was last mounted on crashed.
+const (
+	// Check and repair the filesystem with fsck before mounting it.
+	DirtyPolicyFsck = "fsck"
+	// Mount the filesystem read-only, leaving repairs to a human.
+	DirtyPolicyReadOnly = "readonly"
+	// Refuse to mount the filesystem at all.
+	DirtyPolicyRefuse = "refuse"
+	// Mount the filesystem regardless, relying on journal replay.
+	DirtyPolicyMount = "mount"
+)
+
+const defaultDirtyPolicy = DirtyPolicyFsck
+
+var dirtyPolicies = map[string]bool{
+	DirtyPolicyFsck:     true,
+	DirtyPolicyReadOnly: true,
+	DirtyPolicyRefuse:   true,
+	DirtyPolicyMount:    true,
+}
+
+// isDirty reports whether the filesystem on a device was left in an unclean
+// state.  Filesystems blocker has no handler for are assumed clean.
+func isDirty(dev string, fstype string) bool {
+	fs, ok := filesystems[fstype]
+	return ok && fs.isDirty(dev)
+}
+
+// readSuperblock returns the fields of the superblock of an ext filesystem,
+// as dumpe2fs reports them.
+func readSuperblock(dev string) (map[string]string, error) {
+	out, err := exec.Command("dumpe2fs", "-h", dev).Output()
+	if err != nil {
+		return nil, err
+	}
+	sb := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) == 2 {
+			sb[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
+		}
+	}
+	return sb, nil
+}
+
+// checkDirty applies the dirty-filesystem policy to a device before it is
+// mounted, returning whether it must be mounted read-only.
+func checkDirty(volume string, dev string, policy string) (bool, error) {
+	if policy == "" {
+		policy = defaultDirtyPolicy
+	}
+	fstype := filesystemType(dev)
+	if policy == DirtyPolicyMount || !isDirty(dev, fstype) {
+		return false, nil
+	}
+
+	log("\tWarning: %v filesystem on %v was not cleanly unmounted.\n", fstype, dev)
+	switch policy {
+	case DirtyPolicyReadOnly:
+		log("\tMounting %v read-only.\n", dev)
+		return true, nil
+	case DirtyPolicyRefuse:
+		return false, errorf(ErrDirtyFilesystem,
+			"Filesystem on %v was not cleanly unmounted; refusing to mount it "+
+				"(dirty-policy=refuse).  Run fsck on it manually.", dev)
+	}
+
+	cmd := filesystems[fstype].repairCommand(dev)
+	if cmd == nil {
+		return false, errorf(ErrDirtyFilesystem,
+			"Filesystem on %v was not cleanly unmounted, and blocker cannot "+
+				"repair %v filesystems.", dev, fstype)
+	}
+
+	// Exit codes 1 and 2 mean errors were corrected; anything higher means
+	// the repair gave up.
+	log("\tRunning %v on %v...\n", cmd[0], dev)
+	out, err := runStreaming(volume, cmd[0], cmd[1:]...)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if code := exitErr.ExitCode(); code == 1 || code == 2 {
+			err = nil
+		}
+	}
+	if err != nil {
+		return false, errorf(ErrFsckFailed,
+			"%v of %v failed: %v\n%v", cmd[0], dev, err, string(out))
+	}
+	return false, nil
+}
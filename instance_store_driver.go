@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The NVMe model string of EC2 instance-store devices.
+const instanceStoreModel = "Amazon EC2 NVMe Instance Storage"
+
+// The filesystem instance-store disks are formatted with, unless a volume's
+// fstype option says otherwise.
+var instanceStoreFsType = "ext4"
+
+var instanceStoreFsTypes = map[string]bool{"ext4": true, "xfs": true, "btrfs": true}
+
+// instanceStoreVolumeDriver exposes the instance's local NVMe instance-store
+// disks as volumes, named by their device serial numbers so the names stay
+// stable across reboots even though the kernel's nvme numbering does not.
+// Data on these disks does not survive the instance being stopped, so they
+// are only suitable for scratch space.
+type instanceStoreVolumeDriver struct {
+	mu sync.Mutex
+	// Create options by volume, consulted when formatting on first mount.
+	opts   map[string]map[string]string
+	mounts *mountTable
+}
+
+func NewInstanceStoreVolumeDriver() (VolumeDriver, error) {
+	d := &instanceStoreVolumeDriver{
+		opts:   make(map[string]map[string]string),
+		mounts: newMountTable(),
+	}
+
+	disks, err := instanceStoreDisks()
+	if err != nil {
+		return nil, err
+	}
+	if len(disks) == 0 {
+		return nil, errors.New("No instance-store NVMe devices found.")
+	}
+
+	log("Found instance-store devices (data is EPHEMERAL):\n")
+	for serial, dev := range disks {
+		log("\t%v : %v\n", serial, dev)
+	}
+	return d, nil
+}
+
+// instanceStoreDisks maps the serial numbers of all instance-store devices to
+// their current device paths.
+func instanceStoreDisks() (map[string]string, error) {
+	entries, err := ioutil.ReadDir(sysBlock)
+	if err != nil {
+		return nil, err
+	}
+	disks := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "nvme") {
+			continue
+		}
+		dir := filepath.Join(sysBlock, name, "device")
+		if readSysfs(filepath.Join(dir, "model")) != instanceStoreModel {
+			continue
+		}
+		disks[readSysfs(filepath.Join(dir, "serial"))] = "/dev/" + name
+	}
+	return disks, nil
+}
+
+func (d *instanceStoreVolumeDriver) device(name string) (string, error) {
+	disks, err := instanceStoreDisks()
+	if err != nil {
+		return "", err
+	}
+	dev, ok := disks[name]
+	if !ok {
+		return "", fmt.Errorf("No instance-store device with serial %v.", name)
+	}
+	return dev, nil
+}
+
+func (d *instanceStoreVolumeDriver) Create(path string, opts map[string]string) error {
+	volume, _ := parsePath(path)
+	if _, err := d.device(volume); err != nil {
+		return err
+	}
+	for _, key := range []string{"lazy-init", "force-format"} {
+		if v, ok := opts[key]; ok && v != "true" && v != "false" {
+			return fmt.Errorf("Invalid %v option %q: expected true or false.", key, v)
+		}
+	}
+	if v, ok := opts["fstype"]; ok && !instanceStoreFsTypes[v] {
+		return fmt.Errorf("Invalid fstype option %q: expected ext4, xfs, or btrfs.", v)
+	}
+	if v, ok := opts["mkfs-args"]; ok {
+		if _, err := mkfsArgs(v); err != nil {
+			return err
+		}
+	}
+	if _, err := d.checkFormattable(volume, opts); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.opts[volume] = opts
+	d.mu.Unlock()
+	log("\tWarning: data on instance-store volume %v is ephemeral.\n", volume)
+	return nil
+}
+
+// checkFormattable probes a volume's disk, returning the filesystem already
+// on it, if any.  Disks holding something else, e.g. a partition table or
+// RAID member, are refused rather than formatted, unless force-format is set.
+func (d *instanceStoreVolumeDriver) checkFormattable(
+	volume string, opts map[string]string) (string, error) {
+	dev, err := d.device(volume)
+	if err != nil {
+		return "", err
+	}
+	fstype, other, err := probeDevice(dev)
+	if err != nil {
+		return "", err
+	}
+	if other != "" && opts["force-format"] != "true" {
+		return "", fmt.Errorf(
+			"Device %v of volume %v holds a %v, not a filesystem; pass "+
+				"-o force-format=true to format it anyway.", dev, volume, other)
+	}
+	return fstype, nil
+}
+
+// mkfsArgs parses the mkfs-args option: extra arguments for mkfs, such as
+// "-m 0 -O ^has_journal" for ext4.  They may not name the filesystem type or
+// any paths, lest they format something other than the volume's disk.
+func mkfsArgs(s string) ([]string, error) {
+	args, err := splitArgs(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid mkfs-args option: %v", err)
+	}
+	for _, arg := range args {
+		// -t may have its value attached, e.g. -text4, and paths may be
+		// relative to blocker's working directory.
+		if strings.HasPrefix(arg, "-t") || strings.HasPrefix(arg, "--type") ||
+			strings.Contains(arg, "/") {
+			return nil, fmt.Errorf(
+				"Invalid mkfs-args option: %q is not allowed; use fstype instead "+
+					"of -t, and no paths.", arg)
+		}
+	}
+	return args, nil
+}
+
+func (d *instanceStoreVolumeDriver) Mount(path string, id string) (string, error) {
+	volume, folder := parsePath(path)
+	mnt := mountPath(volume)
+
+	if err := os.MkdirAll(mnt, os.ModeDir|0700); err != nil {
+		return "", err
+	}
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err == nil {
+		d.mounts.add(volume, mountedDevice(mnt), mnt, id, mnt+folder)
+		return mnt + folder, nil
+	}
+
+	dev, err := d.device(volume)
+	if err != nil {
+		return "", err
+	}
+	d.mu.Lock()
+	opts := d.opts[volume]
+	d.mu.Unlock()
+	fstype, err := d.checkFormattable(volume, opts)
+	if err != nil {
+		return "", err
+	}
+
+	// Instance-store disks come up blank whenever the instance is launched or
+	// restarted, so format them on first use.  force-format formats them
+	// even if they already hold something, but only the first time.
+	force := opts["force-format"] == "true"
+	if fstype == "" || force {
+		if fstype = opts["fstype"]; fstype == "" {
+			fstype = instanceStoreFsType
+		}
+		log("\tFormatting instance-store device %v with %v...\n", dev, fstype)
+		extra, _ := mkfsArgs(opts["mkfs-args"])
+		if out, err := mkfs(volume, dev, fstype, opts, force, extra); err != nil {
+			return "", errorf(ErrMountFailed, "Formatting device %v failed: %v\n%v",
+				dev, err, string(out))
+		}
+		d.mu.Lock()
+		formatted := make(map[string]string, len(opts))
+		for k, v := range opts {
+			if k != "force-format" {
+				formatted[k] = v
+			}
+		}
+		d.opts[volume] = formatted
+		d.mu.Unlock()
+	}
+
+	if out, err := runWithTimeout(mountTimeout, "mount", "-t", fstype, dev, mnt); err != nil {
+		return "", errorf(ErrMountFailed, "Mounting device %v to %v failed: %v\n%v",
+			dev, mnt, err, string(out))
+	}
+	d.mounts.add(volume, dev, mnt, id, mnt+folder)
+	return mnt + folder, nil
+}
+
+func (d *instanceStoreVolumeDriver) Path(path string) (string, error) {
+	volume, folder := parsePath(path)
+	mnt := mountPath(volume) + folder
+	if stat, err := os.Stat(mnt); err != nil || !stat.IsDir() {
+		return "", errors.New("Volume not mounted.")
+	}
+	return mnt, nil
+}
+
+func (d *instanceStoreVolumeDriver) Remove(path string) error {
+	return d.Unmount(path, "")
+}
+
+func (d *instanceStoreVolumeDriver) Unmount(path string, id string) error {
+	volume, folder := parsePath(path)
+	mnt := mountPath(volume)
+	if d.mounts.release(volume, id, mnt+folder) > 0 {
+		// Other containers are still using the volume.
+		return nil
+	}
+
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err == nil {
+		if out, err := runWithTimeout(mountTimeout, "umount", mnt); err != nil {
+			if errorCode(err) == ErrCommandTimeout {
+				return err
+			}
+			return errorf(ErrUnmountFailed, "Unmounting %v failed: %v\n%v",
+				mnt, err, string(out))
+		}
+	}
+	d.mounts.remove(volume)
+	return os.Remove(mnt)
+}
+
+func (d *instanceStoreVolumeDriver) Mounts() []MountInfo {
+	return d.mounts.list()
+}
+
+func (d *instanceStoreVolumeDriver) RestoreMounts(mounts []MountInfo) {
+	d.mounts.restore(mounts)
+}
+
+func (d *instanceStoreVolumeDriver) Capabilities() Capabilities {
+	// The disks can only ever be reached from this host.
+	return Capabilities{Scope: "local"}
+}
+
+func (d *instanceStoreVolumeDriver) Info() map[string]string {
+	return map[string]string{
+		"Driver":    "instance-store",
+		"Ephemeral": "true",
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMkfsArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"-m 0 -O ^has_journal", []string{"-m", "0", "-O", "^has_journal"}},
+		{"-i size=1024", []string{"-i", "size=1024"}},
+		{`-L "scratch space"`, []string{"-L", "scratch space"}},
+		// -T is the ext4 usage type, not the filesystem type.
+		{"-T largefile", []string{"-T", "largefile"}},
+	}
+	for _, test := range tests {
+		got, err := mkfsArgs(test.in)
+		if err != nil {
+			t.Errorf("mkfsArgs(%q) failed: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("mkfsArgs(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestMkfsArgsInvalid(t *testing.T) {
+	for _, in := range []string{
+		"-t xfs",
+		"-text4",
+		"--type xfs",
+		"--type=xfs",
+		"/dev/nvme2n1",
+		"dev/nvme2n1",
+		"-m 0 /dev/nvme2n1",
+		`"/dev/nvme2n1"`,
+		`-L "unterminated`,
+	} {
+		if got, err := mkfsArgs(in); err == nil {
+			t.Errorf("mkfsArgs(%q) = %q, want an error", in, got)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An Inventory describes everything a host knows of its volumes, for
+// inventory systems that should not need credentials of their own.
+type Inventory struct {
+	Generated time.Time
+	Host      map[string]string `json:",omitempty"`
+	Mounts    []MountInfo
+	Volumes   []InventoryVolume `json:",omitempty"`
+}
+
+// Describes one of the driver's volumes, as its storage provider sees it.
+type InventoryVolume struct {
+	VolumeId   string
+	Name       string `json:",omitempty"`
+	Type       string
+	SizeGiB    int64
+	State      string
+	Device     string `json:",omitempty"`
+	Encrypted  bool
+	CreateTime time.Time
+	Tags       map[string]string   `json:",omitempty"`
+	Snapshots  []InventorySnapshot `json:",omitempty"`
+}
+
+// Describes a snapshot of a volume.
+type InventorySnapshot struct {
+	SnapshotId  string
+	StartTime   time.Time
+	State       string
+	Description string            `json:",omitempty"`
+	Tags        map[string]string `json:",omitempty"`
+}
+
+// inventory describes a driver's volumes in as much detail as it can.
+func inventory(d VolumeDriver) (Inventory, error) {
+	inv := Inventory{Generated: time.Now().UTC()}
+	if i, ok := d.(InfoDriver); ok {
+		inv.Host = i.Info()
+	}
+	if ml, ok := d.(MountLister); ok {
+		inv.Mounts = ml.Mounts()
+	}
+	if inv.Mounts == nil {
+		inv.Mounts = []MountInfo{}
+	}
+	if inventorier, ok := d.(Inventorier); ok {
+		volumes, err := inventorier.InventoryVolumes()
+		if err != nil {
+			return inv, err
+		}
+		inv.Volumes = volumes
+	}
+	return inv, nil
+}
+
+// exportInventory periodically sends a driver's inventory, as JSON, to dest:
+// either an http(s):// URL to POST it to, or a file to replace.
+func exportInventory(d VolumeDriver, dest string, interval time.Duration) {
+	log("Exporting volume inventory to %v every %v.\n", dest, interval)
+	export := func() {
+		inv, err := inventory(d)
+		if err == nil {
+			err = sendInventory(dest, inv)
+		}
+		if err != nil {
+			logError("Exporting volume inventory to %v failed: %v\n", dest, err)
+		}
+	}
+	export()
+	go func() {
+		for range time.Tick(interval) {
+			export()
+		}
+	}()
+}
+
+func sendInventory(dest string, inv Inventory) error {
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(dest, "http://") && !strings.HasPrefix(dest, "https://") {
+		return writeFileAtomic(dest, data)
+	}
+	resp, err := http.Post(dest, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v responded %v", dest, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a listener being handed over waits for connections it has already
+// accepted to send their requests.
+const handoverGrace = 5 * time.Second
+
+// A listener is one address on which blocker serves its routes, along with
+// the middleware that should wrap the shared router for requests arriving on
+// it.  Docker talks to us over a unix socket; TCP listeners are meant for
+// local administration and monitoring.
+type listener struct {
+	net.Listener
+	addr       string
+	middleware []func(http.Handler) http.Handler
+	server     *http.Server
+
+	mu sync.Mutex
+	// Connections accepted that have yet to send a request, and whether the
+	// listener has been closed to hand it over.
+	fresh      map[net.Conn]bool
+	handedOver bool
+}
+
+// listenFlag collects repeated -listen flags.
+type listenFlag []string
+
+func (f *listenFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listenFlag) Set(addr string) error {
+	*f = append(*f, addr)
+	return nil
+}
+
+// listen opens a listener for an address of the form unix:///path/to.sock or
+// tcp://host:port.  A bare absolute path is taken to be a unix socket.
+func listen(addr string) (*listener, error) {
+	network, address := "unix", addr
+	if sep := strings.Index(addr, "://"); sep >= 0 {
+		network, address = addr[:sep], addr[sep+3:]
+	} else if !strings.HasPrefix(addr, "/") {
+		return nil, fmt.Errorf("Unrecognized listen address %v.", addr)
+	}
+
+	l := &listener{addr: addr, fresh: make(map[net.Conn]bool)}
+	l.server = &http.Server{ConnState: l.trackConn}
+	switch network {
+	case "unix":
+	case "tcp":
+		// Plugin requests can mount arbitrary volumes onto this host, so
+		// never accept them from anywhere but the host itself.  TCP listeners
+		// double as debug listeners, exposing runtime statistics.
+		l.middleware = append(l.middleware, loopbackOnly, debugVars)
+	default:
+		return nil, fmt.Errorf("Unsupported network %v in listen address %v.",
+			network, addr)
+	}
+
+	if il, ok := inherited[addr]; ok {
+		delete(inherited, addr)
+		if ul, ok := il.(*net.UnixListener); ok {
+			// Clean up the socket on exit as if we had created it.
+			ul.SetUnlinkOnClose(true)
+		}
+		l.Listener = il
+		return l, nil
+	}
+	var err error
+	if l.Listener, err = net.Listen(network, address); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// file returns a duplicate of the listener's socket, for handing it over to
+// another process.
+func (l *listener) file() (*os.File, error) {
+	fl, ok := l.Listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("Cannot hand over listener on %v.", l.addr)
+	}
+	return fl.File()
+}
+
+// serve handles requests on the listener until it is closed.
+func (l *listener) serve(handler http.Handler) error {
+	for i := len(l.middleware) - 1; i >= 0; i-- {
+		handler = l.middleware[i](handler)
+	}
+	l.server.Handler = handler
+	err := l.server.Serve(l)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.handedOver {
+		return http.ErrServerClosed
+	}
+	return err
+}
+
+func (l *listener) trackConn(c net.Conn, state http.ConnState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state == http.StateNew {
+		l.fresh[c] = true
+	} else {
+		delete(l.fresh, c)
+	}
+}
+
+// shutdown stops accepting connections and waits for requests in flight to
+// finish.  Unix sockets are left in place for whoever takes them over.
+// Connections already accepted get a while to send their requests first,
+// since http.Server.Shutdown would drop any that arrive after it starts.
+func (l *listener) shutdown() error {
+	if ul, ok := l.Listener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	l.server.SetKeepAlivesEnabled(false)
+	l.mu.Lock()
+	l.handedOver = true
+	l.mu.Unlock()
+	if err := l.Listener.Close(); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(handoverGrace); time.Now().Before(deadline); {
+		l.mu.Lock()
+		n := len(l.fresh)
+		l.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return l.server.Shutdown(context.Background())
+}
+
+// loopbackOnly rejects requests that do not originate from the local host.
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			logError("Rejected request from non-local address %s.\n", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// debugVars serves expvar's runtime statistics and counters at /debug/vars.
+func debugVars(next http.Handler) http.Handler {
+	vars := expvar.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/debug/vars" {
+			vars.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
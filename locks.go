@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyedLocks hands out a mutex per key, e.g. per volume name.
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	users int
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: make(map[string]*keyedLock)}
+}
+
+// lock locks key, returning a function that unlocks it again.
+func (k *keyedLocks) lock(key string) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.users++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		if l.users--; l.users == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// Operations that change a volume, whether through the plugin or the admin
+// API, take its lock, so that e.g. an Unmount can't detach a volume that a
+// concurrent Mount is still attaching.  Path only looks, so it doesn't wait.
+var volumeLocks = newKeyedLocks()
+
+// lockVolume locks the volume an op is on, returning a function that unlocks
+// it again.
+func lockVolume(op string, name string) func() {
+	if op == "/VolumeDriver.Path" {
+		return func() {}
+	}
+	volume, _ := parsePath(name)
+	return volumeLocks.lock(volume)
+}
+
+// lockVolumes locks several volumes an op is on, always in name order so that
+// two ops locking the same volumes can't deadlock, returning a function that
+// unlocks them all again.
+func lockVolumes(op string, names ...string) func() {
+	seen := make(map[string]bool)
+	var volumes []string
+	for _, name := range names {
+		volume, _ := parsePath(name)
+		if !seen[volume] {
+			seen[volume] = true
+			volumes = append(volumes, volume)
+		}
+	}
+	sort.Strings(volumes)
+	var unlocks []func()
+	for _, volume := range volumes {
+		unlocks = append(unlocks, lockVolume(op, volume))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// EC2 tags exported as labels on per-volume metrics, e.g. team and service,
+// so dashboards can be split by owner.
+var metricLabelTags []string
+
+// volumeOpStats accumulates one kind of operation on one volume.
+type volumeOpStats struct {
+	count   int64
+	errors  int64
+	seconds float64
+}
+
+var (
+	volumeStatsMu sync.Mutex
+	// Operation statistics by volume, then operation.
+	volumeStats = map[string]map[string]*volumeOpStats{}
+)
+
+func volumeOpStat(op string, volume string) *volumeOpStats {
+	v, _ := parsePath(volume)
+	ops, ok := volumeStats[v]
+	if !ok {
+		ops = make(map[string]*volumeOpStats)
+		volumeStats[v] = ops
+	}
+	s, ok := ops[op]
+	if !ok {
+		s = &volumeOpStats{}
+		ops[op] = s
+	}
+	return s
+}
+
+func recordVolumeOperation(op string, volume string, elapsed time.Duration) {
+	if volume == "" {
+		return
+	}
+	volumeStatsMu.Lock()
+	defer volumeStatsMu.Unlock()
+	s := volumeOpStat(op, volume)
+	s.count++
+	s.seconds += elapsed.Seconds()
+}
+
+func recordVolumeError(op string, volume string) {
+	if volume == "" {
+		return
+	}
+	volumeStatsMu.Lock()
+	defer volumeStatsMu.Unlock()
+	volumeOpStat(op, volume).errors++
+}
+
+var labelNameRegexp = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// metricLabels renders the labels of a per-volume metric in Prometheus' text
+// format, including those taken from the volume's tags.
+func metricLabels(d VolumeDriver, volume string, extra ...string) string {
+	labels := []string{"volume", volume}
+	if vl, ok := d.(VolumeLabeler); ok {
+		tags := vl.VolumeLabels(volume)
+		for _, key := range metricLabelTags {
+			labels = append(labels, labelNameRegexp.ReplaceAllString(key, "_"), tags[key])
+		}
+	}
+	labels = append(labels, extra...)
+
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// serveMetrics exports per-volume usage and operation statistics in
+// Prometheus' text format.
+func serveMetrics(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		if ml, ok := d.(MountLister); ok {
+			fmt.Fprintf(w, "# TYPE blocker_volume_size_bytes gauge\n")
+			fmt.Fprintf(w, "# TYPE blocker_volume_used_bytes gauge\n")
+			for _, m := range ml.Mounts() {
+				var st syscall.Statfs_t
+				if linkedDevice(m.Mountpoint) != "" ||
+					partitionedDisk(m.Mountpoint) != "" ||
+					syscall.Statfs(m.Mountpoint, &st) != nil {
+					continue
+				}
+				labels := metricLabels(d, m.Volume)
+				size := st.Blocks * uint64(st.Bsize)
+				used := (st.Blocks - st.Bfree) * uint64(st.Bsize)
+				fmt.Fprintf(w, "blocker_volume_size_bytes%s %d\n", labels, size)
+				fmt.Fprintf(w, "blocker_volume_used_bytes%s %d\n", labels, used)
+			}
+		}
+
+		type sample struct {
+			volume string
+			op     string
+			stats  volumeOpStats
+		}
+		var samples []sample
+		volumeStatsMu.Lock()
+		for v, ops := range volumeStats {
+			for op, s := range ops {
+				samples = append(samples, sample{volume: v, op: op, stats: *s})
+			}
+		}
+		volumeStatsMu.Unlock()
+		sort.Slice(samples, func(i, j int) bool {
+			if samples[i].volume != samples[j].volume {
+				return samples[i].volume < samples[j].volume
+			}
+			return samples[i].op < samples[j].op
+		})
+
+		fmt.Fprintf(w, "# TYPE blocker_volume_operations_total counter\n")
+		fmt.Fprintf(w, "# TYPE blocker_volume_operation_errors_total counter\n")
+		fmt.Fprintf(w, "# TYPE blocker_volume_operation_seconds_total counter\n")
+		for _, s := range samples {
+			labels := metricLabels(d, s.volume, "op", s.op)
+			fmt.Fprintf(w, "blocker_volume_operations_total%s %d\n",
+				labels, s.stats.count)
+			fmt.Fprintf(w, "blocker_volume_operation_errors_total%s %d\n",
+				labels, s.stats.errors)
+			fmt.Fprintf(w, "blocker_volume_operation_seconds_total%s %g\n",
+				labels, s.stats.seconds)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// An image with mkfs tools to format volumes in, through the Docker API at
+// dockerSocket, on hosts that have no mkfs tools of their own, such as
+// Bottlerocket.  "" formats volumes on the host only.
+var mkfsImage string
+
+// hostHasMkfs reports whether the host can format a filesystem of type fstype
+// itself.
+func hostHasMkfs(fstype string) bool {
+	for _, tool := range []string{"mkfs", "mkfs." + fstype} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// mkfsInContainer formats dev with a filesystem of type fstype for volume by
+// running mkfs.<fstype> with args, and then dev, in a throwaway container of
+// mkfsImage, which is given access to dev and nothing else, pulling the
+// image first if need be.  Returns mkfs's output.  The container is removed
+// afterwards, and killed if mkfs takes longer than fsCommandTimeout.
+func mkfsInContainer(volume string, dev string, fstype string,
+	args []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fsCommandTimeout)
+	defer cancel()
+	client := dockerClient()
+	// Devices are passed to containers by their real path; EBS devices are
+	// often symlinks.
+	if real, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = real
+	}
+
+	cmd := append([]string{"mkfs." + fstype}, args...)
+	config := map[string]interface{}{
+		"Image":  mkfsImage,
+		"Cmd":    append(cmd, dev),
+		"Tty":    true,
+		"Labels": map[string]string{"blocker.volume": volume},
+		"HostConfig": map[string]interface{}{
+			"NetworkMode": "none",
+			"Devices": []map[string]string{{
+				"PathOnHost":        dev,
+				"PathInContainer":   dev,
+				"CgroupPermissions": "rwm",
+			}},
+		},
+	}
+	var created struct{ Id string }
+	create := func() (int, error) {
+		return dockerCall(ctx, client, "POST", "/containers/create", config, &created)
+	}
+	status, err := create()
+	if status == http.StatusNotFound {
+		log("\tPulling %v to format %v...\n", mkfsImage, dev)
+		if err := pullImage(ctx, client, mkfsImage); err != nil {
+			return nil, err
+		}
+		_, err = create()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Creating a %v container failed: %v", mkfsImage, err)
+	}
+	defer func() {
+		// Use a fresh context, as ctx may have expired.
+		if _, err := dockerCall(context.Background(), client, "DELETE",
+			"/containers/"+created.Id+"?force=1", nil, nil); err != nil {
+			logError("Removing container %v failed: %v\n", created.Id, err)
+		}
+	}()
+
+	log("\tRunning mkfs.%v in container %.12s of %v.\n",
+		fstype, created.Id, mkfsImage)
+	if _, err := dockerCall(ctx, client, "POST",
+		"/containers/"+created.Id+"/start", nil, nil); err != nil {
+		return nil, err
+	}
+	var exit struct{ StatusCode int }
+	if _, err := dockerCall(ctx, client, "POST",
+		"/containers/"+created.Id+"/wait", nil, &exit); err != nil {
+		if ctx.Err() != nil {
+			return nil, errorf(ErrCommandTimeout,
+				"mkfs.%v in container %.12s timed out after %v.",
+				fstype, created.Id, fsCommandTimeout)
+		}
+		return nil, err
+	}
+	out, err := containerLogs(ctx, client, created.Id)
+	if err != nil {
+		logError("Fetching the output of container %v failed: %v\n",
+			created.Id, err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		log("\t%v: %v\n", volume, strings.TrimRight(line, "\r"))
+	}
+	if exit.StatusCode != 0 {
+		return out, fmt.Errorf("mkfs.%v exited with status %d",
+			fstype, exit.StatusCode)
+	}
+	return out, nil
+}
+
+// dockerCall makes a Docker API call, sending body and decoding the response
+// into resp if they aren't nil.  Returns the response's status code, and an
+// error unless it succeeded.
+func dockerCall(ctx context.Context, client *http.Client, method string,
+	path string, body interface{}, resp interface{}) (int, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, "http://docker"+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	r, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(r.Body)
+		return r.StatusCode, fmt.Errorf("%v %v: %v: %s", method, path, r.Status,
+			bytes.TrimSpace(msg))
+	}
+	if resp != nil {
+		return r.StatusCode, json.NewDecoder(r.Body).Decode(resp)
+	}
+	return r.StatusCode, nil
+}
+
+// pullImage pulls an image through the Docker API, waiting for it to finish.
+func pullImage(ctx context.Context, client *http.Client, image string) error {
+	req, err := http.NewRequest("POST",
+		"http://docker/images/create?fromImage="+url.QueryEscape(image), nil)
+	if err != nil {
+		return err
+	}
+	r, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(r.Body)
+		return fmt.Errorf("Pulling %v failed: %v: %s", image, r.Status,
+			bytes.TrimSpace(msg))
+	}
+	// The pull only finishes once its progress stream ends, which reports
+	// errors along the way.
+	dec := json.NewDecoder(r.Body)
+	for {
+		var msg struct{ Error string }
+		if err := dec.Decode(&msg); err != nil {
+			break
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("Pulling %v failed: %v", image, msg.Error)
+		}
+	}
+	return ctx.Err()
+}
+
+// containerLogs returns the output of a container run with a TTY, which the
+// Docker API sends as is.
+func containerLogs(ctx context.Context, client *http.Client,
+	id string) ([]byte, error) {
+	req, err := http.NewRequest("GET",
+		"http://docker/containers/"+id+"/logs?stdout=1&stderr=1", nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	return ioutil.ReadAll(r.Body)
+}
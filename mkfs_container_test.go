@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDocker serves the parts of the Docker API mkfsInContainer uses, with
+// the image missing until it is pulled.
+type fakeDocker struct {
+	mu       sync.Mutex
+	pulled   bool
+	config   map[string]interface{}
+	calls    []string
+	exitCode int
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+	switch {
+	case r.URL.Path == "/images/create":
+		f.pulled = true
+		fmt.Fprintln(w, `{"status": "Pulling"}`)
+	case r.URL.Path == "/containers/create":
+		if !f.pulled {
+			http.Error(w, `{"message": "No such image"}`, http.StatusNotFound)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&f.config)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, `{"Id": "0123456789abcdef"}`)
+	case strings.HasSuffix(r.URL.Path, "/start"):
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(r.URL.Path, "/wait"):
+		fmt.Fprintf(w, `{"StatusCode": %d}`, f.exitCode)
+	case strings.HasSuffix(r.URL.Path, "/logs"):
+		fmt.Fprint(w, "Creating filesystem\r\nDone\r\n")
+	case r.Method == "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func withFakeDocker(t *testing.T, f *fakeDocker) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, f)
+	savedSocket, savedImage := dockerSocket, mkfsImage
+	t.Cleanup(func() {
+		l.Close()
+		dockerSocket, mkfsImage = savedSocket, savedImage
+	})
+	dockerSocket, mkfsImage = socket, "example/mkfs:1"
+}
+
+func TestMkfsInContainer(t *testing.T) {
+	f := &fakeDocker{}
+	withFakeDocker(t, f)
+
+	out, err := mkfsInContainer("scratch", "/dev/nonexistent", "xfs", []string{"-f"})
+	if err != nil {
+		t.Fatalf("mkfsInContainer failed: %v", err)
+	}
+	if !strings.Contains(string(out), "Done") {
+		t.Errorf("mkfsInContainer output %q, want mkfs's", out)
+	}
+	if cmd := f.config["Cmd"]; !reflect.DeepEqual(cmd,
+		[]interface{}{"mkfs.xfs", "-f", "/dev/nonexistent"}) {
+		t.Errorf("Container ran %v, want mkfs.xfs -f /dev/nonexistent", cmd)
+	}
+	host := f.config["HostConfig"].(map[string]interface{})
+	devices := host["Devices"].([]interface{})
+	if len(devices) != 1 ||
+		devices[0].(map[string]interface{})["PathOnHost"] != "/dev/nonexistent" {
+		t.Errorf("Container was given devices %v, want only /dev/nonexistent",
+			devices)
+	}
+	want := []string{
+		"POST /containers/create",
+		"POST /images/create",
+		"POST /containers/create",
+		"POST /containers/0123456789abcdef/start",
+		"POST /containers/0123456789abcdef/wait",
+		"GET /containers/0123456789abcdef/logs",
+		"DELETE /containers/0123456789abcdef",
+	}
+	if !reflect.DeepEqual(f.calls, want) {
+		t.Errorf("Docker API calls:\n%v\nwant:\n%v",
+			strings.Join(f.calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestMkfsInContainerFails(t *testing.T) {
+	f := &fakeDocker{pulled: true, exitCode: 1}
+	withFakeDocker(t, f)
+
+	if _, err := mkfsInContainer("scratch", "/dev/nonexistent", "ext4",
+		nil); err == nil {
+		t.Error("mkfsInContainer succeeded although mkfs failed.")
+	}
+	if last := f.calls[len(f.calls)-1]; !strings.HasPrefix(last, "DELETE") {
+		t.Errorf("Container was not removed; last call was %v", last)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The directory beneath which volumes are mounted.  Hosts with a read-only
+// root filesystem can point this somewhere writable, or have blocker mount a
+// tmpfs over it.
+var mountRoot = "/mnt/blocker"
+
+// The permissions and, if set, the uid:gid the mount root should have, e.g.
+// for monitoring agents that read volumes' mountpoints.
+var (
+	mountRootMode  os.FileMode = 0700
+	mountRootOwner string
+)
+
+// mountPath returns where a volume is mounted.
+func mountPath(volume string) string {
+	return mountRoot + "/" + volume
+}
+
+// Volumes whose filesystems are managed by something other than blocker are
+// only attached, not mounted; their mountpoints instead hold a symlink of
+// this name to the device.
+const deviceLinkName = "device"
+
+// linkDevice points an attach-only volume's device symlink at dev.
+func linkDevice(mnt string, dev string) error {
+	link := filepath.Join(mnt, deviceLinkName)
+	os.Remove(link)
+	return os.Symlink(dev, link)
+}
+
+// unlinkDevice removes an attach-only volume's device symlink.
+func unlinkDevice(mnt string) error {
+	return os.Remove(filepath.Join(mnt, deviceLinkName))
+}
+
+// linkedDevice returns the device an attach-only volume's mountpoint links to,
+// or "" if the volume is not attached that way.
+func linkedDevice(mnt string) string {
+	dev, err := os.Readlink(filepath.Join(mnt, deviceLinkName))
+	if err != nil || mountedDevice(mnt) != "" {
+		return ""
+	}
+	return dev
+}
+
+// volumeDevice returns the device of the volume at a mountpoint: the one
+// mounted on it, the disk whose partitions are mounted beneath it, or the one
+// an attach-only volume links to; or "" if there is none.
+func volumeDevice(mnt string) string {
+	if dev := mountedDevice(mnt); dev != "" {
+		return dev
+	}
+	if dev := partitionedDisk(mnt); dev != "" {
+		return dev
+	}
+	return linkedDevice(mnt)
+}
+
+// prepareMountRoot makes sure volumes can be mounted beneath a mount root,
+// the global one or a tenant's, first mounting a tmpfs on it if asked to, so
+// that misconfigured hosts fail at startup rather than on their first mount.
+func prepareMountRoot(root string, tmpfs bool) error {
+	if err := os.MkdirAll(root, os.ModeDir|mountRootMode); err != nil {
+		return err
+	}
+	if tmpfs && exec.Command("mountpoint", "-q", root).Run() != nil {
+		if out, err := exec.Command("mount", "-t", "tmpfs", "-o", "mode=0700",
+			"blocker", root).CombinedOutput(); err != nil {
+			return fmt.Errorf("Mounting a tmpfs on %v failed: %v\n%v",
+				root, err, string(out))
+		}
+		log("Mounted a tmpfs on %v.\n", root)
+	}
+
+	if err := fixMountRootPermissions(root); err != nil {
+		return err
+	}
+
+	// Mountpoints are created on demand, so the root must be writable, and
+	// it must be possible to mount filesystems beneath it; try it out.
+	dir, err := ioutil.TempDir(root, ".probe-")
+	if err != nil {
+		return fmt.Errorf("Mount root %v is not writable: %v", root, err)
+	}
+	defer os.Remove(dir)
+	if out, err := runWithTimeout(mountTimeout, "mount", "-t", "tmpfs",
+		"-o", "size=4k", "blocker-probe", dir); err != nil {
+		return fmt.Errorf("Cannot mount filesystems beneath %v: %v\n%v",
+			root, err, string(out))
+	}
+	if out, err := runWithTimeout(mountTimeout, "umount", dir); err != nil {
+		return fmt.Errorf("Unmounting probe %v failed: %v\n%v",
+			dir, err, string(out))
+	}
+	return nil
+}
+
+// fixMountRootPermissions gives a mount root the configured mode and owner,
+// should it have been created, or since changed, otherwise.
+func fixMountRootPermissions(root string) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Mount root %v is not a directory.", root)
+	}
+	if info.Mode().Perm() != mountRootMode {
+		log("Changing mode of %v from %v to %v.\n",
+			root, info.Mode().Perm(), mountRootMode)
+		if err := os.Chmod(root, mountRootMode); err != nil {
+			return err
+		}
+	}
+	if mountRootOwner == "" {
+		return nil
+	}
+	uid, gid, err := parseOwner(mountRootOwner)
+	if err != nil {
+		return err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok &&
+		(int(st.Uid) != uid || int(st.Gid) != gid) {
+		log("Changing owner of %v from %v:%v to %v:%v.\n",
+			root, st.Uid, st.Gid, uid, gid)
+		return os.Chown(root, uid, gid)
+	}
+	return nil
+}
+
+// parseOwner parses a numeric uid:gid.
+func parseOwner(s string) (int, int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 2 {
+		uid, err1 := strconv.ParseUint(parts[0], 10, 32)
+		gid, err2 := strconv.ParseUint(parts[1], 10, 32)
+		if err1 == nil && err2 == nil {
+			return int(uid), int(gid), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("Invalid owner %q: expected <uid>:<gid>.", s)
+}
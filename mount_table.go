@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MountInfo describes a volume a driver has mounted on this host.
+type MountInfo struct {
+	Volume     string
+	Device     string
+	Mountpoint string
+	AttachedAt time.Time
+	// When the volume was last seen mounted (or linked) where it should be.
+	VerifiedAt time.Time
+	// The Docker mount IDs using the volume, each mapped to the path that was
+	// handed out for it.  Docker versions that send no mount IDs are tracked
+	// by path instead.
+	Consumers map[string]string
+	Refcount  int
+	// The containers using the volume, if looked up through the Docker API.
+	Containers []ContainerInfo `json:",omitempty"`
+}
+
+// How long a check that a volume is still mounted is trusted.  dockerd asks
+// for the paths of volumes far more often than they change.
+var mountStateTTL = 10 * time.Second
+
+// mountTable tracks the volumes a driver has mounted and who is using them.
+type mountTable struct {
+	mu     sync.Mutex
+	mounts map[string]*MountInfo
+	// The file the table is saved to.
+	path string
+}
+
+// Where Blocker keeps the state it needs across restarts.  It is kept apart
+// from the mount root, which holds nothing but volumes' mountpoints.
+var stateDir = "/var/lib/blocker"
+
+// The file the mount table is saved to, so that who is using each volume
+// survives Blocker restarting, or "" for mounts.json in the state directory.
+var mountStateFile string
+
+func mountStatePath() string {
+	if mountStateFile != "" {
+		return mountStateFile
+	}
+	return filepath.Join(stateDir, "mounts.json")
+}
+
+// newMountTable creates a mount table, starting out with the mounts saved by
+// the previous blocker process that are still in place.
+func newMountTable() *mountTable {
+	return newMountTableAt(mountStatePath())
+}
+
+// newMountTableAt creates a mount table saved to path rather than the mount
+// state file, e.g. for a tenant's driver.
+func newMountTableAt(path string) *mountTable {
+	t := &mountTable{mounts: make(map[string]*MountInfo), path: path}
+	t.load()
+	return t
+}
+
+// load restores the mounts saved in the mount state file, skipping those no
+// longer mounted where they were, e.g. after the host rebooted.
+func (t *mountTable) load() {
+	data, err := ioutil.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var saved []MountInfo
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		logError("Loading the mount table from %v failed: %v\n", t.path, err)
+		return
+	}
+	var mounts []MountInfo
+	for _, m := range saved {
+		if sameDevice(volumeDevice(m.Mountpoint), m.Device) {
+			mounts = append(mounts, m)
+		}
+	}
+	t.restore(mounts)
+	log("Restored %d mounted volumes from %v.\n", len(mounts), t.path)
+}
+
+// save writes the mount table to the mount state file, replacing it at once
+// so that a crash never leaves it half-written.  t.mu must be held.
+func (t *mountTable) save() {
+	path := t.path
+	data, err := json.Marshal(t.snapshot())
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		logError("Saving the mount table to %v failed: %v\n", path, err)
+	}
+}
+
+// consumerKey identifies a user of a volume: by mount ID if there is one,
+// otherwise by the path it was given.
+func consumerKey(id, path string) string {
+	if id == "" {
+		return path
+	}
+	return id
+}
+
+// add records that the mount ID id is using volume at path.  Adding the same
+// ID again, as Docker does when it restarts, only refreshes the record.
+func (t *mountTable) add(volume, device, mnt, id, path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.mounts[volume]
+	if !ok {
+		m = &MountInfo{
+			Volume:     volume,
+			AttachedAt: time.Now(),
+			Consumers:  make(map[string]string),
+		}
+		t.mounts[volume] = m
+	}
+	m.Device, m.Mountpoint = device, mnt
+	m.VerifiedAt = time.Now()
+	m.Consumers[consumerKey(id, path)] = path
+	m.Refcount = len(m.Consumers)
+	t.save()
+	if dockerSocket != "" {
+		go t.identify(volume, mnt)
+	}
+}
+
+// existing returns the device of a volume recorded as mounted, provided it is
+// still mounted (or, for attach-only volumes, linked to) where it was, so that
+// repeated mounts of it need not redo any work.  The host is only checked
+// again once the last check is older than mountStateTTL, or was invalidated.
+func (t *mountTable) existing(volume string) (string, bool) {
+	t.mu.Lock()
+	m, ok := t.mounts[volume]
+	var device, mnt string
+	var verified time.Time
+	if ok {
+		device, mnt, verified = m.Device, m.Mountpoint, m.VerifiedAt
+	}
+	t.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	if time.Since(verified) < mountStateTTL {
+		return device, true
+	}
+	if !sameDevice(volumeDevice(mnt), device) {
+		return "", false
+	}
+	t.mu.Lock()
+	if m, ok := t.mounts[volume]; ok && m.Device == device {
+		m.VerifiedAt = time.Now()
+	}
+	t.mu.Unlock()
+	return device, true
+}
+
+// invalidate makes the next lookup of a volume check the host again, e.g.
+// after an operation on it failed partway.
+func (t *mountTable) invalidate(volume string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if m, ok := t.mounts[volume]; ok {
+		m.VerifiedAt = time.Time{}
+	}
+}
+
+// identify looks up which containers are using a volume.  Docker mounts
+// volumes before starting containers, so keep trying for a little while.
+func (t *mountTable) identify(volume, mnt string) {
+	for _, delay := range []time.Duration{2, 10, 30} {
+		time.Sleep(delay * time.Second)
+		containers, err := containersUsing(mnt)
+		if err != nil {
+			logError("Looking up containers using %v failed: %v\n", volume, err)
+			continue
+		}
+		t.mu.Lock()
+		m, ok := t.mounts[volume]
+		done := !ok || len(containers) >= m.Refcount
+		if ok {
+			m.Containers = containers
+		}
+		t.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// release records that the mount ID id is no longer using volume at path,
+// returning how many users remain.  The volume may only be torn down once
+// none do.
+func (t *mountTable) release(volume, id, path string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.mounts[volume]
+	if !ok {
+		return 0
+	}
+	delete(m.Consumers, consumerKey(id, path))
+	m.Refcount = len(m.Consumers)
+	t.save()
+	if dockerSocket != "" && m.Refcount > 0 {
+		go t.identify(volume, m.Mountpoint)
+	}
+	return m.Refcount
+}
+
+// remove forgets about a volume once it has been unmounted.
+func (t *mountTable) remove(volume string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.mounts, volume)
+	t.save()
+}
+
+// restore records mounts handed over by another blocker process, replacing
+// whatever is recorded for those volumes.  They are checked again on the
+// host the next time they are looked up.
+func (t *mountTable) restore(mounts []MountInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range mounts {
+		m := mounts[i]
+		if m.Consumers == nil {
+			m.Consumers = make(map[string]string)
+		}
+		m.Refcount = len(m.Consumers)
+		m.VerifiedAt = time.Time{}
+		t.mounts[m.Volume] = &m
+	}
+	t.save()
+}
+
+// list returns a snapshot of all mounts, ordered by volume name.
+func (t *mountTable) list() []MountInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.snapshot()
+}
+
+// snapshot copies all mounts, ordered by volume name.  t.mu must be held.
+func (t *mountTable) snapshot() []MountInfo {
+	mounts := make([]MountInfo, 0, len(t.mounts))
+	for _, m := range t.mounts {
+		c := *m
+		c.Consumers = make(map[string]string, len(m.Consumers))
+		for id, path := range m.Consumers {
+			c.Consumers[id] = path
+		}
+		c.Containers = append([]ContainerInfo(nil), m.Containers...)
+		mounts = append(mounts, c)
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Volume < mounts[j].Volume
+	})
+	return mounts
+}
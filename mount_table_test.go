@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// withMountStateFile points the mount state file somewhere temporary for the
+// length of a test.
+func withMountStateFile(t *testing.T) string {
+	saved := mountStateFile
+	t.Cleanup(func() { mountStateFile = saved })
+	mountStateFile = filepath.Join(t.TempDir(), "mounts.json")
+	return mountStateFile
+}
+
+func TestMountTableRefcounts(t *testing.T) {
+	withMountStateFile(t)
+	mt := newMountTable()
+
+	type step struct {
+		op       string // add or release
+		volume   string
+		id, path string
+		want     int
+	}
+	steps := []step{
+		{"add", "data", "m1", "/mnt/blocker/data", 1},
+		{"add", "data", "m2", "/mnt/blocker/data/sub", 2},
+		// Adding the same mount ID again, as Docker does when it restarts,
+		// only refreshes it.
+		{"add", "data", "m1", "/mnt/blocker/data", 2},
+		// Releasing an unknown consumer leaves the others alone.
+		{"release", "data", "m3", "/mnt/blocker/data", 2},
+		{"release", "data", "m1", "/mnt/blocker/data", 1},
+		// Releasing the same consumer twice only counts once.
+		{"release", "data", "m1", "/mnt/blocker/data", 1},
+		{"release", "data", "m2", "/mnt/blocker/data/sub", 0},
+		// Docker versions that send no mount IDs are tracked by path.
+		{"add", "logs", "", "/mnt/blocker/logs", 1},
+		{"add", "logs", "", "/mnt/blocker/logs/a", 2},
+		{"add", "logs", "", "/mnt/blocker/logs", 2},
+		{"release", "logs", "", "/mnt/blocker/logs/a", 1},
+		// Unknown volumes have no users.
+		{"release", "unknown", "m1", "/mnt/blocker/unknown", 0},
+	}
+	for i, s := range steps {
+		var got int
+		switch s.op {
+		case "add":
+			mt.add(s.volume, "/dev/xvdf", "/mnt/blocker/"+s.volume, s.id, s.path)
+			for _, m := range mt.list() {
+				if m.Volume == s.volume {
+					got = m.Refcount
+				}
+			}
+		case "release":
+			got = mt.release(s.volume, s.id, s.path)
+		}
+		if got != s.want {
+			t.Errorf("Step %d: %v(%q, %q, %q) leaves %d users, want %d",
+				i, s.op, s.volume, s.id, s.path, got, s.want)
+		}
+	}
+
+	mt.remove("logs")
+	for _, m := range mt.list() {
+		if m.Volume == "logs" {
+			t.Errorf("Removed volume logs is still listed: %+v", m)
+		}
+	}
+}
+
+func TestMountTableSave(t *testing.T) {
+	path := withMountStateFile(t)
+	mt := newMountTable()
+	mt.add("data", "/dev/xvdf", "/mnt/blocker/data", "m1", "/mnt/blocker/data")
+	mt.add("data", "/dev/xvdf", "/mnt/blocker/data", "m2", "/mnt/blocker/data/sub")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Reading the saved mount table failed: %v", err)
+	}
+	var saved []MountInfo
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("Parsing the saved mount table failed: %v\n%s", err, data)
+	}
+	if len(saved) != 1 || saved[0].Volume != "data" || saved[0].Refcount != 2 ||
+		saved[0].Consumers["m2"] != "/mnt/blocker/data/sub" {
+		t.Errorf("Saved mount table is %+v, want data used by m1 and m2", saved)
+	}
+}
+
+func TestMountTableLoad(t *testing.T) {
+	// /proc is mounted wherever the tests run, so it stands in for a volume
+	// that is still mounted.
+	procDevice := mountedDevice("/proc")
+	if procDevice == "" {
+		t.Skip("/proc is not mounted.")
+	}
+
+	tests := []struct {
+		name  string
+		saved string
+		want  map[string]int
+	}{
+		{"missing file", "", map[string]int{}},
+		{"corrupt file", "[{", map[string]int{}},
+		{"empty table", "[]", map[string]int{}},
+		{"mounts", `[
+			{"Volume": "proc", "Device": "` + procDevice + `", "Mountpoint": "/proc",
+			 "Consumers": {"m1": "/proc", "m2": "/proc/sys"}, "Refcount": 5},
+			{"Volume": "gone", "Device": "/dev/xvdf",
+			 "Mountpoint": "/nonexistent/blocker/gone",
+			 "Consumers": {"m1": "/nonexistent/blocker/gone"}, "Refcount": 1}
+		]`, map[string]int{"proc": 2}},
+		{"moved device", `[
+			{"Volume": "proc", "Device": "/dev/xvdg", "Mountpoint": "/proc",
+			 "Consumers": {"m1": "/proc"}, "Refcount": 1}
+		]`, map[string]int{}},
+		{"no consumers", `[
+			{"Volume": "proc", "Device": "` + procDevice + `", "Mountpoint": "/proc"}
+		]`, map[string]int{"proc": 0}},
+	}
+	for _, test := range tests {
+		path := withMountStateFile(t)
+		if test.saved != "" {
+			if err := ioutil.WriteFile(path, []byte(test.saved), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := make(map[string]int)
+		for _, m := range newMountTable().list() {
+			got[m.Volume] = m.Refcount
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%v: loaded %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for volume, n := range test.want {
+			if refcount, ok := got[volume]; !ok || refcount != n {
+				t.Errorf("%v: loaded %v, want %v", test.name, got, test.want)
+			}
+		}
+	}
+}
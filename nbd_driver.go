@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// nbdVolumeDriver serves the exports of a network block device server (such
+// as qemu-nbd or nbdkit) as volumes, connecting each to a local /dev/nbd*
+// device and mounting the filesystem on it.  Volumes are named after their
+// exports, which must already contain a filesystem.
+type nbdVolumeDriver struct {
+	host   string
+	port   string
+	mu     sync.Mutex // Serializes picking and connecting nbd devices.
+	mounts *mountTable
+}
+
+func NewNbdVolumeDriver(server string) (VolumeDriver, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("NBD server %q must be of the form host:port.",
+			server)
+	}
+	if _, err := os.Stat(filepath.Join(sysBlock, "nbd0")); err != nil {
+		return nil, errors.New(
+			"No /dev/nbd* devices found; load the nbd kernel module first.")
+	}
+
+	log("Serving volumes from NBD server %v\n", server)
+	return &nbdVolumeDriver{host: host, port: port, mounts: newMountTable()}, nil
+}
+
+// freeNbdDevice returns the first nbd device not connected to a server.
+func freeNbdDevice() (string, error) {
+	devs, err := filepath.Glob(filepath.Join(sysBlock, "nbd*"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(devs)
+	for _, dev := range devs {
+		// The kernel exposes the pid of the client holding a device open.
+		if _, err := os.Stat(filepath.Join(dev, "pid")); os.IsNotExist(err) {
+			return "/dev/" + filepath.Base(dev), nil
+		}
+	}
+	return "", errors.New("No free /dev/nbd* devices.")
+}
+
+func (d *nbdVolumeDriver) Create(name string, opts map[string]string) error {
+	return nil
+}
+
+func (d *nbdVolumeDriver) Mount(name string, id string) (string, error) {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+
+	if err := os.MkdirAll(mnt, os.ModeDir|0700); err != nil {
+		return "", err
+	}
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err == nil {
+		d.mounts.add(volume, mountedDevice(mnt), mnt, id, mnt+folder)
+		return mnt + folder, nil
+	}
+
+	d.mu.Lock()
+	dev, err := freeNbdDevice()
+	if err == nil {
+		var out []byte
+		out, err = exec.Command("nbd-client",
+			d.host, d.port, dev, "-N", volume).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("Connecting NBD export %v to %v failed: %v\n%v",
+				volume, dev, err, string(out))
+		}
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if out, err := runWithTimeout(mountTimeout, "mount", dev, mnt); err != nil {
+		exec.Command("nbd-client", "-d", dev).Run()
+		return "", fmt.Errorf("Mounting device %v to %v failed: %v\n%v",
+			dev, mnt, err, string(out))
+	}
+	d.mounts.add(volume, dev, mnt, id, mnt+folder)
+	return mnt + folder, nil
+}
+
+func (d *nbdVolumeDriver) Path(name string) (string, error) {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err != nil {
+		return "", errors.New("Volume not mounted.")
+	}
+	return mnt + folder, nil
+}
+
+func (d *nbdVolumeDriver) Remove(name string) error {
+	return d.Unmount(name, "")
+}
+
+func (d *nbdVolumeDriver) Unmount(name string, id string) error {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+	if d.mounts.release(volume, id, mnt+folder) > 0 {
+		// Other containers are still using the volume.
+		return nil
+	}
+
+	dev := mountedDevice(mnt)
+	if out, err := runWithTimeout(mountTimeout, "umount", mnt); err != nil {
+		return fmt.Errorf("Unmounting %v failed: %v\n%v", mnt, err, string(out))
+	}
+	if dev != "" {
+		if out, err := exec.Command("nbd-client", "-d", dev).CombinedOutput(); err != nil {
+			return fmt.Errorf("Disconnecting %v failed: %v\n%v", dev, err, string(out))
+		}
+	}
+	d.mounts.remove(volume)
+	return os.Remove(mnt)
+}
+
+func (d *nbdVolumeDriver) Mounts() []MountInfo {
+	return d.mounts.list()
+}
+
+func (d *nbdVolumeDriver) RestoreMounts(mounts []MountInfo) {
+	d.mounts.restore(mounts)
+}
+
+func (d *nbdVolumeDriver) Capabilities() Capabilities {
+	return Capabilities{Scope: "global"}
+}
+
+func (d *nbdVolumeDriver) Info() map[string]string {
+	return map[string]string{
+		"Driver": "nbd",
+		"Server": net.JoinHostPort(d.host, d.port),
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// The NFS mount options recommended for EFS, which also suit most other NFSv4
+// servers.
+const DefaultNfsOptions = "nfsvers=4.1,rsize=1048576,wsize=1048576,hard," +
+	"timeo=600,retrans=2,noresvport"
+
+// nfsVolumeDriver serves directories of an NFS export, such as an EFS file
+// system, as volumes.  Each volume is a directory named after it beneath the
+// export, so unlike EBS volumes they can be mounted by many hosts at once.
+type nfsVolumeDriver struct {
+	server  string
+	export  string
+	options string
+	mounts  *mountTable
+}
+
+// NewNfsVolumeDriver creates a driver for the export given as host:/path.
+func NewNfsVolumeDriver(export string, options string) (VolumeDriver, error) {
+	sep := strings.Index(export, ":")
+	if sep <= 0 || !strings.HasPrefix(export[sep+1:], "/") {
+		return nil, fmt.Errorf("NFS export %q must be of the form host:/path.", export)
+	}
+	d := &nfsVolumeDriver{
+		server:  export[:sep],
+		export:  export[sep+1:],
+		options: options,
+		mounts:  newMountTable(),
+	}
+
+	log("Serving volumes from NFS export %v:%v\n", d.server, d.export)
+	return d, nil
+}
+
+func (d *nfsVolumeDriver) source(volume string) string {
+	return d.server + ":" + path.Join(d.export, volume)
+}
+
+func (d *nfsVolumeDriver) mount(source string, mnt string) error {
+	out, err := runWithTimeout(mountTimeout,
+		"mount", "-t", "nfs4", "-o", d.options, source, mnt)
+	if err != nil {
+		return fmt.Errorf("Mounting %v to %v failed: %v\n%v",
+			source, mnt, err, string(out))
+	}
+	return nil
+}
+
+func (d *nfsVolumeDriver) Create(name string, opts map[string]string) error {
+	volume, _ := parsePath(name)
+	if volume == "" || strings.HasPrefix(volume, ".") {
+		return fmt.Errorf("Invalid NFS volume name %q.", volume)
+	}
+
+	// Make the volume's directory by briefly mounting the export's root.
+	root, err := ioutil.TempDir(mountRoot, ".nfs-root-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(root)
+	if err := d.mount(d.server+":"+d.export, root); err != nil {
+		return err
+	}
+	defer exec.Command("umount", root).Run()
+
+	if err := os.Mkdir(path.Join(root, volume), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *nfsVolumeDriver) Mount(name string, id string) (string, error) {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+
+	if err := os.MkdirAll(mnt, os.ModeDir|0700); err != nil {
+		return "", err
+	}
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err != nil {
+		if err := d.mount(d.source(volume), mnt); err != nil {
+			return "", err
+		}
+	}
+	d.mounts.add(volume, d.source(volume), mnt, id, mnt+folder)
+	return mnt + folder, nil
+}
+
+func (d *nfsVolumeDriver) Path(name string) (string, error) {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err != nil {
+		return "", errors.New("Volume not mounted.")
+	}
+	return mnt + folder, nil
+}
+
+// Remove leaves the volume's directory and data on the server in place.
+func (d *nfsVolumeDriver) Remove(name string) error {
+	return d.Unmount(name, "")
+}
+
+func (d *nfsVolumeDriver) Unmount(name string, id string) error {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+	if d.mounts.release(volume, id, mnt+folder) > 0 {
+		// Other containers are still using the volume.
+		return nil
+	}
+	if out, err := runWithTimeout(mountTimeout, "umount", mnt); err != nil {
+		return fmt.Errorf("Unmounting %v failed: %v\n%v", mnt, err, string(out))
+	}
+	d.mounts.remove(volume)
+	return os.Remove(mnt)
+}
+
+func (d *nfsVolumeDriver) Mounts() []MountInfo {
+	return d.mounts.list()
+}
+
+func (d *nfsVolumeDriver) RestoreMounts(mounts []MountInfo) {
+	d.mounts.restore(mounts)
+}
+
+func (d *nfsVolumeDriver) Capabilities() Capabilities {
+	// The same volume can be mounted from any host that reaches the server.
+	return Capabilities{Scope: "global"}
+}
+
+func (d *nfsVolumeDriver) Info() map[string]string {
+	return map[string]string{
+		"Driver": "nfs",
+		"Export": d.server + ":" + d.export,
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// nvmeTcpVolumeDriver serves the NVMe-over-TCP subsystems exported by a
+// central storage node (e.g. through the kernel's nvmet target) as volumes,
+// connecting each with nvme-cli and mounting the filesystem on its namespace.
+// Volumes are named after their subsystems, whose NQNs are a common prefix
+// followed by the volume name, and must already contain a filesystem.  The
+// storage node may be reached over a WireGuard tunnel by giving its address
+// on the tunnel.  It is experimental, meant for lab clusters without EBS.
+type nvmeTcpVolumeDriver struct {
+	host      string
+	port      string
+	nqnPrefix string
+	mounts    *mountTable
+}
+
+// Where the kernel lists NVMe subsystems, each with its NQN and namespaces.
+const sysNvmeSubsystems = "/sys/class/nvme-subsystem"
+
+func NewNvmeTcpVolumeDriver(target string, nqnPrefix string) (VolumeDriver, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		// The default NVMe/TCP port.
+		host, port, err = target, "4420", nil
+	}
+	if host == "" || strings.ContainsAny(host, "[]") {
+		return nil, fmt.Errorf("NVMe target %q must be of the form host[:port].",
+			target)
+	}
+	if nqnPrefix == "" {
+		return nil, errors.New("The NQN prefix of the target's subsystems is required.")
+	}
+	if _, err := os.Stat("/sys/module/nvme_tcp"); err != nil {
+		return nil, errors.New(
+			"NVMe over TCP is unavailable; load the nvme-tcp kernel module first.")
+	}
+
+	log("Serving volumes from NVMe/TCP target %v (%v*)\n", target, nqnPrefix)
+	return &nvmeTcpVolumeDriver{
+		host:      host,
+		port:      port,
+		nqnPrefix: nqnPrefix,
+		mounts:    newMountTable(),
+	}, nil
+}
+
+func (d *nvmeTcpVolumeDriver) nqn(volume string) string {
+	return d.nqnPrefix + volume
+}
+
+// subsystemDevice returns the block device of the first namespace of a
+// connected subsystem, or "" if it isn't connected (yet).
+func subsystemDevice(nqn string) string {
+	subsystems, _ := filepath.Glob(filepath.Join(sysNvmeSubsystems, "*"))
+	for _, dir := range subsystems {
+		if readSysfs(filepath.Join(dir, "subsysnqn")) != nqn {
+			continue
+		}
+		namespaces, _ := filepath.Glob(filepath.Join(dir, "nvme*n*"))
+		sort.Strings(namespaces)
+		for _, ns := range namespaces {
+			return "/dev/" + filepath.Base(ns)
+		}
+	}
+	return ""
+}
+
+// connect connects a volume's subsystem, unless it already is, and waits up
+// to deviceWaitTimeout for its namespace to show up.
+func (d *nvmeTcpVolumeDriver) connect(volume string) (string, error) {
+	nqn := d.nqn(volume)
+	if dev := subsystemDevice(nqn); dev != "" {
+		return dev, nil
+	}
+	if out, err := exec.Command("nvme", "connect", "-t", "tcp",
+		"-a", d.host, "-s", d.port, "-n", nqn).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("Connecting NVMe subsystem %v failed: %v\n%v",
+			nqn, err, string(out))
+	}
+	deadline := time.Now().Add(deviceWaitTimeout)
+	for {
+		if dev := subsystemDevice(nqn); dev != "" {
+			return dev, nil
+		}
+		if time.Now().After(deadline) {
+			d.disconnect(volume)
+			return "", errorf(ErrDeviceMissing,
+				"NVMe subsystem %v has no namespace after connecting.", nqn)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func (d *nvmeTcpVolumeDriver) disconnect(volume string) error {
+	nqn := d.nqn(volume)
+	if out, err := exec.Command("nvme", "disconnect", "-n", nqn).CombinedOutput(); err != nil {
+		return fmt.Errorf("Disconnecting NVMe subsystem %v failed: %v\n%v",
+			nqn, err, string(out))
+	}
+	return nil
+}
+
+func (d *nvmeTcpVolumeDriver) Create(name string, opts map[string]string) error {
+	return nil
+}
+
+func (d *nvmeTcpVolumeDriver) Mount(name string, id string) (string, error) {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+
+	if err := os.MkdirAll(mnt, os.ModeDir|0700); err != nil {
+		return "", err
+	}
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err == nil {
+		d.mounts.add(volume, mountedDevice(mnt), mnt, id, mnt+folder)
+		return mnt + folder, nil
+	}
+
+	dev, err := d.connect(volume)
+	if err != nil {
+		return "", err
+	}
+	if out, err := runWithTimeout(mountTimeout, "mount", dev, mnt); err != nil {
+		d.disconnect(volume)
+		return "", errorf(ErrMountFailed, "Mounting device %v to %v failed: %v\n%v",
+			dev, mnt, err, string(out))
+	}
+	d.mounts.add(volume, dev, mnt, id, mnt+folder)
+	return mnt + folder, nil
+}
+
+func (d *nvmeTcpVolumeDriver) Path(name string) (string, error) {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err != nil {
+		return "", errors.New("Volume not mounted.")
+	}
+	return mnt + folder, nil
+}
+
+func (d *nvmeTcpVolumeDriver) Remove(name string) error {
+	return d.Unmount(name, "")
+}
+
+func (d *nvmeTcpVolumeDriver) Unmount(name string, id string) error {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+	if d.mounts.release(volume, id, mnt+folder) > 0 {
+		// Other containers are still using the volume.
+		return nil
+	}
+
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err == nil {
+		if out, err := runWithTimeout(mountTimeout, "umount", mnt); err != nil {
+			return errorf(ErrUnmountFailed, "Unmounting %v failed: %v\n%v",
+				mnt, err, string(out))
+		}
+	}
+	if subsystemDevice(d.nqn(volume)) != "" {
+		if err := d.disconnect(volume); err != nil {
+			return err
+		}
+	}
+	d.mounts.remove(volume)
+	return os.Remove(mnt)
+}
+
+func (d *nvmeTcpVolumeDriver) Mounts() []MountInfo {
+	return d.mounts.list()
+}
+
+func (d *nvmeTcpVolumeDriver) RestoreMounts(mounts []MountInfo) {
+	d.mounts.restore(mounts)
+}
+
+func (d *nvmeTcpVolumeDriver) Capabilities() Capabilities {
+	return Capabilities{Scope: "global"}
+}
+
+func (d *nvmeTcpVolumeDriver) Info() map[string]string {
+	return map[string]string{
+		"Driver":    "nvme-tcp",
+		"Target":    net.JoinHostPort(d.host, d.port),
+		"NqnPrefix": d.nqnPrefix,
+	}
+}
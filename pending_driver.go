@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How often creating a driver that failed to start is retried.
+var pendingRetryInterval = 30 * time.Second
+
+// pendingVolumeDriver stands in for a driver that could not be created at
+// startup, e.g. because the instance metadata service isn't answering yet, so
+// that Docker can activate the plugin regardless.  It fails every operation
+// with BLOCKER_NOT_READY until retrying in the background creates the driver,
+// and then passes operations on to it.  Like faultyVolumeDriver, it hides the
+// driver's optional interfaces; callers that need them wait for the driver
+// with whenReady.
+type pendingVolumeDriver struct {
+	mu  sync.RWMutex
+	d   VolumeDriver
+	err error
+	// Called with the driver once it has been created.
+	ready []func(VolumeDriver)
+}
+
+func NewPendingVolumeDriver(create func() (VolumeDriver, error),
+	err error) *pendingVolumeDriver {
+	p := &pendingVolumeDriver{err: err}
+	go func() {
+		for range time.Tick(pendingRetryInterval) {
+			d, err := create()
+			p.mu.Lock()
+			p.d, p.err = d, err
+			ready := p.ready
+			if err == nil {
+				p.ready = nil
+			}
+			p.mu.Unlock()
+			if err == nil {
+				log("Driver created; now serving requests.\n")
+				for _, f := range ready {
+					f(d)
+				}
+				return
+			}
+			logError("Creating the driver failed again: %v\n", err)
+		}
+	}()
+	return p
+}
+
+// whenReady calls f with the driver once it has been created, or straight
+// away if it already has been.
+func (p *pendingVolumeDriver) whenReady(f func(VolumeDriver)) {
+	p.mu.Lock()
+	d := p.d
+	if d == nil {
+		p.ready = append(p.ready, f)
+	}
+	p.mu.Unlock()
+	if d != nil {
+		f(d)
+	}
+}
+
+// driver returns the driver, or an error if it hasn't been created yet.
+func (p *pendingVolumeDriver) driver() (VolumeDriver, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.d == nil {
+		return nil, errorf(ErrNotReady, "Blocker is not ready yet: %v", p.err)
+	}
+	return p.d, nil
+}
+
+func (p *pendingVolumeDriver) Create(name string, opts map[string]string) error {
+	d, err := p.driver()
+	if err != nil {
+		return err
+	}
+	return d.Create(name, opts)
+}
+
+func (p *pendingVolumeDriver) Mount(name string, id string) (string, error) {
+	d, err := p.driver()
+	if err != nil {
+		return "", err
+	}
+	return d.Mount(name, id)
+}
+
+func (p *pendingVolumeDriver) Path(name string) (string, error) {
+	d, err := p.driver()
+	if err != nil {
+		return "", err
+	}
+	return d.Path(name)
+}
+
+func (p *pendingVolumeDriver) Remove(name string) error {
+	d, err := p.driver()
+	if err != nil {
+		return err
+	}
+	return d.Remove(name)
+}
+
+func (p *pendingVolumeDriver) Unmount(name string, id string) error {
+	d, err := p.driver()
+	if err != nil {
+		return err
+	}
+	return d.Unmount(name, id)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// exportNodeLabels periodically writes a driver's placement labels to a file
+// as key=value lines, for tooling that turns them into node labels, e.g.
+// Kubernetes' node-feature-discovery (via its features.d directory) or a
+// script running `docker node update --label-add` for Swarm.
+func exportNodeLabels(d PlacementDriver, path string, interval time.Duration) {
+	log("Exporting node labels to %v every %v.\n", path, interval)
+	write := func() {
+		if err := writeNodeLabels(path, d.Placement()); err != nil {
+			logError("Exporting node labels to %v failed: %v\n", path, err)
+		}
+	}
+	write()
+	go func() {
+		for range time.Tick(interval) {
+			write()
+		}
+	}()
+}
+
+// writeNodeLabels replaces the file at path with the given labels, sorted so
+// that it only changes when they do.
+func writeNodeLabels(path string, labels map[string]string) error {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s=%s\n", k, labels[k])
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
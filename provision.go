@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"time"
+)
+
+// How long provisioning a new volume may take by default, from attach through
+// writing its contents to detach, before it is abandoned.
+const defaultProvisionTimeout = time.Hour
+
+// Provisioning statistics exported through expvar.
+var (
+	provisionRuns     = expvar.NewInt("provision_runs")
+	provisionFailures = expvar.NewInt("provision_failures")
+	provisionBytes    = expvar.NewInt("provision_bytes")
+	provisionSeconds  = expvar.NewFloat("provision_seconds")
+)
+
+// provisionTimeout returns how long provisioning a volume created with opts
+// may take, as set by its provision-timeout option.
+func provisionTimeout(opts map[string]string) (time.Duration, error) {
+	t, ok := opts["provision-timeout"]
+	if !ok {
+		return defaultProvisionTimeout, nil
+	}
+	timeout, err := time.ParseDuration(t)
+	if err != nil {
+		return 0, errorf(ErrInvalidOption,
+			"Invalid provision-timeout option %q: %v", t, err)
+	}
+	return timeout, nil
+}
+
+// provision attaches a newly created volume just long enough for fill to
+// write its initial contents to the device, then detaches it again.  The
+// whole pipeline shares a single timeout; when it expires, fill's context is
+// cancelled and the volume is detached before returning.
+func (d *ebsVolumeDriver) provision(id string, timeout time.Duration,
+	fill func(ctx context.Context, dev string) error) (err error) {
+	if timeout <= 0 {
+		timeout = defaultProvisionTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	provisionRuns.Add(1)
+	defer func() {
+		provisionSeconds.Add(time.Since(start).Seconds())
+		if err != nil {
+			provisionFailures.Add(1)
+		}
+	}()
+
+	if err := d.waitUntilAvailable(id); err != nil {
+		return err
+	}
+	dev, err := d.attachVolume(id)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := d.detachVolume(id); err == nil {
+			d.waitUntilAvailable(id)
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return errorf(ErrProvisionTimeout,
+			"Provisioning %v timed out after %v.", id, timeout)
+	}
+
+	if err := fill(ctx, dev); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errorf(ErrProvisionTimeout, "Provisioning %v timed out after %v: %v",
+				id, timeout, err)
+		}
+		return err
+	}
+	log("\tProvisioned %v in %v.\n", id, time.Since(start))
+	return nil
+}
+
+// A progressWriter counts and periodically logs the bytes written through
+// it, failing further writes once its context is done.
+type progressWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	what    string
+	written int64
+	logged  time.Time
+}
+
+func newProgressWriter(ctx context.Context, w io.Writer, what string) *progressWriter {
+	return &progressWriter{ctx: ctx, w: w, what: what, logged: time.Now()}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	provisionBytes.Add(int64(n))
+	if time.Since(p.logged) >= 30*time.Second {
+		log("\t%v: %v MiB written...\n", p.what, p.written>>20)
+		p.logged = time.Now()
+	}
+	return n, err
+}
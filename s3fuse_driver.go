@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// s3FuseVolumeDriver is an experimental driver exposing prefixes of an S3
+// bucket as volumes, mounted through a FUSE helper (goofys or s3fs).  S3 is
+// not a POSIX filesystem, so this is only suitable for distributing read-
+// mostly datasets to containers; volumes are mounted read-only unless the
+// driver is created with writable set.
+type s3FuseVolumeDriver struct {
+	bucket   string
+	helper   string
+	writable bool
+	mounts   *mountTable
+}
+
+func NewS3FuseVolumeDriver(
+	bucket string, helper string, writable bool) (VolumeDriver, error) {
+	if bucket == "" {
+		return nil, errors.New("No S3 bucket given for the s3fuse driver.")
+	}
+	if helper != "goofys" && helper != "s3fs" {
+		return nil, fmt.Errorf("Unsupported FUSE helper %q: use goofys or s3fs.",
+			helper)
+	}
+	if _, err := exec.LookPath(helper); err != nil {
+		return nil, fmt.Errorf("FUSE helper %v not found: %v", helper, err)
+	}
+
+	d := &s3FuseVolumeDriver{
+		bucket:   bucket,
+		helper:   helper,
+		writable: writable,
+		mounts:   newMountTable(),
+	}
+	log("Serving volumes from s3://%v via %v (EXPERIMENTAL)\n", bucket, helper)
+	return d, nil
+}
+
+// Create does nothing: a volume is just a key prefix, which S3 creates
+// implicitly as objects are written beneath it.
+func (d *s3FuseVolumeDriver) Create(name string, opts map[string]string) error {
+	volume, _ := parsePath(name)
+	if volume == "" || strings.HasPrefix(volume, ".") {
+		return fmt.Errorf("Invalid S3 volume name %q.", volume)
+	}
+	return nil
+}
+
+func (d *s3FuseVolumeDriver) Mount(name string, id string) (string, error) {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+
+	if err := os.MkdirAll(mnt, os.ModeDir|0700); err != nil {
+		return "", err
+	}
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err != nil {
+		var args []string
+		switch d.helper {
+		case "goofys":
+			if !d.writable {
+				args = append(args, "-o", "ro")
+			}
+			args = append(args, d.bucket+":"+volume, mnt)
+		case "s3fs":
+			args = append(args, d.bucket+":/"+volume, mnt)
+			if !d.writable {
+				args = append(args, "-o", "ro")
+			}
+		}
+		if out, err := exec.Command(d.helper, args...).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("Mounting s3://%v/%v to %v failed: %v\n%v",
+				d.bucket, volume, mnt, err, string(out))
+		}
+	}
+
+	d.mounts.add(volume, "s3://"+d.bucket+"/"+volume, mnt, id, mnt+folder)
+	return mnt + folder, nil
+}
+
+func (d *s3FuseVolumeDriver) Path(name string) (string, error) {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err != nil {
+		return "", errors.New("Volume not mounted.")
+	}
+	return mnt + folder, nil
+}
+
+// Remove leaves the objects in S3 untouched.
+func (d *s3FuseVolumeDriver) Remove(name string) error {
+	return d.Unmount(name, "")
+}
+
+func (d *s3FuseVolumeDriver) Unmount(name string, id string) error {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+	if d.mounts.release(volume, id, mnt+folder) > 0 {
+		// Other containers are still using the volume.
+		return nil
+	}
+	if out, err := runWithTimeout(mountTimeout, "umount", mnt); err != nil {
+		return fmt.Errorf("Unmounting %v failed: %v\n%v", mnt, err, string(out))
+	}
+	d.mounts.remove(volume)
+	return os.Remove(mnt)
+}
+
+func (d *s3FuseVolumeDriver) Mounts() []MountInfo {
+	return d.mounts.list()
+}
+
+func (d *s3FuseVolumeDriver) Capabilities() Capabilities {
+	return Capabilities{Scope: "global"}
+}
+
+func (d *s3FuseVolumeDriver) Info() map[string]string {
+	return map[string]string{
+		"Driver": "s3fuse",
+		"Bucket": d.bucket,
+		"Helper": d.helper,
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Scrub results exported through expvar, keyed by volume.
+var (
+	scrubRuns   = expvar.NewMap("scrub_runs")
+	scrubErrors = expvar.NewMap("scrub_errors")
+)
+
+// startScrubber periodically verifies every mounted volume in the background,
+// to catch latent corruption while the data can still be restored from
+// elsewhere.  Scrubs run in the idle IO scheduling class so they never compete
+// with applications for bandwidth.
+func startScrubber(d MountLister, interval time.Duration) {
+	log("Scrubbing mounted volumes every %v.\n", interval)
+	go func() {
+		for range time.Tick(interval) {
+			for _, m := range d.Mounts() {
+				scrubRuns.Add(m.Volume, 1)
+				if err := scrub(m); err != nil {
+					scrubErrors.Add(m.Volume, 1)
+					logError("Scrub of %v found problems: %v\n", m.Volume, err)
+				}
+			}
+		}
+	}()
+}
+
+// scrub verifies a mounted volume, using the filesystem's own online checker
+// where there is one, and otherwise reading back the whole device.
+func scrub(m MountInfo) error {
+	var cmd []string
+	if fs, ok := filesystems[filesystemType(m.Device)]; ok {
+		cmd = fs.scrubCommand(m.Mountpoint)
+	}
+	if cmd == nil {
+		cmd = []string{"ionice", "-c", "3",
+			"dd", "if=" + m.Device, "of=/dev/null", "bs=1M", "iflag=direct"}
+	}
+
+	log("\tScrubbing %v (%v)...\n", m.Volume, m.Device)
+	if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v\n%v", cmd[0], err, string(out))
+	}
+	return nil
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/json"
-	"net"
+	"flag"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -14,24 +18,399 @@ import (
 const SocketFile = "/var/run/blocker.sock"
 
 func main() {
+	var listenAddrs listenFlag
+	flag.Var(&listenAddrs, "listen",
+		"address to serve on, as unix:///path or tcp://host:port (repeatable; "+
+			"default unix://"+SocketFile+")")
+	tenantsFile := flag.String("tenants", "",
+		"JSON file of tenants to serve EBS volumes to on sockets of their own, "+
+			"isolated from each other and from the -listen addresses")
+	adminTokens := flag.String("admin-tokens", "",
+		"JSON file of bearer tokens for the admin API (admin API disabled if unset)")
+	driver := flag.String("driver", "ebs",
+		"volume driver to serve: ebs, instance-store, nbd, nfs, nvme-tcp, "+
+			"s3fuse, or zfs")
+	awsInstanceId := flag.String("aws-instance-id", "",
+		"EC2 instance ID, to run without the instance metadata service "+
+			"(requires -aws-region and -aws-zone)")
+	awsRegion := flag.String("aws-region", "",
+		"AWS region, to run without the instance metadata service")
+	awsZone := flag.String("aws-zone", "",
+		"EC2 availability zone, to run without the instance metadata service")
+	flag.DurationVar(&metadataTimeout, "metadata-timeout", metadataTimeout,
+		"give up on instance metadata service calls after this long")
+	flag.IntVar(&metadataRetries, "metadata-retries", metadataRetries,
+		"how many times to retry failed instance metadata service calls")
+	degradedStart := flag.Bool("metadata-degraded-start", false,
+		"if the instance metadata service is unavailable at startup, start "+
+			"anyway, failing requests until it answers")
+	flag.DurationVar(&identityCheckInterval, "identity-check-interval",
+		identityCheckInterval,
+		"how often to check the instance ID and zone against the instance "+
+			"metadata service (0 disables)")
+	flag.StringVar(&identityChangePolicy, "identity-change", IdentityChangeRefresh,
+		"what to do when the instance ID or zone changes: refresh or exit")
+	awsCredsEndpoint := flag.String("aws-credentials-endpoint", "",
+		"URL of a local agent vending AWS credentials, instead of the default chain")
+	awsCredsProcess := flag.String("aws-credentials-process", "",
+		"command printing AWS credentials, as for the AWS CLI's credential_process")
+	nfsExport := flag.String("nfs-export", "",
+		"NFS export (host:/path) whose directories the nfs driver serves")
+	nfsOptions := flag.String("nfs-options", DefaultNfsOptions,
+		"mount options for the nfs driver")
+	s3Bucket := flag.String("s3-bucket", "",
+		"S3 bucket whose prefixes the s3fuse driver serves")
+	s3Helper := flag.String("s3-helper", "goofys",
+		"FUSE helper for the s3fuse driver: goofys or s3fs")
+	s3Writable := flag.Bool("s3-writable", false,
+		"mount s3fuse volumes read-write rather than read-only")
+	nbdServer := flag.String("nbd-server", "",
+		"NBD server (host:port) whose exports the nbd driver serves")
+	nvmeTarget := flag.String("nvme-target", "",
+		"NVMe/TCP target (host[:port]) whose subsystems the nvme-tcp driver serves")
+	nvmeNqnPrefix := flag.String("nvme-nqn-prefix", "",
+		"NQN prefix of the nvme-tcp target's subsystems, followed by volume names")
+	zfsParent := flag.String("zfs-parent", "",
+		"ZFS dataset beneath which the zfs driver creates volumes")
+	flag.StringVar(&instanceStoreFsType, "instance-store-fstype", instanceStoreFsType,
+		"filesystem to format instance-store disks with: ext4, xfs, or btrfs")
+	scrubInterval := flag.Duration("scrub-interval", 0,
+		"how often to scrub mounted volumes in the background (0 disables)")
+	flag.StringVar(&defaultDetachPolicy, "detach-policy", DetachPolicyDetach,
+		"what to do with EBS volumes once unmounted: detach, keep-attached, "+
+			"or detach-after-idle")
+	flag.StringVar(&defaultReclaimPolicy, "reclaim-policy", ReclaimPolicyRetain,
+		"what removing an EBS volume without a reclaim option does to it: "+
+			"retain or delete")
+	flag.StringVar(&defaultStealPolicy, "steal-policy", StealPolicyNever,
+		"whether mounting an EBS volume without a steal option forcibly "+
+			"detaches it from other instances: never, stopped, or always")
+	flag.DurationVar(&detachIdleTimeout, "detach-idle", detachIdleTimeout,
+		"how long detach-after-idle volumes stay attached once unmounted")
+	flag.StringVar(&mountRoot, "mount-root", mountRoot,
+		"directory beneath which volumes are mounted")
+	rootMode := flag.String("mount-root-mode", "0700",
+		"permissions (in octal) to give the mount root")
+	flag.StringVar(&mountRootOwner, "mount-root-owner", "",
+		"numeric uid:gid to give the mount root (unchanged if unset)")
+	mountTmpfs := flag.Bool("mount-tmpfs", false,
+		"mount a tmpfs on the mount root, e.g. on hosts with a read-only /")
+	metricTags := flag.String("metric-label-tags", "",
+		"comma-separated EC2 tags to export as labels on per-volume metrics")
+	flag.StringVar(&nameTag, "name-tag", nameTag,
+		"EC2 tag holding the names of EBS volumes")
+	flag.StringVar(&managedTag, "managed-tag", managedTag,
+		"EC2 tag marking the EBS volumes Blocker created")
+	flag.BoolVar(&managedOnly, "managed-only", false,
+		"only resolve names and IDs to EBS volumes Blocker created (tagged "+
+			"with -managed-tag)")
+	flag.DurationVar(&tagRepairInterval, "tag-repair-interval", 0,
+		"how often to restore the name tags of mounted EBS volumes should "+
+			"they go missing (0 disables)")
+	flag.StringVar(&dockerSocket, "docker-socket", "",
+		"Docker API socket to look up the containers using each volume from, "+
+			"e.g. /var/run/docker.sock")
+	flag.StringVar(&mkfsImage, "mkfs-image", "",
+		"image to format volumes in, through -docker-socket, where the host "+
+			"lacks mkfs tools, e.g. on Bottlerocket")
+	nodeLabelsFile := flag.String("node-labels-file", "",
+		"file to keep updated with scheduling labels for this node, as "+
+			"key=value lines")
+	inventoryDest := flag.String("inventory-export", "",
+		"file to keep updated, or http(s):// URL to POST to, with a JSON "+
+			"inventory of the host's volumes")
+	inventoryInterval := flag.Duration("inventory-interval", 15*time.Minute,
+		"how often to export the -inventory-export inventory")
+	injectLatency := flag.Duration("inject-latency", 0,
+		"for testing: delay each volume operation by up to this long")
+	injectFailures := flag.Float64("inject-failure-rate", 0,
+		"for testing: fail this fraction (0-1) of volume operations")
+	flag.BoolVar(&allowUnknownOptions, "allow-unknown-options", false,
+		"log a warning about unknown EBS volume options rather than failing "+
+			"the create")
+	flag.BoolVar(&forceEncryption, "force-encryption", false,
+		"encrypt every EBS volume Blocker creates, whatever its options")
+	flag.StringVar(&defaultKmsKeyId, "kms-key-id", "",
+		"KMS key to encrypt created EBS volumes with, if not the account's default")
+	flag.StringVar(&deviceRanges, "attach-devices", deviceRanges,
+		"device letters to attach EBS volumes with, as /dev/sd<letters>, "+
+			"e.g. f-z,aa-az")
+	flag.DurationVar(&deviceWaitTimeout, "device-wait", deviceWaitTimeout,
+		"how long to wait for an attached EBS volume's device to appear")
+	flag.BoolVar(&rescanOnAttach, "rescan-on-attach", false,
+		"rescan the PCI bus if an attached EBS volume's device doesn't appear")
+	var watermarks usageWatermarks
+	flag.IntVar(&watermarks.WarnPercent, "usage-warn", 80,
+		"warn about mounted volumes at least this percent full (0 disables)")
+	flag.IntVar(&watermarks.ResizePercent, "usage-resize", 0,
+		"grow EBS volumes at least this percent full (0 disables)")
+	resizeIncrement := flag.String("resize-increment", "+10",
+		"how to grow volumes when they reach -usage-resize, as +<GiB> or "+
+			"+<percent>%, optionally followed by :max=<GiB>")
+	flag.IntVar(&breakerThreshold, "aws-breaker-threshold", breakerThreshold,
+		"fail EC2 calls fast after this many in a row fail for want of AWS "+
+			"(0 disables)")
+	flag.DurationVar(&breakerCooldown, "aws-breaker-cooldown", breakerCooldown,
+		"how often to check whether AWS has recovered while failing fast")
+	flag.DurationVar(&mountTimeout, "mount-timeout", mountTimeout,
+		"kill mount and umount commands that take longer than this")
+	flag.DurationVar(&fsCommandTimeout, "fs-command-timeout", fsCommandTimeout,
+		"kill mkfs and fsck commands that take longer than this")
+	flag.StringVar(&stateDir, "state-dir", stateDir,
+		"directory to keep state that must survive restarts in")
+	flag.StringVar(&mountStateFile, "mount-state-file", "",
+		"file to save the mount table to, so that volumes' users survive "+
+			"restarts (default mounts.json in -state-dir)")
+	flag.DurationVar(&mountStateTTL, "mount-state-ttl", mountStateTTL,
+		"trust that a mounted volume is still mounted for this long before "+
+			"checking the host again")
+	flag.DurationVar(&slowOperationThreshold, "slow-operation", time.Minute,
+		"log operations that take longer than this as slow (0 disables)")
+	flag.Parse()
+	if len(listenAddrs) == 0 {
+		listenAddrs = listenFlag{"unix://" + SocketFile}
+	}
+	policy, err := parseResizePolicy(*resizeIncrement)
+	if err != nil {
+		logError("%s\n", err)
+		return
+	}
+	watermarks.Policy = policy
+	mode, err := strconv.ParseUint(*rootMode, 8, 32)
+	if err != nil || mode > 0777 {
+		logError("Invalid mount root mode %q.\n", *rootMode)
+		return
+	}
+	mountRootMode = os.FileMode(mode)
+	if !instanceStoreFsTypes[instanceStoreFsType] {
+		logError("Unsupported instance-store filesystem %q.\n", instanceStoreFsType)
+		return
+	}
+	if mkfsImage != "" && dockerSocket == "" {
+		logError("-mkfs-image needs -docker-socket to run containers through.\n")
+		return
+	}
+	if deviceLetters, err = parseDeviceRanges(deviceRanges); err != nil {
+		logError("%s\n", err)
+		return
+	}
+	if !detachPolicies[defaultDetachPolicy] {
+		logError("Unknown detach policy %q.\n", defaultDetachPolicy)
+		return
+	}
+	if !identityChangePolicies[identityChangePolicy] {
+		logError("Unknown identity change policy %q.\n", identityChangePolicy)
+		return
+	}
+	if !stealPolicies[defaultStealPolicy] {
+		logError("Unknown steal policy %q.\n", defaultStealPolicy)
+		return
+	}
+	if !reclaimPolicies[defaultReclaimPolicy] {
+		logError("Unknown reclaim policy %q.\n", defaultReclaimPolicy)
+		return
+	}
+
+	if *metricTags != "" {
+		metricLabelTags = strings.Split(*metricTags, ",")
+	}
+	var tenants []*tenant
+	if *tenantsFile != "" {
+		if *driver != "ebs" {
+			logError("Only the ebs driver can serve -tenants.\n")
+			return
+		}
+		if tenants, err = loadTenants(*tenantsFile, listenAddrs); err != nil {
+			logError("Failed to load tenants: %s.\n", err)
+			return
+		}
+	}
+
 	log("blocker: starting up...\n")
 
-	d, err := NewEbsVolumeDriver()
-	if err != nil {
-		logError("Failed to create an EBS driver: %s.\n", err)
+	if missing := missingTools(*driver); len(missing) > 0 {
+		logError("The %v driver needs these tools, which are not installed: %v.\n",
+			*driver, strings.Join(missing, ", "))
 		return
 	}
+	logUnavailableFeatures()
 
-	// Manufacture a socket for communication with Docker.
-	l, err := net.Listen("unix", SocketFile)
-	if err != nil {
-		logError("Failed to listen on socket %s: %s.\n", SocketFile, err)
+	if err := prepareMountRoot(mountRoot, *mountTmpfs); err != nil {
+		logError("Failed to prepare mount root: %s.\n", err)
+		return
+	}
+	for _, t := range tenants {
+		if err := prepareMountRoot(t.MountRoot, *mountTmpfs); err != nil {
+			logError("Failed to prepare tenant %v's mount root: %s.\n", t.Name, err)
+			return
+		}
+	}
+
+	var d VolumeDriver
+	// The EBS driver, should it have to be created in the background.
+	var pending *pendingVolumeDriver
+	switch *driver {
+	case "ebs":
+		creds, err := awsCredentials(*awsCredsEndpoint, *awsCredsProcess)
+		if err != nil {
+			logError("Failed to configure AWS credentials: %s.\n", err)
+			return
+		}
+		create := func() (VolumeDriver, error) {
+			return NewEbsVolumeDriver(*awsInstanceId, *awsRegion, *awsZone, creds)
+		}
+		if d, err = create(); err != nil {
+			if !*degradedStart || errorCode(err) != ErrMetadataUnavailable {
+				logError("Failed to create an EBS driver: %s.\n", err)
+				return
+			}
+			logError("Failed to create an EBS driver: %s.  Failing requests "+
+				"until it can be created.\n", err)
+			pending = NewPendingVolumeDriver(create, err)
+			d = pending
+		}
+	case "instance-store":
+		if d, err = NewInstanceStoreVolumeDriver(); err != nil {
+			logError("Failed to create an instance-store driver: %s.\n", err)
+			return
+		}
+	case "nbd":
+		if d, err = NewNbdVolumeDriver(*nbdServer); err != nil {
+			logError("Failed to create an NBD driver: %s.\n", err)
+			return
+		}
+	case "nfs":
+		if d, err = NewNfsVolumeDriver(*nfsExport, *nfsOptions); err != nil {
+			logError("Failed to create an NFS driver: %s.\n", err)
+			return
+		}
+	case "nvme-tcp":
+		if d, err = NewNvmeTcpVolumeDriver(*nvmeTarget, *nvmeNqnPrefix); err != nil {
+			logError("Failed to create an NVMe/TCP driver: %s.\n", err)
+			return
+		}
+	case "s3fuse":
+		if d, err = NewS3FuseVolumeDriver(
+			*s3Bucket, *s3Helper, *s3Writable); err != nil {
+			logError("Failed to create an S3 FUSE driver: %s.\n", err)
+			return
+		}
+	case "zfs":
+		if d, err = NewZfsVolumeDriver(*zfsParent); err != nil {
+			logError("Failed to create a ZFS driver: %s.\n", err)
+			return
+		}
+	default:
+		logError("Unknown driver %s.\n", *driver)
+		return
+	}
+
+	withFaults := func(d VolumeDriver) VolumeDriver {
+		if *injectLatency > 0 || *injectFailures > 0 {
+			return NewFaultyVolumeDriver(d, *injectLatency, *injectFailures)
+		}
+		return d
+	}
+	ebs := d
+	d = withFaults(d)
+
+	var auth *adminAuth
+	if *adminTokens != "" {
+		if auth, err = loadAdminAuth(*adminTokens); err != nil {
+			logError("Failed to load admin tokens: %s.\n", err)
+			return
+		}
+	}
+
+	startMountJobs := func(d VolumeDriver) {
+		if ml, ok := d.(MountLister); ok && *scrubInterval > 0 {
+			startScrubber(ml, *scrubInterval)
+		}
+		if ml, ok := d.(MountLister); ok &&
+			(watermarks.WarnPercent > 0 || watermarks.ResizePercent > 0) {
+			startUsageMonitor(ml, time.Minute, watermarks)
+		}
+	}
+	startJobs := func(d VolumeDriver) {
+		startMountJobs(d)
+		if p, ok := d.(PlacementDriver); ok && *nodeLabelsFile != "" {
+			exportNodeLabels(p, *nodeLabelsFile, time.Minute)
+		}
+
+		if *inventoryDest != "" {
+			exportInventory(d, *inventoryDest, *inventoryInterval)
+		}
+	}
+	if pending == nil {
+		startJobs(d)
+	}
+
+	// Each tenant gets a driver of its own once the EBS driver exists, and
+	// only the plugin API, as the rest covers the whole host.  Until then,
+	// its sockets fail requests like the pending driver.
+	var tenantsMu sync.Mutex
+	tenantDrivers := make(map[string]VolumeDriver)
+	tenantHandlers := make(map[string]*routeSwitch)
+	for _, t := range tenants {
+		tenantHandlers[t.Name] = &routeSwitch{h: makePluginRoutes(d)}
+	}
+	serveTenants := func(base VolumeDriver) {
+		for _, t := range tenants {
+			td := withFaults(base.(*ebsVolumeDriver).forTenant(t))
+			startMountJobs(td)
+			tenantsMu.Lock()
+			tenantDrivers[t.Name] = td
+			tenantsMu.Unlock()
+			tenantHandlers[t.Name].set(makePluginRoutes(td))
+		}
+	}
+	servedTenants := func() map[string]VolumeDriver {
+		tenantsMu.Lock()
+		defer tenantsMu.Unlock()
+		served := make(map[string]VolumeDriver, len(tenantDrivers))
+		for name, td := range tenantDrivers {
+			served[name] = td
+		}
+		return served
+	}
+	if pending == nil {
+		serveTenants(ebs)
+	}
+
+	// Manufacture the sockets for communication with Docker and friends,
+	// taking over those of the process we are replacing, if any.
+	if err := inheritListeners(); err != nil {
+		logError("%s.\n", err)
+		return
+	}
+	handler := &routeSwitch{h: makeRoutes(d, auth)}
+	var listeners []*listener
+	handlers := make(map[*listener]http.Handler)
+	listenOn := func(addrs []string, h http.Handler) bool {
+		for _, addr := range addrs {
+			l, err := listen(addr)
+			if err != nil {
+				logError("Failed to listen on %s: %s.\n", addr, err)
+				return false
+			}
+			listeners = append(listeners, l)
+			handlers[l] = h
+		}
+		return true
+	}
+	ok := listenOn(listenAddrs, handler)
+	for _, t := range tenants {
+		ok = ok && listenOn(t.Listen, tenantHandlers[t.Name])
+	}
+	for _, l := range listeners {
+		defer l.Close()
+	}
+	if !ok {
 		return
 	}
-	defer l.Close()
 
 	// Make a channel that signals program exit.
-	exit := make(chan bool, 1)
+	exit := make(chan bool, len(listeners)+1)
 
 	// Listen to important OS signals, so we trigger exit cleanly.
 	signals := make(chan os.Signal, 1)
@@ -43,33 +422,115 @@ func main() {
 		exit <- true
 	}()
 
-	// Now listen for HTTP calls from Docker.
-	handler := makeRoutes(d)
+	// Dump our state to the log on demand.
+	dumps := make(chan os.Signal, 1)
+	signal.Notify(dumps, syscall.SIGUSR1)
 	go func() {
-		log("Ready to go; listening on socket %s...\n", SocketFile)
-		err = http.Serve(l, handler)
-		if err != nil {
-			logError("HTTP server error: %s.\n", err)
+		for range dumps {
+			dumpState(d)
+			for name, td := range servedTenants() {
+				log("Tenant %v:\n", name)
+				dumpState(td)
+			}
+		}
+	}()
+
+	// Hand over to a new blocker binary on demand.
+	upgrades := make(chan os.Signal, 1)
+	signal.Notify(upgrades, syscall.SIGUSR2)
+	go func() {
+		for range upgrades {
+			log("Caught SIGUSR2: upgrading.\n")
+			if err := upgrade(d, servedTenants(), listeners); err != nil {
+				logError("Upgrade failed: %s.\n", err)
+				continue
+			}
+			exit <- true
+			return
 		}
-		exit <- true
 	}()
 
+	// Now listen for HTTP calls from Docker.
+	takeOver(d, servedTenants())
+	if pending != nil {
+		// The driver's optional operations can only be routed once it
+		// exists.
+		pending.whenReady(func(ready VolumeDriver) {
+			serveTenants(ready)
+			ready = withFaults(ready)
+			startJobs(ready)
+			handler.set(makeRoutes(ready, auth))
+		})
+	}
+	for _, l := range listeners {
+		go func(l *listener) {
+			log("Ready to go; listening on %s...\n", l.addr)
+			err := l.serve(handlers[l])
+			if err == http.ErrServerClosed {
+				// Handed over to a new process by upgrade.
+				return
+			}
+			if err != nil {
+				logError("HTTP server error on %s: %s.\n", l.addr, err)
+			}
+			exit <- true
+		}(l)
+	}
+	notifySystemd()
+
 	// Block until the program exits.
 	<-exit
 }
 
-func makeRoutes(d VolumeDriver) http.Handler {
+func makeRoutes(d VolumeDriver, auth *adminAuth) http.Handler {
+	r := makePluginRoutes(d)
+	r.HandleFunc("/metrics", serveMetrics(d))
+	if auth != nil {
+		makeAdminRoutes(r, d, auth)
+	}
+	return r
+}
+
+// makePluginRoutes routes the Docker volume plugin API alone.
+func makePluginRoutes(d VolumeDriver) *mux.Router {
 	r := mux.NewRouter()
 	// TODO: permit options in the name string.
 	r.HandleFunc("/Plugin.Activate", servePluginActivate)
-	r.HandleFunc("/VolumeDriver.Create", serveVolumeSimple(d.Create))
-	r.HandleFunc("/VolumeDriver.Mount", serveVolumeComplex(d.Mount))
+	r.HandleFunc("/VolumeDriver.Capabilities", serveCapabilities(d))
+	r.HandleFunc("/VolumeDriver.Create", serveVolumeCreate(d.Create))
+	r.HandleFunc("/VolumeDriver.Mount", serveVolumeComplexWithId(refuseWhileDraining(d, d.Mount)))
 	r.HandleFunc("/VolumeDriver.Path", serveVolumeComplex(d.Path))
 	r.HandleFunc("/VolumeDriver.Remove", serveVolumeSimple(d.Remove))
-	r.HandleFunc("/VolumeDriver.Unmount", serveVolumeSimple(d.Unmount))
+	r.HandleFunc("/VolumeDriver.Unmount", serveVolumeSimpleWithId(d.Unmount))
+	if g, ok := d.(Getter); ok {
+		r.HandleFunc("/VolumeDriver.Get", serveVolumeGet(g))
+	}
+	if l, ok := d.(Lister); ok {
+		r.HandleFunc("/VolumeDriver.List", serveVolumeList(l))
+	}
 	return r
 }
 
+// routeSwitch serves requests with a router that can be replaced while
+// serving, e.g. once a driver created in the background is ready.
+type routeSwitch struct {
+	mu sync.RWMutex
+	h  http.Handler
+}
+
+func (s *routeSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	h := s.h
+	s.mu.RUnlock()
+	h.ServeHTTP(w, r)
+}
+
+func (s *routeSwitch) set(h http.Handler) {
+	s.mu.Lock()
+	s.h = h
+	s.mu.Unlock()
+}
+
 type pluginInfoResponse struct {
 	Implements []string
 }
@@ -80,8 +541,27 @@ func servePluginActivate(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type capabilitiesResponse struct {
+	Capabilities Capabilities
+}
+
+func serveCapabilities(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caps := Capabilities{Scope: "local"}
+		if cd, ok := d.(CapabilitiesDriver); ok {
+			caps = cd.Capabilities()
+		}
+		caps.Features = features(d)
+		json.NewEncoder(w).Encode(capabilitiesResponse{
+			Capabilities: caps,
+		})
+	}
+}
+
 type volumeRequest struct {
 	Name string
+	ID   string
+	Opts map[string]string
 }
 
 type volumeSimpleResponse struct {
@@ -89,17 +569,48 @@ type volumeSimpleResponse struct {
 }
 
 func serveVolumeSimple(f func(string) error) http.HandlerFunc {
+	return serveVolumeSimpleWithId(func(name string, _ string) error {
+		return f(name)
+	})
+}
+
+func serveVolumeSimpleWithId(f func(string, string) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log("* %s\n", r.URL.String())
 		var vol volumeRequest
 		err := json.NewDecoder(r.Body).Decode(&vol)
 		if err == nil {
-			err = f(vol.Name)
+			defer beginOperation(r.URL.Path, vol.Name)()
+			defer lockVolume(r.URL.Path, vol.Name)()
+			err = f(vol.Name, vol.ID)
 			log("\tdone: (%s): %v\n", vol.Name, err)
 		}
 		var errs string
 		if err != nil {
-			errs = err.Error()
+			operationFailed(r.URL.Path, vol.Name)
+			errs = errorString(err)
+		}
+		json.NewEncoder(w).Encode(volumeSimpleResponse{
+			Err: errs,
+		})
+	}
+}
+
+func serveVolumeCreate(f func(string, map[string]string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var vol volumeRequest
+		err := json.NewDecoder(r.Body).Decode(&vol)
+		if err == nil {
+			defer beginOperation(r.URL.Path, vol.Name)()
+			defer lockVolume(r.URL.Path, vol.Name)()
+			err = f(vol.Name, vol.Opts)
+			log("\tdone: (%s, %s): %v\n", vol.Name, formatOpts(vol.Opts), err)
+		}
+		var errs string
+		if err != nil {
+			operationFailed(r.URL.Path, vol.Name)
+			errs = errorString(err)
 		}
 		json.NewEncoder(w).Encode(volumeSimpleResponse{
 			Err: errs,
@@ -107,24 +618,82 @@ func serveVolumeSimple(f func(string) error) http.HandlerFunc {
 	}
 }
 
+type volumeGetResponse struct {
+	Volume *VolumeInfo `json:",omitempty"`
+	Err    string
+}
+
+func serveVolumeGet(d Getter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		var vol volumeRequest
+		err := json.NewDecoder(r.Body).Decode(&vol)
+		var resp volumeGetResponse
+		if err == nil {
+			defer beginOperation(r.URL.Path, vol.Name)()
+			var info VolumeInfo
+			info, err = d.Get(vol.Name)
+			log("\tdone: (%s): (%v, %v)\n", vol.Name, info, err)
+			if err == nil {
+				resp.Volume = &info
+			}
+		}
+		if err != nil {
+			operationFailed(r.URL.Path, vol.Name)
+			resp.Err = errorString(err)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+type volumeListResponse struct {
+	Volumes []VolumeInfo
+	Err     string
+}
+
+func serveVolumeList(d Lister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log("* %s\n", r.URL.String())
+		defer beginOperation(r.URL.Path, "")()
+		volumes, err := d.List()
+		log("\tdone: (%d volumes, %v)\n", len(volumes), err)
+		resp := volumeListResponse{Volumes: volumes}
+		if err != nil {
+			operationFailed(r.URL.Path, "")
+			resp.Err = errorString(err)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
 type volumeComplexResponse struct {
 	Mountpoint string
 	Err        string
 }
 
 func serveVolumeComplex(f func(string) (string, error)) http.HandlerFunc {
+	return serveVolumeComplexWithId(func(name string, _ string) (string, error) {
+		return f(name)
+	})
+}
+
+func serveVolumeComplexWithId(
+	f func(string, string) (string, error)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log("* %s\n", r.URL.String())
 		var vol volumeRequest
 		err := json.NewDecoder(r.Body).Decode(&vol)
 		var mountpoint string
 		if err == nil {
-			mountpoint, err = f(vol.Name)
+			defer beginOperation(r.URL.Path, vol.Name)()
+			defer lockVolume(r.URL.Path, vol.Name)()
+			mountpoint, err = f(vol.Name, vol.ID)
 			log("\tdone: (%s): (%s, %v)\n", vol.Name, mountpoint, err)
 		}
 		var errs string
 		if err != nil {
-			errs = err.Error()
+			operationFailed(r.URL.Path, vol.Name)
+			errs = errorString(err)
 		}
 		json.NewEncoder(w).Encode(volumeComplexResponse{
 			Mountpoint: mountpoint,
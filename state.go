@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An operation is a plugin or admin request currently being served.
+type operation struct {
+	Op      string
+	Volume  string
+	Started time.Time
+	Phases  []phase `json:",omitempty"`
+	// The latest output of a long-running command the operation is waiting on.
+	Progress string `json:",omitempty"`
+}
+
+// A phase is a named step of an operation, lasting until the next one begins.
+type phase struct {
+	Name    string
+	Started time.Time
+}
+
+// Operations taking longer than this are logged as slow, along with how long
+// each of their phases took.  Zero disables the warnings.
+var slowOperationThreshold time.Duration
+
+// Counters exported through expvar on debug listeners.
+var (
+	opsStarted  = expvar.NewMap("operations")
+	opsFailed   = expvar.NewMap("operation_errors")
+	opsInFlight = expvar.NewInt("operations_in_flight")
+	opsSlow     = expvar.NewMap("slow_operations")
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+}
+
+var (
+	operationsMu sync.Mutex
+	operations   = map[int]*operation{}
+	nextOpId     int
+)
+
+// beginOperation records an in-flight operation, returning a function that
+// must be called once it completes.
+func beginOperation(op string, volume string) func() {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	id := nextOpId
+	nextOpId++
+	operations[id] = &operation{Op: op, Volume: volume, Started: time.Now()}
+	opsStarted.Add(op, 1)
+	opsInFlight.Add(1)
+	return func() {
+		operationsMu.Lock()
+		o := operations[id]
+		delete(operations, id)
+		operationsMu.Unlock()
+		opsInFlight.Add(-1)
+
+		elapsed := time.Since(o.Started)
+		recordVolumeOperation(op, volume, elapsed)
+		if slowOperationThreshold > 0 && elapsed > slowOperationThreshold {
+			opsSlow.Add(op, 1)
+			logError("Slow operation: %s %s took %v (%s).\n",
+				op, volume, elapsed.Round(time.Millisecond), o.breakdown())
+		}
+	}
+}
+
+// beginPhase marks the start of a new phase of any in-flight operations on
+// a volume, for the breakdown of slow operations.
+func beginPhase(volume string, name string) {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	now := time.Now()
+	for _, op := range operations {
+		if v, _ := parsePath(op.Volume); v == volume {
+			op.Phases = append(op.Phases, phase{Name: name, Started: now})
+		}
+	}
+}
+
+// operationProgress reports the progress of any in-flight operations on a
+// volume.
+func operationProgress(volume string, progress string) {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	for _, op := range operations {
+		if v, _ := parsePath(op.Volume); v == volume {
+			op.Progress = progress
+		}
+	}
+}
+
+// breakdown describes how long each phase of a finished operation took, with
+// any time before the first phase attributed to "setup".
+func (o *operation) breakdown() string {
+	phases := append([]phase{{Name: "setup", Started: o.Started}}, o.Phases...)
+	now := time.Now()
+	parts := make([]string, len(phases))
+	for i, p := range phases {
+		end := now
+		if i+1 < len(phases) {
+			end = phases[i+1].Started
+		}
+		parts[i] = fmt.Sprintf("%s %v",
+			p.Name, end.Sub(p.Started).Round(time.Millisecond))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// operationFailed counts a failed operation.
+func operationFailed(op string, volume string) {
+	opsFailed.Add(op, 1)
+	recordVolumeError(op, volume)
+}
+
+func inFlightOperations() []operation {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	ops := make([]operation, 0, len(operations))
+	for _, op := range operations {
+		ops = append(ops, *op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Started.Before(ops[j].Started)
+	})
+	return ops
+}
+
+// dumpState logs everything blocker currently believes to be true as JSON,
+// for diagnosing wedged hosts.
+func dumpState(d VolumeDriver) {
+	state := struct {
+		Time       time.Time
+		Operations []operation
+		Driver     interface{} `json:",omitempty"`
+	}{
+		Time:       time.Now(),
+		Operations: inFlightOperations(),
+	}
+	if sd, ok := d.(StateDumper); ok {
+		state.Driver = sd.State()
+	}
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		logError("Failed to serialize state: %v\n", err)
+		return
+	}
+	log("State dump:\n%s\n", b)
+}
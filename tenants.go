@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A tenant is one of several isolated plugin instances a single Blocker
+// serves EBS volumes to, e.g. the dockerds of different customers on a shared
+// host.  Each has its own sockets, managed tag, mount root, and mount table,
+// so that it can only see and mount the volumes it created, and may be
+// limited in how many volumes, and how much storage, it has.
+type tenant struct {
+	Name string
+	// Addresses to serve the tenant's plugin API on, as for -listen.
+	Listen []string
+	// The tag marking the tenant's volumes; the managed tag followed by
+	// :<name> by default.
+	ManagedTag string
+	// The directory beneath which the tenant's volumes are mounted; the mount
+	// root followed by -<name> by default.
+	MountRoot string
+	// The most volumes, and GiB of them, the tenant may have; 0 for no limit.
+	MaxVolumes int
+	MaxGiB     int64
+
+	// Whether names and IDs only refer to volumes tagged with ManagedTag,
+	// which they always do for the tenants of a tenants file.
+	managedOnly bool
+	// Where the tenant's mount table is saved.
+	mountState string
+}
+
+// defaultTenant describes the volumes served on the -listen addresses, as
+// configured by the flags.
+func defaultTenant() *tenant {
+	return &tenant{
+		ManagedTag:  managedTag,
+		MountRoot:   mountRoot,
+		managedOnly: managedOnly,
+	}
+}
+
+// limited reports whether the tenant has a quota.
+func (t *tenant) limited() bool {
+	return t.MaxVolumes > 0 || t.MaxGiB > 0
+}
+
+// checkQuota fails if a tenant that has count volumes of used GiB in all
+// can't have another volumes volumes and gib GiB.
+func (t *tenant) checkQuota(count int, used int64, volumes int, gib int64) error {
+	if t.MaxVolumes > 0 && volumes > 0 && count+volumes > t.MaxVolumes {
+		return errorf(ErrQuotaExceeded,
+			"Tenant %v already has %d of its %d EBS volumes.",
+			t.Name, count, t.MaxVolumes)
+	}
+	if t.MaxGiB > 0 && gib > 0 && used+gib > t.MaxGiB {
+		return errorf(ErrQuotaExceeded,
+			"Tenant %v has %d of its %d GiB of EBS volumes left; %d more "+
+				"are needed.", t.Name, t.MaxGiB-used, t.MaxGiB, gib)
+	}
+	return nil
+}
+
+var tenantNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// loadTenants loads the tenants to serve besides the default one from a JSON
+// file of the form:
+//
+//	{"Tenants": [{"Name": "acme", "Listen": ["unix:///run/acme/blocker.sock"],
+//	              "MaxVolumes": 20, "MaxGiB": 2048}, ...]}
+//
+// Tenants must not share sockets, managed tags, or mount roots with each
+// other or with the default tenant, whose addresses are given by listen.
+func loadTenants(path string, listen []string) ([]*tenant, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file struct{ Tenants []*tenant }
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("Parsing tenants file %v failed: %v", path, err)
+	}
+	names := make(map[string]bool)
+	addrs := make(map[string]bool)
+	for _, addr := range listen {
+		addrs[addr] = true
+	}
+	tags := map[string]bool{managedTag: true}
+	roots := map[string]bool{filepath.Clean(mountRoot): true}
+	for _, t := range file.Tenants {
+		if !tenantNameRegexp.MatchString(t.Name) {
+			return nil, fmt.Errorf("Tenants file %v has invalid tenant name %q.",
+				path, t.Name)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("Tenants file %v has tenant %v twice.",
+				path, t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Listen) == 0 {
+			return nil, fmt.Errorf("Tenant %v has no addresses to listen on.", t.Name)
+		}
+		for _, addr := range t.Listen {
+			if addrs[addr] {
+				return nil, fmt.Errorf("Tenant %v's address %v is already in use.",
+					t.Name, addr)
+			}
+			addrs[addr] = true
+		}
+
+		if t.ManagedTag == "" {
+			t.ManagedTag = managedTag + ":" + t.Name
+		}
+		// Tags with this prefix can't be set through volume options, so
+		// one tenant can't slip volumes into another's namespace.
+		if !strings.HasPrefix(t.ManagedTag, optionTagPrefix) {
+			return nil, fmt.Errorf("Tenant %v's managed tag %v must start with %v.",
+				t.Name, t.ManagedTag, optionTagPrefix)
+		}
+		if tags[t.ManagedTag] {
+			return nil, fmt.Errorf("Tenant %v's managed tag %v is already in use.",
+				t.Name, t.ManagedTag)
+		}
+		tags[t.ManagedTag] = true
+
+		if t.MountRoot == "" {
+			t.MountRoot = mountRoot + "-" + t.Name
+		}
+		t.MountRoot = filepath.Clean(t.MountRoot)
+		if !filepath.IsAbs(t.MountRoot) {
+			return nil, fmt.Errorf("Tenant %v's mount root %v is not absolute.",
+				t.Name, t.MountRoot)
+		}
+		for root := range roots {
+			if strings.HasPrefix(t.MountRoot+"/", root+"/") ||
+				strings.HasPrefix(root+"/", t.MountRoot+"/") {
+				return nil, fmt.Errorf("Tenant %v's mount root %v overlaps %v.",
+					t.Name, t.MountRoot, root)
+			}
+		}
+		roots[t.MountRoot] = true
+
+		if t.MaxVolumes < 0 || t.MaxGiB < 0 {
+			return nil, fmt.Errorf("Tenant %v has a negative quota.", t.Name)
+		}
+		t.managedOnly = true
+		t.mountState = filepath.Join(filepath.Dir(mountStatePath()),
+			"mounts-"+t.Name+".json")
+	}
+	return file.Tenants, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTenants(t *testing.T) {
+	withMountStateFile(t)
+	defaults := []string{"unix:///var/run/blocker.sock"}
+	tests := []struct {
+		name  string
+		file  string
+		valid bool
+	}{
+		{"defaults", `{"Tenants": [{"Name": "acme",
+			"Listen": ["unix:///run/acme.sock"], "MaxGiB": 100}]}`, true},
+		{"configured", `{"Tenants": [{"Name": "acme",
+			"Listen": ["unix:///run/acme.sock"], "ManagedTag": "blocker:acme",
+			"MountRoot": "/mnt/acme"}]}`, true},
+		{"no name", `{"Tenants": [{"Listen": ["unix:///run/acme.sock"]}]}`, false},
+		{"bad name", `{"Tenants": [{"Name": "../acme",
+			"Listen": ["unix:///run/acme.sock"]}]}`, false},
+		{"duplicate", `{"Tenants": [
+			{"Name": "acme", "Listen": ["unix:///run/acme.sock"]},
+			{"Name": "acme", "Listen": ["unix:///run/acme2.sock"]}]}`, false},
+		{"no sockets", `{"Tenants": [{"Name": "acme"}]}`, false},
+		{"default socket", `{"Tenants": [{"Name": "acme",
+			"Listen": ["unix:///var/run/blocker.sock"]}]}`, false},
+		{"shared socket", `{"Tenants": [
+			{"Name": "acme", "Listen": ["unix:///run/shared.sock"]},
+			{"Name": "initech", "Listen": ["unix:///run/shared.sock"]}]}`, false},
+		// Tenants could tag their volumes into another namespace.
+		{"settable tag", `{"Tenants": [{"Name": "acme",
+			"Listen": ["unix:///run/acme.sock"], "ManagedTag": "acme"}]}`, false},
+		{"default tag", `{"Tenants": [{"Name": "acme",
+			"Listen": ["unix:///run/acme.sock"],
+			"ManagedTag": "blocker:managed"}]}`, false},
+		{"shared tag", `{"Tenants": [
+			{"Name": "acme", "Listen": ["unix:///run/acme.sock"],
+				"ManagedTag": "blocker:shared"},
+			{"Name": "initech", "Listen": ["unix:///run/initech.sock"],
+				"ManagedTag": "blocker:shared"}]}`, false},
+		{"nested mount root", `{"Tenants": [{"Name": "acme",
+			"Listen": ["unix:///run/acme.sock"],
+			"MountRoot": "/mnt/blocker/acme"}]}`, false},
+		{"relative mount root", `{"Tenants": [{"Name": "acme",
+			"Listen": ["unix:///run/acme.sock"], "MountRoot": "acme"}]}`, false},
+		{"negative quota", `{"Tenants": [{"Name": "acme",
+			"Listen": ["unix:///run/acme.sock"], "MaxVolumes": -1}]}`, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "tenants.json")
+		if err := ioutil.WriteFile(path, []byte(test.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		tenants, err := loadTenants(path, defaults)
+		if test.valid && err != nil {
+			t.Errorf("%v: loadTenants failed: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%v: loadTenants = %+v, want an error", test.name, tenants)
+		}
+	}
+}
+
+func TestLoadTenantsDefaults(t *testing.T) {
+	state := withMountStateFile(t)
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := ioutil.WriteFile(path, []byte(`{"Tenants": [{"Name": "acme",
+		"Listen": ["unix:///run/acme.sock"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tenants, err := loadTenants(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := tenants[0]
+	want := tenant{
+		Name:        "acme",
+		Listen:      []string{"unix:///run/acme.sock"},
+		ManagedTag:  "blocker:managed:acme",
+		MountRoot:   "/mnt/blocker-acme",
+		managedOnly: true,
+		mountState:  filepath.Join(filepath.Dir(state), "mounts-acme.json"),
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("loadTenants = %+v, want %+v", *got, want)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	acme := &tenant{Name: "acme", MaxVolumes: 3, MaxGiB: 100}
+	tests := []struct {
+		count       int
+		used        int64
+		volumes     int
+		gib         int64
+		withinQuota bool
+	}{
+		{0, 0, 1, 100, true},
+		{2, 50, 1, 50, true},
+		{3, 50, 1, 10, false},
+		{2, 95, 1, 10, false},
+		// Growing a volume needs no more volumes.
+		{3, 90, 0, 10, true},
+		{3, 100, 0, 1, false},
+		{5, 200, 0, 0, true},
+	}
+	for _, test := range tests {
+		err := acme.checkQuota(test.count, test.used, test.volumes, test.gib)
+		if (err == nil) != test.withinQuota ||
+			(err != nil && errorCode(err) != ErrQuotaExceeded) {
+			t.Errorf("checkQuota(%d, %d, %d, %d) = %v, want within quota: %v",
+				test.count, test.used, test.volumes, test.gib, err,
+				test.withinQuota)
+		}
+	}
+
+	unlimited := &tenant{Name: "initech"}
+	if unlimited.limited() {
+		t.Error("Tenant without quotas is limited.")
+	}
+	if err := unlimited.checkQuota(1000, 1<<20, 1, 1<<20); err != nil {
+		t.Errorf("checkQuota without quotas = %v", err)
+	}
+}
+
+func TestTenantDriver(t *testing.T) {
+	withMountStateFile(t)
+	d := &ebsVolumeDriver{
+		identity: &instanceIdentity{instanceId: "i-1", zone: "us-east-1a"},
+		tenant:   defaultTenant(),
+		slots:    newDeviceSlots(),
+	}
+	acme := &tenant{Name: "acme", ManagedTag: "blocker:managed:acme",
+		MountRoot: "/mnt/blocker-acme", managedOnly: true,
+		mountState: filepath.Join(t.TempDir(), "mounts-acme.json")}
+	td := d.forTenant(acme)
+	if td.identity != d.identity || td.slots != d.slots {
+		t.Error("Tenant driver doesn't share the instance's identity and device slots.")
+	}
+	if mnt := td.mountPath("data"); mnt != "/mnt/blocker-acme/data" {
+		t.Errorf("Tenant mounts data at %v, want /mnt/blocker-acme/data", mnt)
+	}
+
+	tags := tagMap(td.newVolumeInput("data", 10, nil).TagSpecifications[0].Tags)
+	if tags["blocker:managed:acme"] != "true" || tags[managedTag] != "" {
+		t.Errorf("Tenant's new volume is tagged %v, want only its managed tag",
+			tags)
+	}
+	var filtered bool
+	for _, f := range td.nameFilters("data") {
+		if *f.Name == "tag:blocker:managed:acme" {
+			filtered = true
+		}
+	}
+	if !filtered {
+		t.Error("Tenant's names resolve to volumes without its managed tag.")
+	}
+}
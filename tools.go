@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os/exec"
+	"sort"
+)
+
+// The external tools each driver cannot work without.
+var requiredTools = map[string][]string{
+	"ebs":            {"mount", "umount", "mountpoint", "blkid", "fsck", "dumpe2fs"},
+	"instance-store": {"mount", "umount", "mountpoint", "blkid"},
+	"nbd":            {"mount", "umount", "mountpoint", "nbd-client"},
+	"nfs":            {"mount", "umount", "mountpoint", "mount.nfs4"},
+	"nvme-tcp":       {"mount", "umount", "mountpoint", "nvme"},
+	"s3fuse":         {"umount", "mountpoint"},
+	"zfs":            {"zfs", "mountpoint"},
+}
+
+// The external tools optional features need; any one of those listed will
+// do.  Features whose tools are all missing are disabled.
+var featureTools = map[string][]string{
+	"freeze": {"fsfreeze"},
+	"wipe":   {"blkdiscard"},
+	"resize": {"resize2fs", "xfs_growfs", "btrfs"},
+}
+
+// missingTools lists the tools a driver needs that aren't on the PATH.
+func missingTools(driver string) []string {
+	var missing []string
+	for _, tool := range requiredTools[driver] {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	// Without mkfs, instance-store disks can only be formatted in a container
+	// of -mkfs-image.
+	if driver == "instance-store" && mkfsImage == "" {
+		for _, tool := range []string{"mkfs", "mkfs." + instanceStoreFsType} {
+			if _, err := exec.LookPath(tool); err != nil {
+				missing = append(missing, tool)
+			}
+		}
+	}
+	return missing
+}
+
+// featureAvailable reports whether the tools a feature needs, if any, are
+// installed.
+func featureAvailable(feature string) bool {
+	tools, ok := featureTools[feature]
+	if !ok {
+		return true
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// logUnavailableFeatures warns about features disabled for want of tools.
+func logUnavailableFeatures() {
+	var features []string
+	for feature := range featureTools {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	for _, feature := range features {
+		if !featureAvailable(feature) {
+			logError("Disabling %v: none of %v is installed.\n",
+				feature, featureTools[feature])
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The environment variable through which a blocker process tells the one
+// replacing it the addresses of the listeners it hands over.
+const upgradeListenersEnv = "BLOCKER_UPGRADE_LISTENERS"
+
+// The file descriptors handed to a replacement process: a pipe on which it
+// reports that it is ready, a pipe on which it is sent the upgradeState of
+// the old process, and then the listeners, in the order of
+// upgradeListenersEnv.
+const (
+	upgradeReadyFd         = 3
+	upgradeStateFd         = 4
+	upgradeFirstListenerFd = 5
+)
+
+// How long a replacement process may take to get ready before the upgrade is
+// abandoned.
+var upgradeReadyTimeout = time.Minute
+
+// What a blocker process hands over to the one replacing it.  Processes from
+// before detaches were handed over send just the mounts.
+type upgradeState struct {
+	Mounts   []MountInfo
+	Detaches []PendingDetach
+	// The same for the driver of each tenant, by name.
+	Tenants map[string]*upgradeState `json:",omitempty"`
+}
+
+// handOverState returns what a driver has to hand over.
+func handOverState(d VolumeDriver) *upgradeState {
+	state := &upgradeState{Mounts: []MountInfo{}, Detaches: []PendingDetach{}}
+	if ml, ok := d.(MountLister); ok {
+		state.Mounts = ml.Mounts()
+	}
+	if dh, ok := d.(DetachHandover); ok {
+		state.Detaches = dh.HandOverDetaches()
+	}
+	return state
+}
+
+// takeOverState gives a driver what was handed over for it.
+func takeOverState(d VolumeDriver, us *upgradeState) {
+	if mr, ok := d.(MountRestorer); ok {
+		mr.RestoreMounts(us.Mounts)
+	}
+	log("Took over %d mounted volumes from the previous process.\n",
+		len(us.Mounts))
+	if dh, ok := d.(DetachHandover); ok && len(us.Detaches) > 0 {
+		dh.TakeOverDetaches(us.Detaches)
+		log("Took over %d pending detaches from the previous process.\n",
+			len(us.Detaches))
+	}
+}
+
+// Listeners handed over by the process this one replaced, by address, until
+// listen claims them.
+var inherited = map[string]net.Listener{}
+
+// upgrade replaces this process with a new one, started from the blocker
+// binary now on disk, which takes over its listeners.  Requests arriving
+// during the switch wait in the listeners' backlogs rather than failing.  The
+// new process starts up as far as it can without serving requests; once it
+// is ready, this one stops accepting them, finishes those in flight, and
+// hands over what it, and the driver of each tenant, know of mounted volumes
+// and those due to be detached, after which it must exit.  If the new process
+// doesn't get ready, the upgrade is abandoned and an error returned, leaving
+// this process serving as before.
+func upgrade(d VolumeDriver, tenants map[string]VolumeDriver,
+	listeners []*listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	defer stateW.Close()
+
+	files := []*os.File{readyW, stateR}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		f, err := l.file()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		addrs[i] = l.addr
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		upgradeListenersEnv+"="+strings.Join(addrs, " "))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log("Started new blocker process %d; waiting for it to get ready...\n",
+		cmd.Process.Pid)
+
+	// Only the new process holds the write end of the pipe now, so reading
+	// fails if it exits before reporting that it is ready.
+	readyW.Close()
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeReadyTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return fmt.Errorf("New blocker process %d did not get ready: %v",
+			cmd.Process.Pid, err)
+	}
+
+	log("Handing over to blocker process %d.\n", cmd.Process.Pid)
+	for _, l := range listeners {
+		if err := l.shutdown(); err != nil {
+			logError("Shutting down listener on %v failed: %v\n", l.addr, err)
+		}
+	}
+	state := handOverState(d)
+	if len(tenants) > 0 {
+		state.Tenants = make(map[string]*upgradeState)
+		for name, td := range tenants {
+			state.Tenants[name] = handOverState(td)
+		}
+	}
+	if err := json.NewEncoder(stateW).Encode(state); err != nil {
+		logError("Handing over mounts failed: %v\n", err)
+	}
+	return nil
+}
+
+// inheritListeners picks up the listeners handed over by the process this one
+// is replacing, if any.
+func inheritListeners() error {
+	addrs := os.Getenv(upgradeListenersEnv)
+	if addrs == "" {
+		return nil
+	}
+	for i, addr := range strings.Fields(addrs) {
+		f := os.NewFile(uintptr(upgradeFirstListenerFd+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Inheriting listener on %v failed: %v", addr, err)
+		}
+		inherited[addr] = l
+	}
+	return nil
+}
+
+// takeOver completes taking over from the process this one is replacing, if
+// any: it reports that this process is ready, and then waits for the old one
+// to finish its requests and hand over the volumes it, and the driver of each
+// tenant, has mounted, and those it was due to detach.  Inherited listeners
+// that are no longer wanted are closed.
+func takeOver(d VolumeDriver, tenants map[string]VolumeDriver) {
+	if os.Getenv(upgradeListenersEnv) == "" {
+		return
+	}
+	os.Unsetenv(upgradeListenersEnv)
+	for addr, l := range inherited {
+		log("No longer listening on %v.\n", addr)
+		l.Close()
+		delete(inherited, addr)
+	}
+
+	ready := os.NewFile(upgradeReadyFd, "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+	state := os.NewFile(upgradeStateFd, "state")
+	defer state.Close()
+	us, err := readUpgradeState(state)
+	if err != nil {
+		logError("Taking over mounts from the previous process failed: %v\n", err)
+		return
+	}
+	takeOverState(d, &us)
+	for name, ts := range us.Tenants {
+		td, ok := tenants[name]
+		if !ok {
+			logError("Tenant %v isn't served; leaving its %d mounted volumes "+
+				"be.\n", name, len(ts.Mounts))
+			continue
+		}
+		log("Taking over tenant %v:\n", name)
+		takeOverState(td, ts)
+	}
+}
+
+// readUpgradeState reads what the previous process handed over, which for
+// older processes is only a list of mounts.
+func readUpgradeState(r io.Reader) (upgradeState, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return upgradeState{}, err
+	}
+	var us upgradeState
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "[") {
+		err := json.Unmarshal(raw, &us.Mounts)
+		return us, err
+	}
+	err := json.Unmarshal(raw, &us)
+	return us, err
+}
+
+// notifySystemd tells systemd that blocker is ready, and which process is
+// now the main one, when it runs as a Type=notify service.
+func notifySystemd() {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		logError("Notifying systemd failed: %v\n", err)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "READY=1\nMAINPID=%d", os.Getpid())
+}
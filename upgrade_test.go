@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadUpgradeState(t *testing.T) {
+	tests := []struct {
+		name            string
+		in              string
+		mounts, pending int
+	}{
+		{"mounts only", `[{"Volume": "data"}, {"Volume": "logs"}]`, 2, 0},
+		{"state", `{"Mounts": [{"Volume": "data"}],
+			"Detaches": [{"Volume": "logs", "VolumeId": "vol-1",
+				"At": "2024-01-02T03:04:05Z"}]}`, 1, 1},
+		{"empty state", `{"Mounts": [], "Detaches": []}`, 0, 0},
+	}
+	for _, test := range tests {
+		us, err := readUpgradeState(strings.NewReader(test.in))
+		if err != nil {
+			t.Errorf("%v: readUpgradeState failed: %v", test.name, err)
+			continue
+		}
+		if len(us.Mounts) != test.mounts || len(us.Detaches) != test.pending {
+			t.Errorf("%v: read %+v, want %d mounts and %d detaches",
+				test.name, us, test.mounts, test.pending)
+		}
+	}
+
+	if _, err := readUpgradeState(strings.NewReader(`{"Mounts": [`)); err == nil {
+		t.Error("readUpgradeState of a truncated state succeeded.")
+	}
+}
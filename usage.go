@@ -0,0 +1,367 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Usage watermark events, keyed by volume.
+var (
+	usageWarnings = expvar.NewMap("usage_warnings")
+	usageResizes  = expvar.NewMap("usage_resizes")
+)
+
+// usageWatermarks configures what happens as mounted volumes fill up.
+type usageWatermarks struct {
+	// Warn about volumes at least this full, in percent; 0 disables.
+	WarnPercent int
+	// Grow volumes at least this full, in percent; 0 disables, except for
+	// volumes with their own resize policy, which are grown at 90%.
+	ResizePercent int
+	// How to grow volumes without their own resize policy.
+	Policy ResizePolicy
+}
+
+// A ResizePolicy says how to grow a volume, e.g. "+20%:max=2048" grows it by
+// a fifth at a time up to 2 TiB, and "+10" by 10 GiB at a time without limit.
+type ResizePolicy struct {
+	// How much to grow by, in GiB or, if Percent, percent of the current size.
+	Increment int64
+	Percent   bool
+	// The largest size to grow to, in GiB, or 0 for no limit.
+	MaxGiB int64
+}
+
+var resizePolicyRegexp = regexp.MustCompile(`^\+([0-9]+)(%?)(:max=([0-9]+))?$`)
+
+func parseResizePolicy(s string) (ResizePolicy, error) {
+	m := resizePolicyRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return ResizePolicy{}, errorf(ErrInvalidOption,
+			"Invalid resize policy %q: expected +<GiB> or +<percent>%%, "+
+				"optionally followed by :max=<GiB>.", s)
+	}
+	p := ResizePolicy{Percent: m[2] == "%"}
+	p.Increment, _ = strconv.ParseInt(m[1], 10, 64)
+	if m[4] != "" {
+		p.MaxGiB, _ = strconv.ParseInt(m[4], 10, 64)
+	}
+	return p, nil
+}
+
+// parseResizeTarget parses the size a volume is to be grown to on request:
+// either a resize policy, or an absolute size in GiB.
+func parseResizeTarget(s string) (ResizePolicy, error) {
+	if strings.HasPrefix(s, "+") {
+		return parseResizePolicy(s)
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size <= 0 {
+		return ResizePolicy{}, errorf(ErrInvalidOption,
+			"Invalid size %q: expected <GiB>, +<GiB>, or +<percent>%%.", s)
+	}
+	// Growing by the size itself, but no further, grows to exactly it.
+	return ResizePolicy{Increment: size, MaxGiB: size}, nil
+}
+
+// How long to wait for EBS to make the new size of a volume usable.
+var modifyTimeout = 10 * time.Minute
+
+// next returns the size in GiB to grow a volume of the given size to, or 0
+// if it may not grow any further.
+func (p ResizePolicy) next(current int64) int64 {
+	increment := p.Increment
+	if p.Percent {
+		increment = (current*p.Increment + 99) / 100
+	}
+	size := current + increment
+	if p.MaxGiB > 0 && size > p.MaxGiB {
+		size = p.MaxGiB
+	}
+	if size <= current {
+		return 0
+	}
+	return size
+}
+
+// How long after growing a volume automatically it may be grown again.  EBS
+// only allows one modification of a volume every six hours, so trying any
+// sooner only fails.
+var autoResizeCooldown = 6 * time.Hour
+
+// startUsageMonitor periodically checks how full each mounted volume is, so
+// that growth is dealt with before applications run out of space.
+func startUsageMonitor(d MountLister, interval time.Duration, w usageWatermarks) {
+	log("Checking volume usage every %v.\n", interval)
+	go func() {
+		// When each volume was last grown automatically.
+		autoResized := make(map[string]time.Time)
+		for range time.Tick(interval) {
+			for _, m := range d.Mounts() {
+				checkUsage(d, m, w, autoResized)
+			}
+		}
+	}()
+}
+
+func checkUsage(d MountLister, m MountInfo, w usageWatermarks,
+	autoResized map[string]time.Time) {
+	if linkedDevice(m.Mountpoint) != "" || partitionedDisk(m.Mountpoint) != "" {
+		// There's no filesystem to check on attach-only volumes, nor a
+		// single one on partitioned volumes.
+		return
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(m.Mountpoint, &st); err != nil || st.Blocks == 0 {
+		return
+	}
+	percent := int(100 * (st.Blocks - st.Bavail) / st.Blocks)
+
+	if r, ok := d.(Resizer); ok && featureAvailable("resize") {
+		policy, trigger := w.Policy, w.ResizePercent
+		if p, ok := r.ResizePolicy(m.Volume); ok {
+			policy = p
+			if trigger == 0 {
+				trigger = 90
+			}
+		}
+		if trigger > 0 && percent >= trigger {
+			if last, ok := autoResized[m.Volume]; ok &&
+				time.Since(last) < autoResizeCooldown {
+				logError("Volume %v is %d%% full; it was last grown at %v, "+
+					"too recently to grow it again.\n",
+					m.Volume, percent, last.Format(time.RFC3339))
+				return
+			}
+			log("\tVolume %v is %d%% full; growing it.\n", m.Volume, percent)
+			usageResizes.Add(m.Volume, 1)
+			// Failed attempts count too: most fail for reasons that
+			// retrying every minute won't fix.
+			autoResized[m.Volume] = time.Now()
+			if err := r.Grow(m.Volume, policy); err != nil {
+				logError("Growing %v failed: %v\n", m.Volume, err)
+			}
+			return
+		}
+	}
+	if w.WarnPercent > 0 && percent >= w.WarnPercent {
+		usageWarnings.Add(m.Volume, 1)
+		logError("Volume %v is %d%% full.\n", m.Volume, percent)
+	}
+}
+
+// Grow enlarges a mounted volume and the filesystem on it according to a
+// resize policy.  EBS only allows one modification of a volume every six
+// hours, so later attempts within that time fail.  Grow takes the volume's
+// lock itself, and lets go of it while EBS carries out the modification,
+// which can take minutes, so that Docker can still unmount the volume
+// meanwhile.
+func (d *ebsVolumeDriver) Grow(path string, policy ResizePolicy) error {
+	volume, _ := parsePath(path)
+	unlock := lockVolume("grow", volume)
+	id, size, err := d.modifySize(volume, policy)
+	unlock()
+	if err != nil {
+		return err
+	}
+	if err := d.waitUntilModified(volume, id, size); err != nil {
+		return err
+	}
+	log("\tEBS volume %v is now %d GiB.\n", id, size)
+
+	defer lockVolume("grow", volume)()
+	if mountedDevice(d.mountPath(volume)) == "" {
+		return errorf(ErrNotMounted, "Volume %v was unmounted while it grew; "+
+			"mount it with auto-grow=true to grow its filesystem.", volume)
+	}
+	beginPhase(volume, "growfs")
+	return growFilesystem(d.mountPath(volume))
+}
+
+// modifySize asks EBS to grow a mounted volume according to a resize policy,
+// returning its ID and new size in GiB.  The volume's lock must be held.
+func (d *ebsVolumeDriver) modifySize(
+	volume string, policy ResizePolicy) (string, int64, error) {
+	if mountedDevice(d.mountPath(volume)) == "" {
+		return "", 0, errorf(ErrNotMounted,
+			"Volume %v is not mounted here, so its filesystem can't be grown.", volume)
+	}
+	id, err := d.volumeId(volume)
+	if err != nil {
+		return "", 0, err
+	}
+	info, err := d.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	current := *info.Volumes[0].Size
+	size := policy.next(current)
+	if size == 0 {
+		return "", 0, errorf(ErrResizeLimit,
+			"Volume %v cannot grow beyond its current %d GiB.", id, current)
+	}
+	release, err := d.reserveQuota(0, size-current)
+	if err != nil {
+		return "", 0, err
+	}
+	defer release()
+	log("\tGrowing EBS volume %v from %d to %d GiB.\n", id, current, size)
+	beginPhase(volume, "modify")
+	if _, err := d.ec2.ModifyVolume(&ec2.ModifyVolumeInput{
+		VolumeId: aws.String(id),
+		Size:     aws.Int64(size),
+	}); err != nil {
+		return "", 0, d.modificationError(id, "modify", err)
+	}
+	return id, size, nil
+}
+
+// waitUntilModified polls the modification of a volume to a new size until
+// the size is usable, which it is once the modification is optimizing.  That
+// takes anything from seconds to many minutes, so polling backs off to every
+// 30 seconds.
+func (d *ebsVolumeDriver) waitUntilModified(
+	volume string, id string, size int64) error {
+	deadline := time.Now().Add(modifyTimeout)
+	for delay := time.Second; ; delay *= 2 {
+		mods, err := d.ec2.DescribeVolumesModifications(
+			&ec2.DescribeVolumesModificationsInput{
+				VolumeIds: []*string{aws.String(id)},
+			})
+		if aerr, ok := err.(awserr.Error); ok &&
+			aerr.Code() == "InvalidVolumeModification.NotFound" {
+			// Not visible yet.
+			mods, err = &ec2.DescribeVolumesModificationsOutput{}, nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, mod := range mods.VolumesModifications {
+			if aws.Int64Value(mod.TargetSize) != size {
+				continue
+			}
+			state := aws.StringValue(mod.ModificationState)
+			switch state {
+			case ec2.VolumeModificationStateOptimizing,
+				ec2.VolumeModificationStateCompleted:
+				return nil
+			case ec2.VolumeModificationStateFailed:
+				return errorf(ErrResizeFailed, "Modifying volume %v failed: %v", id,
+					aws.StringValue(mod.StatusMessage))
+			}
+			operationProgress(volume, fmt.Sprintf("%v %d%%",
+				state, aws.Int64Value(mod.Progress)))
+		}
+		if time.Now().After(deadline) {
+			return errorf(ErrStateTimeout,
+				"Timed out waiting for volume %v to grow.", id)
+		}
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+		time.Sleep(delay)
+	}
+}
+
+// How long to keep retrying operations that EC2 refuses while a volume is
+// still being modified.
+var busyVolumeTimeout = time.Minute
+
+// modificationError explains an operation EC2 refused because the volume was
+// still being modified, e.g. while it was optimizing, as BLOCKER_VOLUME_BUSY.
+// Other errors are returned as they are.
+func (d *ebsVolumeDriver) modificationError(id string, op string, err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok || (aerr.Code() != "IncorrectState" &&
+		aerr.Code() != "IncorrectModificationState") {
+		return err
+	}
+	mods, derr := d.ec2.DescribeVolumesModifications(
+		&ec2.DescribeVolumesModificationsInput{
+			VolumeIds: []*string{aws.String(id)},
+		})
+	if derr != nil {
+		return err
+	}
+	for _, mod := range mods.VolumesModifications {
+		switch state := aws.StringValue(mod.ModificationState); state {
+		case ec2.VolumeModificationStateModifying,
+			ec2.VolumeModificationStateOptimizing:
+			return errorf(ErrVolumeBusy,
+				"EC2 refused to %v volume %v, which is still %v (%d%%) after "+
+					"being modified: %v", op, id, state,
+				aws.Int64Value(mod.Progress), aerr.Message())
+		}
+	}
+	return err
+}
+
+func (d *ebsVolumeDriver) ResizePolicy(path string) (ResizePolicy, bool) {
+	volume, _ := parsePath(path)
+	d.labelsMu.Lock()
+	defer d.labelsMu.Unlock()
+	p, ok := d.policies[volume]
+	return p, ok
+}
+
+// Filesystems are only grown on mount once their device is larger by at
+// least this many bytes, which is less than EBS ever grows a volume by, but
+// more than filesystems leave unused at the end of their devices.
+const autoGrowSlack = 64 << 20
+
+// growToDevice grows the filesystem mounted at mnt if its device has grown
+// since, e.g. through a ModifyVolume made outside Blocker.  Filesystems that
+// don't say how big they are are grown regardless, which does nothing if they
+// already fill their device.
+func growToDevice(volume string, dev string, mnt string) error {
+	devSize := deviceSize(dev)
+	fsSize := filesystemSize(dev, mnt)
+	if devSize > 0 && fsSize > 0 && devSize-fsSize < autoGrowSlack {
+		return nil
+	}
+	if !featureAvailable("resize") {
+		return errorf(ErrResizeFailed, "No tools to grow the filesystem on %v.", dev)
+	}
+	log("\tGrowing the filesystem on %v (%d bytes) to fill %v (%d bytes).\n",
+		volume, fsSize, dev, devSize)
+	return growFilesystem(mnt)
+}
+
+// filesystemSize returns the size in bytes of the filesystem on a device as
+// it records it, or 0 if unknown.
+func filesystemSize(dev string, mnt string) int64 {
+	if fs, ok := filesystems[filesystemType(dev)]; ok {
+		return fs.size(dev, mnt)
+	}
+	return 0
+}
+
+// growFilesystem grows the filesystem mounted at mnt to fill its device.
+func growFilesystem(mnt string) error {
+	dev := mountedDevice(mnt)
+	fstype := filesystemType(dev)
+	fs, ok := filesystems[fstype]
+	if !ok {
+		return errorf(ErrResizeFailed,
+			"Don't know how to grow %v filesystem on %v.", fstype, dev)
+	}
+	cmd := fs.growCommand(dev, mnt)
+	if out, err := runWithTimeout(fsCommandTimeout, cmd[0], cmd[1:]...); err != nil {
+		if errorCode(err) == ErrCommandTimeout {
+			return err
+		}
+		return errorf(ErrResizeFailed, "%v: %v\n%v", cmd[0], err, string(out))
+	}
+	return nil
+}
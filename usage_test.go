@@ -0,0 +1,130 @@
+package main
+
+import "testing"
+
+func TestParseResizePolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ResizePolicy
+	}{
+		{"+10", ResizePolicy{Increment: 10}},
+		{"+0", ResizePolicy{Increment: 0}},
+		{"+20%", ResizePolicy{Increment: 20, Percent: true}},
+		{"+10:max=100", ResizePolicy{Increment: 10, MaxGiB: 100}},
+		{"+20%:max=2048", ResizePolicy{Increment: 20, Percent: true, MaxGiB: 2048}},
+	}
+	for _, test := range tests {
+		got, err := parseResizePolicy(test.in)
+		if err != nil {
+			t.Errorf("parseResizePolicy(%q) failed: %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseResizePolicy(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseResizePolicyInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"10",
+		"+",
+		"+-10",
+		"-10",
+		"+10GiB",
+		"+1.5",
+		"+10%%",
+		"+10:max=",
+		"+10:max=-1",
+		"+10:min=5",
+		" +10",
+	} {
+		if got, err := parseResizePolicy(in); err == nil {
+			t.Errorf("parseResizePolicy(%q) = %+v, want an error", in, got)
+		} else if errorCode(err) != ErrInvalidOption {
+			t.Errorf("parseResizePolicy(%q) = %v, want %v",
+				in, errorString(err), ErrInvalidOption)
+		}
+	}
+}
+
+func TestResizePolicyNext(t *testing.T) {
+	tests := []struct {
+		policy  ResizePolicy
+		current int64
+		want    int64
+	}{
+		{ResizePolicy{Increment: 10}, 100, 110},
+		{ResizePolicy{Increment: 10, MaxGiB: 105}, 100, 105},
+		{ResizePolicy{Increment: 10, MaxGiB: 100}, 100, 0},
+		{ResizePolicy{Increment: 10, MaxGiB: 50}, 100, 0},
+		{ResizePolicy{Increment: 0}, 100, 0},
+		{ResizePolicy{Increment: 20, Percent: true}, 100, 120},
+		// Percentages round up, so small volumes still grow.
+		{ResizePolicy{Increment: 20, Percent: true}, 1, 2},
+		{ResizePolicy{Increment: 10, Percent: true}, 15, 17},
+		{ResizePolicy{Increment: 20, Percent: true, MaxGiB: 110}, 100, 110},
+	}
+	for _, test := range tests {
+		if got := test.policy.next(test.current); got != test.want {
+			t.Errorf("%+v.next(%d) = %d, want %d",
+				test.policy, test.current, got, test.want)
+		}
+	}
+}
+
+func TestParseResizeTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ResizePolicy
+	}{
+		// An absolute size grows to exactly it.
+		{"200", ResizePolicy{Increment: 200, MaxGiB: 200}},
+		{"1", ResizePolicy{Increment: 1, MaxGiB: 1}},
+		{"+50", ResizePolicy{Increment: 50}},
+		{"+10%", ResizePolicy{Increment: 10, Percent: true}},
+		{"+10%:max=500", ResizePolicy{Increment: 10, Percent: true, MaxGiB: 500}},
+	}
+	for _, test := range tests {
+		got, err := parseResizeTarget(test.in)
+		if err != nil {
+			t.Errorf("parseResizeTarget(%q) failed: %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseResizeTarget(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{"", "0", "-10", "1.5", "10%", "+", "+x", "big"} {
+		if got, err := parseResizeTarget(in); err == nil {
+			t.Errorf("parseResizeTarget(%q) = %+v, want an error", in, got)
+		}
+	}
+}
+
+func TestResizeTargetNext(t *testing.T) {
+	tests := []struct {
+		in      string
+		current int64
+		want    int64
+	}{
+		{"200", 100, 200},
+		{"200", 150, 200},
+		// Volumes can't shrink, nor grow to the size they are.
+		{"200", 200, 0},
+		{"200", 300, 0},
+		{"+50", 100, 150},
+	}
+	for _, test := range tests {
+		p, err := parseResizeTarget(test.in)
+		if err != nil {
+			t.Fatalf("parseResizeTarget(%q) failed: %v", test.in, err)
+		}
+		if got := p.next(test.current); got != test.want {
+			t.Errorf("Growing %d GiB to %q gives %d GiB, want %d",
+				test.current, test.in, got, test.want)
+		}
+	}
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	. "log"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 var stdout *Logger
@@ -11,12 +19,120 @@ var stderr *Logger
 func init() {
 	stdout = New(os.Stdout, "", Ldate|Ltime)
 	stderr = New(os.Stderr, "error: ", Ldate|Ltime)
+	go flushRepeatedErrors()
 }
 
 func log(format string, a ...interface{}) {
 	stdout.Printf(format, a...)
 }
 
+// Values of keys matching this are never logged.
+var sensitiveKeyRegexp = regexp.MustCompile(
+	"(?i)secret|password|passphrase|token|credential")
+
+// Longer values are truncated when logged.
+const maxLoggedValue = 80
+
+// formatFields renders a map for logging as sorted key=value pairs, redacting
+// sensitive values and truncating long ones.
+func formatFields(fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		v := fmt.Sprintf("%v", fields[k])
+		if sensitiveKeyRegexp.MatchString(k) {
+			v = "<redacted>"
+		} else if len(v) > maxLoggedValue {
+			v = fmt.Sprintf("%s...(%d bytes)", v[:maxLoggedValue], len(v))
+		}
+		parts[i] = fmt.Sprintf("%s=%q", k, v)
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
+
+// formatOpts renders volume options for logging.
+func formatOpts(opts map[string]string) string {
+	fields := make(map[string]interface{}, len(opts))
+	for k, v := range opts {
+		fields[k] = v
+	}
+	return formatFields(fields)
+}
+
+// Identical errors logged within this long of one another are only logged
+// once, followed by a summary of how often they repeated, so that storms of
+// errors, e.g. during AWS incidents, don't drown out everything else.
+const errorDedupWindow = time.Minute
+
+var (
+	repeatedMu sync.Mutex
+	// How many times each error has been suppressed since it was last logged
+	// or summarized.
+	repeatedErrors = map[string]int{}
+)
+
 func logError(format string, a ...interface{}) {
-	stderr.Printf(format, a...)
+	msg := fmt.Sprintf(format, a...)
+	repeatedMu.Lock()
+	_, seen := repeatedErrors[msg]
+	if seen {
+		repeatedErrors[msg]++
+	} else {
+		repeatedErrors[msg] = 0
+	}
+	repeatedMu.Unlock()
+	if !seen {
+		stderr.Print(msg)
+	}
+}
+
+// flushRepeatedErrors periodically summarizes the errors suppressed by
+// logError, and forgets those that have stopped repeating.
+func flushRepeatedErrors() {
+	for range time.Tick(errorDedupWindow) {
+		repeatedMu.Lock()
+		repeated := repeatedErrors
+		repeatedErrors = make(map[string]int)
+		for msg, n := range repeated {
+			if n > 0 {
+				// Keep suppressing errors that are still repeating.
+				repeatedErrors[msg] = 0
+			}
+		}
+		repeatedMu.Unlock()
+
+		for msg, n := range repeated {
+			if n > 0 {
+				stderr.Printf("(repeated %d times in the last %v) %s",
+					n, errorDedupWindow, msg)
+			}
+		}
+	}
+}
+
+// writeFileAtomic replaces the file at path with data.  The file is written
+// alongside and then renamed into place, so readers never see it
+// half-written.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".blocker-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
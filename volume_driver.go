@@ -1,16 +1,24 @@
 package main
 
+import (
+	"fmt"
+	"time"
+)
+
 // Docker volume plugins enable Docker deployments to be integrated with
 // external storage systems, and enable data volumes to persist beyond the
 // lifetime of a single Docker host.  See the Docker plugin documentation for
 // more information: https://docs.docker.com/extend/plugins_volume/
 type VolumeDriver interface {
-	// Instructs the plugin about a new volume.  The plugin need not actually
-	// manifest the volume on the filesystem yet, until Mount is called.
-	Create(name string) error
+	// Instructs the plugin about a new volume, along with any driver-specific
+	// options passed via `docker volume create -o`.  The plugin need not
+	// actually manifest the volume on the filesystem yet, until Mount is called.
+	Create(name string, opts map[string]string) error
 
-	// Mounts a volume, returning its mountpoint on the host filesystem.
-	Mount(name string) (string, error)
+	// Mounts a volume, returning its mountpoint on the host filesystem.  The
+	// id uniquely identifies the caller's use of the volume (and is empty for
+	// Docker versions that don't send one).
+	Mount(name string, id string) (string, error)
 
 	// Fetches the host mountpoint location for an existing volume.
 	Path(name string) (string, error)
@@ -18,6 +26,175 @@ type VolumeDriver interface {
 	// Removes an existing volume.
 	Remove(name string) error
 
-	// Unmounts an existing volume.
-	Unmount(name string) error
+	// Unmounts an existing volume, for the caller identified by id.
+	Unmount(name string, id string) error
+}
+
+// Describes properties of a driver's volumes to Docker.
+type Capabilities struct {
+	// Either "local", for volumes only reachable from this host, or
+	// "global", for volumes that may be used from any host.
+	Scope string
+	// Optional features supported on this host, e.g. "snapshots" or "nvme".
+	// Docker ignores these; they are for orchestration layers.
+	Features []string `json:",omitempty"`
+}
+
+// Drivers may report their Capabilities; those that don't are assumed to
+// have local scope.
+type CapabilitiesDriver interface {
+	Capabilities() Capabilities
+}
+
+// Describes a volume to Docker.
+type VolumeInfo struct {
+	Name       string
+	Mountpoint string                 `json:",omitempty"`
+	Status     map[string]interface{} `json:",omitempty"`
+}
+
+// String renders a volume's description for logging.
+func (info VolumeInfo) String() string {
+	return fmt.Sprintf("%s at %q %s", info.Name, info.Mountpoint,
+		formatFields(info.Status))
+}
+
+// Drivers may describe individual volumes; Docker falls back to its own
+// bookkeeping for those that don't.
+type Getter interface {
+	Get(name string) (VolumeInfo, error)
+}
+
+// Drivers may list the volumes they know of; Docker falls back to its own
+// bookkeeping for those that don't.
+type Lister interface {
+	List() ([]VolumeInfo, error)
+}
+
+// Drivers may support features that depend on the host, beyond those implied
+// by the interfaces they implement.
+type FeatureDriver interface {
+	Features() []string
+}
+
+// Drivers may describe which of their volumes this host can use, as labels
+// for schedulers to place storage-using workloads by.
+type PlacementDriver interface {
+	Placement() map[string]string
+}
+
+// Drivers may know tags of volumes, to be exported as labels on their metrics.
+type VolumeLabeler interface {
+	VolumeLabels(name string) map[string]string
+}
+
+// Drivers may additionally implement any of the following interfaces to
+// support the corresponding operations of the admin API.
+
+// Describes the host environment the driver is operating in.
+type InfoDriver interface {
+	Info() map[string]string
+}
+
+// Forcibly detaches a volume from whichever host it is attached to.
+type ForceDetacher interface {
+	ForceDetach(name string) error
+}
+
+// Reports the driver's in-memory state for diagnostic dumps.
+type StateDumper interface {
+	State() interface{}
+}
+
+// Replaces an unencrypted volume with an encrypted copy, returning the new
+// volume's name.
+type Encrypter interface {
+	Encrypt(name string, kmsKeyId string, deleteOriginal bool) (string, error)
+}
+
+// Describes the volumes this host is using in full, for inventory systems.
+type Inventorier interface {
+	InventoryVolumes() ([]InventoryVolume, error)
+}
+
+// Lists the volumes currently mounted on this host.
+type MountLister interface {
+	Mounts() []MountInfo
+}
+
+// Describes a volume in depth, for troubleshooting.
+type Describer interface {
+	Describe(name string) (VolumeDescription, error)
+}
+
+// A VolumeDescription sets what Blocker records of a volume beside what the
+// host and the storage backend say about it, and lists where they disagree.
+type VolumeDescription struct {
+	Name string
+	// The volume's entry in the mount table, if any.
+	Mount *MountInfo `json:",omitempty"`
+	// What the host shows, e.g. what is mounted at the volume's mountpoint.
+	Host map[string]string
+	// What the storage backend reports, e.g. the volume's attachment.
+	Backend map[string]string
+	// Disagreements between the above, in words.
+	Discrepancies []string `json:",omitempty"`
+}
+
+// Takes over the mounts recorded by a previous blocker process, when it hands
+// over to this one.
+type MountRestorer interface {
+	RestoreMounts(mounts []MountInfo)
+}
+
+// Hands over the volumes due to be detached once idle, which would otherwise
+// stay attached, when another blocker process takes over from this one.
+type DetachHandover interface {
+	// Stops the pending detaches, returning them.
+	HandOverDetaches() []PendingDetach
+	// Schedules the detaches handed over by a previous process.
+	TakeOverDetaches(detaches []PendingDetach)
+}
+
+// Exports an image of a volume to the given URL.
+type Exporter interface {
+	Export(name string, url string) error
+}
+
+// Replaces a volume's contents with those of a snapshot.
+type RollBacker interface {
+	Rollback(name string, snapshotId string) error
+}
+
+// Clones a volume from its latest snapshot under a new name, and promotes such
+// a clone to take over a volume's name.
+type Promoter interface {
+	Clone(name string, clone string) error
+	Promote(name string, candidate string) error
+}
+
+// Freezes a mounted volume's filesystem for consistent backups, thawing it
+// automatically once the timeout expires unless it is thawed first.
+type Freezer interface {
+	Freeze(name string, timeout time.Duration) error
+	Thaw(name string) error
+}
+
+// Grows a mounted volume, and its filesystem, according to a resize policy,
+// and knows the resize policies of individual volumes, if any.  Grow takes
+// the volume's lock itself.
+type Resizer interface {
+	Grow(name string, policy ResizePolicy) error
+	ResizePolicy(name string) (ResizePolicy, bool)
+}
+
+// Takes a named snapshot of a volume.
+type Snapshotter interface {
+	Snapshot(name string, snapshot string) error
+}
+
+// Attaches a volume to this host without mounting it, so that mounting it
+// later is quick.
+type PreAttacher interface {
+	PreAttach(name string) error
 }
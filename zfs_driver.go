@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// ZFS dataset and snapshot name components blocker accepts.
+var zfsNameRegexp = regexp.MustCompile("^[A-Za-z0-9_.:-]+$")
+
+// zfsVolumeDriver serves ZFS datasets beneath a parent dataset on a local pool
+// as volumes.  Creating a volume with -o clone-from=<volume>@<snapshot> makes
+// an instant copy-on-write clone, which makes it cheap to hand every CI job
+// its own copy of a large fixture.  Unlike EBS volumes, removing a ZFS volume
+// destroys it.
+type zfsVolumeDriver struct {
+	parent string
+	mounts *mountTable
+}
+
+func NewZfsVolumeDriver(parent string) (VolumeDriver, error) {
+	if parent == "" {
+		return nil, errors.New("No parent dataset given for the zfs driver.")
+	}
+	if out, err := exec.Command(
+		"zfs", "list", "-H", "-o", "name", parent).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ZFS dataset %v not found: %v\n%v",
+			parent, err, string(out))
+	}
+
+	log("Serving volumes from ZFS dataset %v\n", parent)
+	return &zfsVolumeDriver{parent: parent, mounts: newMountTable()}, nil
+}
+
+func (d *zfsVolumeDriver) dataset(volume string) (string, error) {
+	if !zfsNameRegexp.MatchString(volume) {
+		return "", fmt.Errorf("Invalid ZFS volume name %q.", volume)
+	}
+	return d.parent + "/" + volume, nil
+}
+
+func zfs(args ...string) error {
+	if out, err := exec.Command("zfs", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("zfs %v failed: %v\n%v",
+			strings.Join(args, " "), err, string(out))
+	}
+	return nil
+}
+
+func (d *zfsVolumeDriver) Create(name string, opts map[string]string) error {
+	volume, _ := parsePath(name)
+	dataset, err := d.dataset(volume)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"-o", "mountpoint=" + mountPath(volume),
+		"-o", "canmount=noauto",
+	}
+	if quota, ok := opts["quota"]; ok {
+		args = append(args, "-o", "quota="+quota)
+	}
+	if source, ok := opts["clone-from"]; ok {
+		parts := strings.SplitN(source, "@", 2)
+		if len(parts) != 2 || !zfsNameRegexp.MatchString(parts[0]) ||
+			!zfsNameRegexp.MatchString(parts[1]) {
+			return fmt.Errorf(
+				"Invalid clone-from option %q: expected <volume>@<snapshot>.", source)
+		}
+		args = append(append([]string{"clone"}, args...),
+			d.parent+"/"+source, dataset)
+	} else {
+		args = append(append([]string{"create"}, args...), dataset)
+	}
+	return zfs(args...)
+}
+
+func (d *zfsVolumeDriver) Mount(name string, id string) (string, error) {
+	volume, folder := parsePath(name)
+	dataset, err := d.dataset(volume)
+	if err != nil {
+		return "", err
+	}
+	mnt := mountPath(volume)
+
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err != nil {
+		if err := zfs("mount", dataset); err != nil {
+			return "", err
+		}
+	}
+	d.mounts.add(volume, dataset, mnt, id, mnt+folder)
+	return mnt + folder, nil
+}
+
+func (d *zfsVolumeDriver) Path(name string) (string, error) {
+	volume, folder := parsePath(name)
+	mnt := mountPath(volume)
+	if err := exec.Command("mountpoint", "-q", mnt).Run(); err != nil {
+		return "", errors.New("Volume not mounted.")
+	}
+	return mnt + folder, nil
+}
+
+func (d *zfsVolumeDriver) Remove(name string) error {
+	volume, _ := parsePath(name)
+	dataset, err := d.dataset(volume)
+	if err != nil {
+		return err
+	}
+	d.mounts.remove(volume)
+	return zfs("destroy", "-r", dataset)
+}
+
+func (d *zfsVolumeDriver) Unmount(name string, id string) error {
+	volume, folder := parsePath(name)
+	dataset, err := d.dataset(volume)
+	if err != nil {
+		return err
+	}
+	if d.mounts.release(volume, id, mountPath(volume)+folder) > 0 {
+		// Other containers are still using the volume.
+		return nil
+	}
+	if err := zfs("unmount", dataset); err != nil {
+		return err
+	}
+	d.mounts.remove(volume)
+	return nil
+}
+
+// Snapshot takes a ZFS snapshot of a volume, from which other volumes can
+// then be cloned.
+func (d *zfsVolumeDriver) Snapshot(name string, snapshot string) error {
+	volume, _ := parsePath(name)
+	dataset, err := d.dataset(volume)
+	if err != nil {
+		return err
+	}
+	if !zfsNameRegexp.MatchString(snapshot) {
+		return fmt.Errorf("Invalid snapshot name %q.", snapshot)
+	}
+	return zfs("snapshot", dataset+"@"+snapshot)
+}
+
+func (d *zfsVolumeDriver) Mounts() []MountInfo {
+	return d.mounts.list()
+}
+
+func (d *zfsVolumeDriver) RestoreMounts(mounts []MountInfo) {
+	d.mounts.restore(mounts)
+}
+
+func (d *zfsVolumeDriver) Info() map[string]string {
+	return map[string]string{
+		"Driver": "zfs",
+		"Parent": d.parent,
+	}
+}